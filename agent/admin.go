@@ -2,17 +2,23 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"context"
 	"encoding/json"
+	"github.com/lucas-chi/push-service/id"
 	myrpc "github.com/lucas-chi/push-service/rpc"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // PushPrivate handle for push private message.
+// If url param async is set, the message is enqueued to the async push queue and the job id returned.
+// Url params ttl, priority and collapse_key see PushOpts.
+// If url param deliver_at (unix time) is in the future, the push is scheduled and the schedule id returned.
 func PushPrivate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method Not Allowed", 405)
@@ -32,10 +38,33 @@ func PushPrivate(w http.ResponseWriter, r *http.Request) {
 	body = string(bodyBytes)
 	params := r.URL.Query()
 	key := params.Get("key")
-	expire, err := strconv.ParseUint(params.Get("expire"), 10, 32)
+	opts, err := parsePushOpts(params)
 	if err != nil {
 		res["ret"] = ParamErr
-		log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", params.Get("expire"), err)
+		return
+	}
+	rm := json.RawMessage(bodyBytes)
+	msg, err := rm.MarshalJSON()
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("json.RawMessage(\"%s\").MarshalJSON() error(%v)", body, err)
+		return
+	}
+	deliverAt, err := parseDeliverAt(params)
+	if err != nil {
+		res["ret"] = ParamErr
+		return
+	}
+	// scheduled push, store and return the schedule id
+	if deliverAt > time.Now().Unix() {
+		ctx, cancel := httpContext(r)
+		defer cancel()
+		res["ret"] = schedulePush(ctx, res, []string{key}, msg, opts, deliverAt)
+		return
+	}
+	// async push, enqueue and return the job id
+	if params.Get("async") != "" {
+		res["ret"] = enqueuePush(res, []string{key}, msg, opts)
 		return
 	}
 	node := myrpc.GetComet(key)
@@ -48,25 +77,35 @@ func PushPrivate(w http.ResponseWriter, r *http.Request) {
 		res["ret"] = NotFoundServer
 		return
 	}
-	rm := json.RawMessage(bodyBytes)
-	msg, err := rm.MarshalJSON()
-	if err != nil {
-		res["ret"] = ParamErr
-		log.Error("json.RawMessage(\"%s\").MarshalJSON() error(%v)", body, err)
-		return
-	}
-	args := &myrpc.CometPushPrivateArgs{Msg: json.RawMessage(msg), Expire: uint(expire), Key: key}
-	ret := 0
-	if err := client.Call(myrpc.CometServicePushPrivate, args, &ret); err != nil {
-		log.Error("client.Call(\"%s\", \"%s\", &ret) error(%v)", myrpc.CometServicePushPrivate, args.Key, err)
-		res["ret"] = InternalErr
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := pushPrivate(ctx, client, key, msg, opts); err != nil {
+		res["ret"] = rpcErrRet(err)
 		return
 	}
 	return
 }
 
+// pushPrivate push the private message to the comet node of the key, if
+// the key has no live connection it`s notified through the push gateways.
+func pushPrivate(ctx context.Context, client *myrpc.WeightRpc, key string, msg []byte, opts *PushOpts) error {
+	args := &myrpc.CometPushPrivateArgs{Msg: json.RawMessage(msg), Expire: opts.Expire, ExpireAt: opts.ExpireAt, Priority: opts.Priority, CollapseKey: opts.CollapseKey, Devices: opts.Devices, ExDevices: opts.ExDevices, Key: key}
+	resp := &myrpc.CometPushPrivateResp{}
+	if err := client.CallContext(ctx, myrpc.CometServicePushPrivate, args, resp); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", resp) error(%v)", myrpc.CometServicePushPrivate, args.Key, err)
+		return err
+	}
+	if resp.Online == 0 {
+		notifyOffline([]string{key}, msg, resp.MsgId, opts)
+	}
+	return nil
+}
+
 // PushMultiPrivate handle for push multiple private messages.
 // Because of it`s going asynchronously in this method, so it won`t return a InternalErr to caller.
+// If url param async is set, the message is enqueued to the async push queue and the job id returned.
+// Url params ttl, priority and collapse_key see PushOpts.
+// If url param deliver_at (unix time) is in the future, the push is scheduled and the schedule id returned.
 func PushMultiPrivate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method Not Allowed", 405)
@@ -97,19 +136,139 @@ func PushMultiPrivate(w http.ResponseWriter, r *http.Request) {
 	}
 	// url param
 	params := r.URL.Query()
-	expire, err := strconv.ParseUint(params.Get("expire"), 10, 32)
+	opts, err := parsePushOpts(params)
 	if err != nil {
 		res["ret"] = ParamErr
-		log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", params.Get("expire"), err)
+		return
+	}
+	deliverAt, err := parseDeliverAt(params)
+	if err != nil {
+		res["ret"] = ParamErr
+		return
+	}
+	// scheduled push, store and return the schedule id
+	if deliverAt > time.Now().Unix() {
+		ctx, cancel := httpContext(r)
+		defer cancel()
+		res["ret"] = schedulePush(ctx, res, keys, msg, opts, deliverAt)
+		return
+	}
+	// async push, enqueue and return the job id
+	if params.Get("async") != "" {
+		res["ret"] = enqueuePush(res, keys, msg, opts)
 		return
 	}
 	// match nodes
-	nodes := map[*myrpc.CometNodeInfo]*[]string{}
+	nodes, nKeys := matchNodes(keys)
+	if len(nKeys) != 0 {
+		res["ret"] = NotFoundServer
+		return
+	}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	fKeys := pushNodes(ctx, nodes, msg, opts)
+	res["ret"] = OK
+	if len(fKeys) != 0 {
+		res["data"] = map[string]interface{}{"fk": fKeys}
+	}
+	return
+}
+
+// PushPublic handle for push a public message to every online key of all the comet nodes.
+// The public message is only delivered online, never stored offline.
+// Url params ttl and priority see PushOpts, the nodes failed are returned in fn.
+func PushPublic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	if len(bodyBytes) == 0 || !json.Valid(bodyBytes) {
+		res["ret"] = ParamErr
+		return
+	}
+	params := r.URL.Query()
+	// public messages are never stored offline
+	params.Set("expire", "0")
+	opts, err := parsePushOpts(params)
+	if err != nil {
+		res["ret"] = ParamErr
+		return
+	}
+	infos := myrpc.CometNodes()
+	nodes := make([]string, 0, len(infos))
+	for node := range infos {
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		res["ret"] = NotFoundServer
+		return
+	}
+	mid := id.Get()
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	fNodes, n := pushPublic(ctx, nodes, bodyBytes, mid, opts)
+	data := map[string]interface{}{"mid": mid, "pushed": n}
+	if len(fNodes) != 0 {
+		data["fn"] = fNodes
+	}
+	res["data"] = data
+	return
+}
+
+// pushPublic push the public message to the comet nodes concurrently, the
+// failed nodes and the pushed channel count are returned. a retry must use
+// the same mid, so the clients can drop the duplicates.
+func pushPublic(ctx context.Context, nodes []string, msg []byte, mid int64, opts *PushOpts) (fNodes []string, pushed int) {
+	var (
+		infos = myrpc.CometNodes()
+		args  = &myrpc.CometPushPublicArgs{MsgId: mid, Msg: json.RawMessage(msg), ExpireAt: opts.ExpireAt, Priority: opts.Priority}
+		mutex = &sync.Mutex{}
+		wg    = &sync.WaitGroup{}
+	)
+	for _, node := range nodes {
+		info := infos[node]
+		if info == nil || info.Rpc == nil {
+			log.Error("node:%s cannot get comet rpc client", node)
+			fNodes = append(fNodes, node)
+			continue
+		}
+		wg.Add(1)
+		go func(node string, client *myrpc.WeightRpc) {
+			defer wg.Done()
+			ret := 0
+			err := client.CallContext(ctx, myrpc.CometServicePushPublic, args, &ret)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Error("node:%s client.Call(\"%s\", %d, &ret) error(%v)", node, myrpc.CometServicePushPublic, mid, err)
+				fNodes = append(fNodes, node)
+				return
+			}
+			pushed += ret
+		}(node, info.Rpc)
+	}
+	wg.Wait()
+	return
+}
+
+// matchNodes group the keys by comet node, keys which can`t match a comet node are returned in nKeys.
+func matchNodes(keys []string) (nodes map[*myrpc.CometNodeInfo]*[]string, nKeys []string) {
+	nodes = map[*myrpc.CometNodeInfo]*[]string{}
 	for i := 0; i < len(keys); i++ {
 		node := myrpc.GetComet(keys[i])
 		if node == nil || node.Rpc == nil {
-			res["ret"] = NotFoundServer
-			return
+			nKeys = append(nKeys, keys[i])
+			continue
 		}
 		keysTmp, ok := nodes[node]
 		if ok {
@@ -118,8 +277,67 @@ func PushMultiPrivate(w http.ResponseWriter, r *http.Request) {
 			nodes[node] = &([]string{keys[i]})
 		}
 	}
-	var fKeys []string
-	//push to every node
+	return
+}
+
+// PushOpts is the delivery options of a push.
+type PushOpts struct {
+	Expire      uint     `json:"expire"`                 // offline store second
+	ExpireAt    int64    `json:"expire_at,omitempty"`    // delivery deadline unix time, 0 never
+	TTL         int64    `json:"-"`                      // the ttl param, a scheduled push counts it from the delivery time
+	Priority    int      `json:"priority,omitempty"`     // the higher is delivered first
+	CollapseKey string   `json:"collapse_key,omitempty"` // replace the undelivered message with the same key
+	Notify      bool     `json:"notify,omitempty"`       // notify the offline keys through the push gateways
+	Alert       string   `json:"alert,omitempty"`        // the push gateway notification text
+	Devices     []string `json:"devices,omitempty"`      // only push to the devices, empty all
+	ExDevices   []string `json:"exdevices,omitempty"`    // not push to the devices
+}
+
+// parsePushOpts get the push options from the url params:
+// expire: offline store second, required.
+// ttl: not delivered after ttl second from the delivery, deliver_at if scheduled, optional.
+// priority: the higher is delivered first, optional.
+// collapse_key: replace the undelivered message with the same key, optional.
+// notify: if set, notify the keys without live connection through the push gateways, optional.
+// alert: the push gateway notification text, empty for a silent notification, optional.
+// devices, exdevices: the device ids joined through ',' to push to or not, optional.
+func parsePushOpts(params url.Values) (*PushOpts, error) {
+	opts := &PushOpts{CollapseKey: params.Get("collapse_key"), Notify: params.Get("notify") != "", Alert: params.Get("alert")}
+	if devices := params.Get("devices"); devices != "" {
+		opts.Devices = strings.Split(devices, ",")
+	}
+	if exDevices := params.Get("exdevices"); exDevices != "" {
+		opts.ExDevices = strings.Split(exDevices, ",")
+	}
+	expire, err := strconv.ParseUint(params.Get("expire"), 10, 32)
+	if err != nil {
+		log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", params.Get("expire"), err)
+		return nil, err
+	}
+	opts.Expire = uint(expire)
+	if ttlStr := params.Get("ttl"); ttlStr != "" {
+		ttl, err := strconv.ParseUint(ttlStr, 10, 32)
+		if err != nil {
+			log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", ttlStr, err)
+			return nil, err
+		}
+		if ttl > 0 {
+			opts.TTL = int64(ttl)
+			opts.ExpireAt = time.Now().Unix() + opts.TTL
+		}
+	}
+	if priorityStr := params.Get("priority"); priorityStr != "" {
+		if opts.Priority, err = strconv.Atoi(priorityStr); err != nil {
+			log.Error("strconv.Atoi(\"%s\") error(%v)", priorityStr, err)
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// pushNodes push the message to every comet node, return the failed keys,
+// the keys without live connection are notified through the push gateways.
+func pushNodes(ctx context.Context, nodes map[*myrpc.CometNodeInfo]*[]string, msg []byte, opts *PushOpts) (fKeys []string) {
 	for cometInfo, ks := range nodes {
 		client := cometInfo.Rpc
 		if client == nil {
@@ -127,19 +345,16 @@ func PushMultiPrivate(w http.ResponseWriter, r *http.Request) {
 			fKeys = append(fKeys, *ks...)
 			continue
 		}
-		args := &myrpc.CometPushPrivatesArgs{Msg: json.RawMessage(msg), Expire: uint(expire), Keys: *ks}
+		args := &myrpc.CometPushPrivatesArgs{Msg: json.RawMessage(msg), Expire: opts.Expire, ExpireAt: opts.ExpireAt, Priority: opts.Priority, CollapseKey: opts.CollapseKey, Devices: opts.Devices, ExDevices: opts.ExDevices, Keys: *ks}
 		resp := myrpc.CometPushPrivatesResp{}
-		if err := client.Call(myrpc.CometServicePushPrivates, args, &resp); err != nil {
+		if err := client.CallContext(ctx, myrpc.CometServicePushPrivates, args, &resp); err != nil {
 			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.CometServicePushPrivates, args.Keys, err)
 			fKeys = append(fKeys, *ks...)
 			continue
 		}
 		log.Debug("fkeys len(%d) addr:%v", len(resp.FKeys), cometInfo.RpcAddr)
 		fKeys = append(fKeys, resp.FKeys...)
-	}
-	res["ret"] = OK
-	if len(fKeys) != 0 {
-		res["data"] = map[string]interface{}{"fk": fKeys}
+		notifyOffline(resp.OKeys, msg, resp.MsgId, opts)
 	}
 	return
 }
@@ -206,9 +421,101 @@ func DelPrivate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ret := 0
-	if err := client.Call(myrpc.MessageServiceDelPrivate, key, &ret); err != nil {
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceDelPrivate, key, &ret); err != nil {
 		log.Error("client.Call(\"%s\", \"%s\", &ret) error(%v)", myrpc.MessageServiceDelPrivate, key, err)
-		res["ret"] = InternalErr
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	return
+}
+
+// GetPushJob handle for get the async push job status.
+func GetPushJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	jid := params.Get("jid")
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	if jid == "" || PushQueue == nil {
+		res["ret"] = ParamErr
+		return
+	}
+	job, err := PushQueue.Get(jid)
+	if err != nil {
+		res["ret"] = NotFoundJob
+		return
+	}
+	res["data"] = job
+	return
+}
+
+// GetDeadJobs handle for list the dead async push jobs.
+func GetDeadJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	if PushQueue == nil {
+		res["ret"] = ParamErr
+		return
+	}
+	res["data"] = map[string]interface{}{"jobs": PushQueue.Dead()}
+	return
+}
+
+// RetryDeadJob handle for move a dead async push job back to the queue.
+func RetryDeadJob(w http.ResponseWriter, r *http.Request) {
+	deadJobOp(w, r, func(jid string) error { return PushQueue.Retry(jid) })
+}
+
+// DelDeadJob handle for delete a dead async push job.
+func DelDeadJob(w http.ResponseWriter, r *http.Request) {
+	deadJobOp(w, r, func(jid string) error { return PushQueue.Del(jid) })
+}
+
+// deadJobOp parse the job id from the post body then do the op.
+func deadJobOp(w http.ResponseWriter, r *http.Request, op func(string) error) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	jid := params.Get("jid")
+	if jid == "" || PushQueue == nil {
+		res["ret"] = ParamErr
+		return
+	}
+	if err = op(jid); err != nil {
+		if err == ErrJobNotExist {
+			res["ret"] = NotFoundJob
+		} else {
+			res["ret"] = InternalErr
+		}
 		return
 	}
 	return
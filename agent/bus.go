@@ -0,0 +1,178 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lucas-chi/push-service/bus"
+	"github.com/lucas-chi/push-service/id"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"time"
+)
+
+const (
+	// bus push command types
+	BusPushPrivate  = "private"
+	BusPushMPrivate = "mprivate"
+	BusPushPublic   = "public"
+)
+
+var (
+	ErrBusCommand = errors.New("bus push command error")
+	ErrBusExpired = errors.New("bus push command expired")
+)
+
+// BusPushCommand is the json schema of the push commands consumed from the bus.
+// eg: {"type":"private","key":"key1","msg":{"body":"hello"},"expire":3600}
+// or: {"type":"mprivate","keys":["key1","key2"],"msg":{"body":"hello"},"expire":3600}
+// or: {"type":"public","msg":{"body":"hello"}}, public messages are only delivered online.
+// the optional expire_at, priority, collapse_key, notify, alert, devices and exdevices see PushOpts, expired commands are skipped.
+type BusPushCommand struct {
+	Type string          `json:"type"`
+	Key  string          `json:"key"`
+	Keys []string        `json:"keys"`
+	Msg  json.RawMessage `json:"msg"`
+	PushOpts
+}
+
+// InitBus start consuming push commands from the bus if enabled.
+func InitBus() error {
+	if !Conf.BusEnable {
+		return nil
+	}
+	c, err := bus.NewConsumer(Conf.BusType, Conf.BusAddr, Conf.BusTopic, Conf.BusChannel)
+	if err != nil {
+		log.Error("bus.NewConsumer(\"%s\", \"%s\", \"%s\", \"%s\") error(%v)", Conf.BusType, Conf.BusAddr, Conf.BusTopic, Conf.BusChannel, err)
+		return err
+	}
+	go consumeBus(c)
+	return nil
+}
+
+// consumeBus fetch the push commands, commit only after the push succeed,
+// if the consumer broken then reconnect.
+func consumeBus(c bus.Consumer) {
+	for {
+		m, err := c.Fetch()
+		if err != nil {
+			log.Error("bus consumer Fetch() error(%v), reconnect in %v", err, Conf.BusRetryDelay)
+			c.Close()
+			c = reconnectBus()
+			continue
+		}
+		cmd := &BusPushCommand{}
+		if err = json.Unmarshal(m.Body, cmd); err != nil {
+			// bad command never succeed, skip it
+			log.Error("json.Unmarshal(\"%s\") error(%v), skip the bus message", string(m.Body), err)
+			c.Commit(m)
+			continue
+		}
+		if err = handleBusCommand(cmd); err != nil {
+			if err == ErrBusCommand || err == ErrBusExpired {
+				log.Error("bus message: \"%s\" error(%v), skip it", string(m.Body), err)
+				c.Commit(m)
+				continue
+			}
+			log.Error("bus message: \"%s\" push error(%v), requeue", string(m.Body), err)
+			if err = c.Requeue(m, Conf.BusRetryDelay); err != nil {
+				log.Error("bus consumer Requeue() error(%v)", err)
+			}
+			continue
+		}
+		if err = c.Commit(m); err != nil {
+			log.Error("bus consumer Commit() error(%v)", err)
+		}
+	}
+}
+
+// reconnectBus create a new consumer, block till succeed.
+func reconnectBus() bus.Consumer {
+	for {
+		time.Sleep(Conf.BusRetryDelay)
+		c, err := bus.NewConsumer(Conf.BusType, Conf.BusAddr, Conf.BusTopic, Conf.BusChannel)
+		if err != nil {
+			log.Error("bus.NewConsumer() error(%v), retry in %v", err, Conf.BusRetryDelay)
+			continue
+		}
+		return c
+	}
+}
+
+// handleBusCommand push the command through the private, multiple private and public push paths.
+// the failed keys are retried Conf.BusRetry times, if still failed the whole command
+// is requeued, so keys may receive the message more than once.
+func handleBusCommand(cmd *BusPushCommand) error {
+	if len(cmd.Msg) == 0 {
+		return ErrBusCommand
+	}
+	if cmd.ExpireAt > 0 && cmd.ExpireAt <= time.Now().Unix() {
+		return ErrBusExpired
+	}
+	var keys []string
+	switch cmd.Type {
+	case BusPushPrivate:
+		if cmd.Key == "" {
+			return ErrBusCommand
+		}
+		keys = []string{cmd.Key}
+	case BusPushMPrivate:
+		if len(cmd.Keys) == 0 {
+			return ErrBusCommand
+		}
+		keys = cmd.Keys
+	case BusPushPublic:
+		return handleBusPublic(cmd)
+	default:
+		return ErrBusCommand
+	}
+	for i := 0; i < Conf.BusRetry; i++ {
+		if i > 0 {
+			time.Sleep(Conf.BusRetryDelay)
+		}
+		nodes, fKeys := matchNodes(keys)
+		ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+		if cmd.Type == BusPushPrivate {
+			for node := range nodes {
+				if err := pushPrivate(ctx, node.Rpc, cmd.Key, cmd.Msg, &cmd.PushOpts); err != nil {
+					fKeys = append(fKeys, cmd.Key)
+				}
+			}
+		} else {
+			fKeys = append(fKeys, pushNodes(ctx, nodes, cmd.Msg, &cmd.PushOpts)...)
+		}
+		cancel()
+		if len(fKeys) == 0 {
+			return nil
+		}
+		log.Warn("bus push %d keys failed, attempt: %d", len(fKeys), i+1)
+		keys = fKeys
+	}
+	return ErrInternal
+}
+
+// handleBusPublic push the public command to every comet node, the failed
+// nodes are retried Conf.BusRetry times with the same message id.
+func handleBusPublic(cmd *BusPushCommand) error {
+	nodes := make([]string, 0, len(myrpc.CometNodes()))
+	for node := range myrpc.CometNodes() {
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		return ErrCometNodeNotExist
+	}
+	mid := id.Get()
+	for i := 0; i < Conf.BusRetry; i++ {
+		if i > 0 {
+			time.Sleep(Conf.BusRetryDelay)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+		nodes, _ = pushPublic(ctx, nodes, cmd.Msg, mid, &cmd.PushOpts)
+		cancel()
+		if len(nodes) == 0 {
+			return nil
+		}
+		log.Warn("bus push public %d nodes failed, attempt: %d", len(nodes), i+1)
+	}
+	return ErrInternal
+}
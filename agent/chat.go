@@ -0,0 +1,260 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"context"
+	"encoding/json"
+	"github.com/lucas-chi/push-service/id"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// default number of the listed chat sessions
+	defaultChatSessionNum = 50
+	// default page size of the chat history
+	defaultChatHistoryNum = 20
+)
+
+// GetChatSessions handle for list the active chat sessions and their operators.
+func GetChatSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	limit := defaultChatSessionNum
+	if nStr := params.Get("n"); nStr != "" {
+		n, err := strconv.Atoi(nStr)
+		if err != nil || n <= 0 {
+			res["ret"] = ParamErr
+			log.Error("strconv.Atoi(\"%s\") error(%v)", nStr, err)
+			return
+		}
+		limit = n
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	args := &myrpc.MessageGetChatSessionsArgs{Limit: limit}
+	reply := &myrpc.MessageGetChatSessionsResp{}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceGetChatSessions, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetChatSessions, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"sessions": reply.Sessions}
+	return
+}
+
+// GetChatHistory handle for get a page of the history of a chat session.
+// url params: sid, before (message id, empty means from the latest) and n (page size).
+func GetChatHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	sid := params.Get("sid")
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	if sid == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	args := &myrpc.MessageGetConversationArgs{SessionId: sid, Limit: defaultChatHistoryNum}
+	if beforeStr := params.Get("before"); beforeStr != "" {
+		before, err := strconv.ParseInt(beforeStr, 10, 64)
+		if err != nil || before < 0 {
+			res["ret"] = ParamErr
+			log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", beforeStr, err)
+			return
+		}
+		args.Before = before
+	}
+	if nStr := params.Get("n"); nStr != "" {
+		n, err := strconv.Atoi(nStr)
+		if err != nil || n <= 0 {
+			res["ret"] = ParamErr
+			log.Error("strconv.Atoi(\"%s\") error(%v)", nStr, err)
+			return
+		}
+		args.Limit = n
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	reply := &myrpc.MessageGetConversationResp{}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceGetConversation, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetConversation, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"msgs": reply.Msgs, "more": reply.More}
+	return
+}
+
+// ClaimChatSession handle for an operator take over a chat session from the robot.
+func ClaimChatSession(w http.ResponseWriter, r *http.Request) {
+	chatOperatorOp(w, r, myrpc.MessageServiceClaimChatSession)
+}
+
+// ReleaseChatSession handle for an operator hand a chat session back to the robot.
+func ReleaseChatSession(w http.ResponseWriter, r *http.Request) {
+	chatOperatorOp(w, r, myrpc.MessageServiceReleaseChatSession)
+}
+
+// chatOperatorOp parse the session id and operator from the post body then
+// call the message service method, the current operator is returned in data.
+func chatOperatorOp(w http.ResponseWriter, r *http.Request, method string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	args := &myrpc.MessageChatOperatorArgs{SessionId: params.Get("sid"), Operator: params.Get("operator")}
+	if args.SessionId == "" || args.Operator == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	reply := &myrpc.MessageChatOperatorResp{}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err = myrpc.Call(ctx, client, method, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", method, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"operator": reply.Operator}
+	// claimed by another operator
+	if reply.Operator != "" && reply.Operator != args.Operator {
+		res["ret"] = ChatClaimed
+	}
+	return
+}
+
+// ReplyChatSession handle for an operator reply to a claimed chat session,
+// the post body is the message json, the url params are sid and operator.
+func ReplyChatSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params := r.URL.Query()
+	sid := params.Get("sid")
+	operator := params.Get("operator")
+	if sid == "" || operator == "" || !json.Valid(bodyBytes) {
+		res["ret"] = ParamErr
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	// only the owner can reply
+	owner := &myrpc.MessageChatOperatorResp{}
+	if err = myrpc.Call(ctx, client, myrpc.MessageServiceTouchChatSession, sid, owner); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", reply) error(%v)", myrpc.MessageServiceTouchChatSession, sid, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	if owner.Operator != operator {
+		res["ret"] = ChatClaimed
+		res["data"] = map[string]interface{}{"operator": owner.Operator}
+		return
+	}
+	mid, err := pushChatMsg(ctx, sid, myrpc.ChatRoleOperator, json.RawMessage(bodyBytes))
+	if err != nil {
+		if err == ErrCometNodeNotExist {
+			res["ret"] = NotFoundServer
+		} else {
+			res["ret"] = rpcErrRet(err)
+		}
+		return
+	}
+	res["data"] = map[string]interface{}{"mid": mid}
+	return
+}
+
+// pushChatMsg save the message with the sender role to the session history
+// then push it to the session through the comet node, return the message id.
+func pushChatMsg(ctx context.Context, sid, role string, msg json.RawMessage) (int64, error) {
+	node := myrpc.GetComet(sid)
+	if node == nil || node.Rpc == nil {
+		return 0, ErrCometNodeNotExist
+	}
+	mid := id.Get()
+	ret := 0
+	saveArgs := &myrpc.MessageSaveUserMsgArgs{SessionId: sid, Msg: msg, MsgId: mid, Expire: userMsgExpire, Role: role}
+	if err := myrpc.Call(ctx, myrpc.MessageRPC.Get(), myrpc.MessageServiceSaveUserMsg, saveArgs, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSaveUserMsg, saveArgs, err)
+		return 0, err
+	}
+	m := &myrpc.Message{Msg: msg, MsgId: mid, Role: role, Ctime: time.Now().Unix()}
+	reply := &myrpc.MessageGetResp{Msgs: []*myrpc.Message{m}}
+	replyJson, err := json.Marshal(reply)
+	if err != nil {
+		log.Error("json.Marshal(%v) error(%v)", reply, err)
+		return 0, err
+	}
+	// chat replies jump the queue of the notifications
+	args := &myrpc.CometPushPrivateArgs{Msg: json.RawMessage(replyJson), Expire: 0, Priority: myrpc.PriorityHigh, Key: sid}
+	if err = node.Rpc.CallContext(ctx, myrpc.CometServicePushPrivate, args, &myrpc.CometPushPrivateResp{}); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", resp) error(%v)", myrpc.CometServicePushPrivate, args.Key, err)
+		return 0, err
+	}
+	return mid, nil
+}
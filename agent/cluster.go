@@ -0,0 +1,144 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	myzk "github.com/lucas-chi/push-service/zk"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cometNodeStat is the topology and health of a comet node.
+type cometNodeStat struct {
+	*myrpc.CometNodeInfo
+	Ownership float64               `json:"ownership"` // percent of the keys hashed to the node
+	Stats     *myrpc.CometStatsResp `json:"stats,omitempty"`
+	Error     string                `json:"error,omitempty"`
+}
+
+// GetClusterComets handle for get the comet nodes with the weights, the
+// addresses, the hash ring ownership and the channel/connection counts.
+func GetClusterComets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	nodes := myrpc.CometNodes()
+	ownership := myrpc.CometOwnership()
+	stats := make(map[string]*cometNodeStat, len(nodes))
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	for node, info := range nodes {
+		if info == nil {
+			continue
+		}
+		st := &cometNodeStat{CometNodeInfo: info, Ownership: ownership[node] * 100}
+		stats[node] = st
+		if info.Rpc == nil {
+			st.Error = myrpc.ErrNoClient.Error()
+			continue
+		}
+		wg.Add(1)
+		go func(node string, st *cometNodeStat) {
+			defer wg.Done()
+			resp := &myrpc.CometStatsResp{}
+			if err := st.Rpc.CallContext(ctx, myrpc.CometServiceStats, 0, resp); err != nil {
+				log.Error("node:%s client.Call(\"%s\", 0, resp) error(%v)", node, myrpc.CometServiceStats, err)
+				st.Error = err.Error()
+				return
+			}
+			st.Stats = resp
+		}(node, st)
+	}
+	wg.Wait()
+	res["data"] = map[string]interface{}{"comets": stats}
+	return
+}
+
+// GetClusterBackends handle for get the message and agent rpc backends of the
+// random load balancers, every backend is pinged for the status.
+func GetClusterBackends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	var (
+		message, agent []*myrpc.BackendStatus
+		wg             = &sync.WaitGroup{}
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		message = myrpc.MessageRPC.Status(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		agent = myrpc.AgentRPC.Status(ctx)
+	}()
+	wg.Wait()
+	res["data"] = map[string]interface{}{"message": message, "agent": agent}
+	return
+}
+
+// ChangeCometWeight handle for change the weight of a comet node in zookeeper.
+// post form: node, weight. every agent watching the node rebuilds the ring,
+// one of them notifies the comets to migrate, the comets close the moved
+// channels in stages.
+func ChangeCometWeight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	node := params.Get("node")
+	weight, err := strconv.Atoi(params.Get("weight"))
+	if node == "" || err != nil || weight <= 0 {
+		res["ret"] = ParamErr
+		return
+	}
+	if agentZK == nil {
+		res["ret"] = InternalErr
+		return
+	}
+	old, err := myrpc.SetCometWeight(agentZK, Conf.ZookeeperCometPath, node, weight)
+	if err == myzk.ErrNodeNotExist || err == myzk.ErrNoChild {
+		res["ret"] = NotFoundServer
+		return
+	} else if err != nil {
+		log.Error("myrpc.SetCometWeight(\"%s\", %d) error(%v)", node, weight, err)
+		res["ret"] = InternalErr
+		return
+	}
+	res["data"] = map[string]interface{}{"old": old, "weight": weight}
+	return
+}
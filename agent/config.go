@@ -4,6 +4,7 @@ package main
 import (
 	"flag"
 	"github.com/lucas-chi/push-service/conf"
+	"github.com/lucas-chi/push-service/robot"
 	"runtime"
 	"time"
 )
@@ -38,7 +39,54 @@ type Config struct {
 	ZookeeperAgentNodeWeight int	   `goconf:"zookeeper:agent.nodeweight"`
 	RPCRetry             time.Duration `goconf:"rpc:retry:time"`
 	RPCPing              time.Duration `goconf:"rpc:ping:time"`
+	RPCTimeout           time.Duration `goconf:"rpc:timeout:time"`
 	RPCBind				 []string  	   `goconf:"rpc:bind"`
+	// async push
+	AsyncEnable          bool          `goconf:"async:enable"`
+	AsyncDir             string        `goconf:"async:dir"`
+	AsyncWorker          int           `goconf:"async:worker"`
+	AsyncQueueSize       int           `goconf:"async:queue.size"`
+	AsyncMaxPending      int           `goconf:"async:pending.max"`
+	AsyncRetry           int           `goconf:"async:retry"`
+	AsyncBackoff         time.Duration `goconf:"async:backoff:time"`
+	AsyncMaxBackoff      time.Duration `goconf:"async:backoff.max:time"`
+	// message bus
+	BusEnable            bool          `goconf:"bus:enable"`
+	BusType              string        `goconf:"bus:type"`
+	BusAddr              string        `goconf:"bus:addr"`
+	BusTopic             string        `goconf:"bus:topic"`
+	BusChannel           string        `goconf:"bus:channel"`
+	BusRetry             int           `goconf:"bus:retry"`
+	BusRetryDelay        time.Duration `goconf:"bus:retry.delay:time"`
+	// webhook
+	WebhookURL           []string      `goconf:"webhook:url:,"`
+	WebhookSecret        string        `goconf:"webhook:secret"`
+	WebhookTimeout       time.Duration `goconf:"webhook:timeout:time"`
+	WebhookRetry         int           `goconf:"webhook:retry"`
+	WebhookRetryDelay    time.Duration `goconf:"webhook:retry.delay:time"`
+	WebhookReply         bool          `goconf:"webhook:reply"`
+	WebhookPresenceURL   []string      `goconf:"webhook:presence.url:,"`
+	WebhookAckURL        []string      `goconf:"webhook:ack.url:,"`
+	// schedule
+	ScheduleEnable       bool          `goconf:"schedule:enable"`
+	ScheduleInterval     time.Duration `goconf:"schedule:interval:time"`
+	ScheduleBatch        int           `goconf:"schedule:batch"`
+	ScheduleRetry        int           `goconf:"schedule:retry"`
+	ScheduleRetryDelay   time.Duration `goconf:"schedule:retry.delay:time"`
+	// notify
+	NotifyAPNsURL        string        `goconf:"notify:apns.url"`
+	NotifyAPNsAuth       string        `goconf:"notify:apns.auth"`
+	NotifyAPNsTopic      string        `goconf:"notify:apns.topic"`
+	NotifyFCMURL         string        `goconf:"notify:fcm.url"`
+	NotifyFCMAuth        string        `goconf:"notify:fcm.auth"`
+	NotifyTimeout        time.Duration `goconf:"notify:timeout:time"`
+	NotifyWorker         int           `goconf:"notify:worker"`
+	NotifyQueueSize      int           `goconf:"notify:queue.size"`
+	// robot
+	RobotType            string        `goconf:"robot:type"`
+	RobotSource          string        `goconf:"robot:source"`
+	RobotTimeout         time.Duration `goconf:"robot:timeout:time"`
+	RobotWelcome         string        `goconf:"robot:welcome"`
 }
 
 // InitConfig init configuration file.
@@ -68,7 +116,43 @@ func InitConfig() error {
 		ZookeeperAgentNodeWeight: 1,
 		RPCRetry:             3 * time.Second,
 		RPCPing:              1 * time.Second,
+		RPCTimeout:           3 * time.Second,
 		RPCBind:            []string{"localhost:8191"},
+		AsyncEnable:          false,
+		AsyncDir:             "./async",
+		AsyncWorker:          runtime.NumCPU(),
+		AsyncQueueSize:       1024,
+		AsyncMaxPending:      102400,
+		AsyncRetry:           8,
+		AsyncBackoff:         1 * time.Second,
+		AsyncMaxBackoff:      5 * time.Minute,
+		BusEnable:            false,
+		BusType:              "nsq",
+		BusAddr:              "localhost:4150",
+		BusTopic:             "push",
+		BusChannel:           "agent",
+		BusRetry:             3,
+		BusRetryDelay:        1 * time.Second,
+		WebhookURL:           []string{},
+		WebhookTimeout:       2 * time.Second,
+		WebhookRetry:         2,
+		WebhookRetryDelay:    200 * time.Millisecond,
+		WebhookReply:         false,
+		WebhookPresenceURL:   []string{},
+		WebhookAckURL:        []string{},
+		ScheduleEnable:       false,
+		ScheduleInterval:     1 * time.Second,
+		ScheduleBatch:        100,
+		ScheduleRetry:        3,
+		ScheduleRetryDelay:   10 * time.Second,
+		NotifyAPNsURL:        "https://api.push.apple.com",
+		NotifyFCMURL:         "https://fcm.googleapis.com/fcm/send",
+		NotifyTimeout:        5 * time.Second,
+		NotifyWorker:         runtime.NumCPU(),
+		NotifyQueueSize:      1024,
+		RobotType:            robot.DictType,
+		RobotTimeout:         2 * time.Second,
+		RobotWelcome:         "尊敬的用户，我将竭诚为您服务",
 	}
 	if err := gconf.Unmarshal(Conf); err != nil {
 		return err
@@ -10,8 +10,11 @@ import (
 )
 
 const (
-	wsProto  = "1"
-	tcpProto = "2"
+	wsProto       = "1"
+	tcpProto      = "2"
+	sseProto      = "3"
+	longpollProto = "4"
+	mqttProto     = "5"
 )
 
 // GetServer handle for server get
@@ -105,9 +108,11 @@ func GetOfflineMsg(w http.ResponseWriter, r *http.Request) {
 		res["ret"] = InternalErr
 		return
 	}
-	if err := client.Call(myrpc.MessageServiceGetPrivate, args, reply); err != nil {
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceGetPrivate, args, reply); err != nil {
 		log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPrivate, args, err)
-		res["ret"] = InternalErr
+		res["ret"] = rpcErrRet(err)
 		return
 	}
 	if len(reply.Msgs) == 0 {
@@ -138,6 +143,12 @@ func getProtoAddr(node *myrpc.CometNodeInfo, p string) (addrs []string, ret int)
 		addrs = node.WsAddr
 	} else if p == tcpProto {
 		addrs = node.TcpAddr
+	} else if p == sseProto {
+		addrs = node.SseAddr
+	} else if p == longpollProto {
+		addrs = node.PollAddr
+	} else if p == mqttProto {
+		addrs = node.MqttAddr
 	} else {
 		ret = ParamErr
 		return
@@ -3,6 +3,7 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"context"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -26,7 +27,28 @@ func StartHTTP() {
 	// 1.0
 	httpAdminServeMux.HandleFunc("/1/admin/push/private", PushPrivate)
 	httpAdminServeMux.HandleFunc("/1/admin/push/mprivate", PushMultiPrivate)
+	httpAdminServeMux.HandleFunc("/1/admin/push/public", PushPublic)
 	httpAdminServeMux.HandleFunc("/1/admin/msg/del", DelPrivate)
+	httpAdminServeMux.HandleFunc("/1/admin/push/job/get", GetPushJob)
+	httpAdminServeMux.HandleFunc("/1/admin/push/dead/list", GetDeadJobs)
+	httpAdminServeMux.HandleFunc("/1/admin/push/dead/retry", RetryDeadJob)
+	httpAdminServeMux.HandleFunc("/1/admin/push/dead/del", DelDeadJob)
+	httpAdminServeMux.HandleFunc("/1/admin/push/schedule/list", GetSchedules)
+	httpAdminServeMux.HandleFunc("/1/admin/push/schedule/cancel", CancelSchedule)
+	httpAdminServeMux.HandleFunc("/1/admin/presence", GetPresence)
+	httpAdminServeMux.HandleFunc("/1/admin/kick", KickDevice)
+	httpAdminServeMux.HandleFunc("/1/admin/conn/close", CloseConn)
+	httpAdminServeMux.HandleFunc("/1/admin/device/register", RegisterDevice)
+	httpAdminServeMux.HandleFunc("/1/admin/device/unregister", UnregisterDevice)
+	httpAdminServeMux.HandleFunc("/1/admin/device/list", GetDevices)
+	httpAdminServeMux.HandleFunc("/1/admin/cluster/comets", GetClusterComets)
+	httpAdminServeMux.HandleFunc("/1/admin/cluster/backends", GetClusterBackends)
+	httpAdminServeMux.HandleFunc("/1/admin/comet/weight", ChangeCometWeight)
+	httpAdminServeMux.HandleFunc("/1/admin/chat/sessions", GetChatSessions)
+	httpAdminServeMux.HandleFunc("/1/admin/chat/history", GetChatHistory)
+	httpAdminServeMux.HandleFunc("/1/admin/chat/claim", ClaimChatSession)
+	httpAdminServeMux.HandleFunc("/1/admin/chat/release", ReleaseChatSession)
+	httpAdminServeMux.HandleFunc("/1/admin/chat/reply", ReplyChatSession)
 
 	for _, bind := range Conf.HttpBind {
 		log.Info("start http listen addr:\"%s\"", bind)
@@ -52,6 +74,12 @@ func httpListen(mux *http.ServeMux, bind string) {
 	}
 }
 
+// httpContext return a context for the rpc calls of a http request, it`s done
+// when the client goes away or the http server timeout is reached.
+func httpContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), Conf.HttpServerTimeout)
+}
+
 // retWrite marshal the result and write to client(get).
 func retWrite(w http.ResponseWriter, r *http.Request, res map[string]interface{}, callback string, start time.Time) {
 	data, err := json.Marshal(res)
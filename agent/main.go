@@ -24,6 +24,12 @@ func main() {
 	log.LoadConfiguration(Conf.Log)
 	defer log.Close()
 	
+	// init robot
+	if err = InitRobot(); err != nil {
+		panic(err)
+	}
+	// init webhook client
+	InitWebhook()
 	// init rpc service
 	if err = InitRPC(); err != nil {
 		panic(err)
@@ -37,6 +43,20 @@ func main() {
 		}
 		panic(err)
 	}
+	// init async push queue
+	if err = InitPushQueue(); err != nil {
+		panic(err)
+	}
+	// init message bus consumer
+	if err = InitBus(); err != nil {
+		panic(err)
+	}
+	// init push gateway notifiers
+	if err = InitNotifier(); err != nil {
+		panic(err)
+	}
+	// init scheduled push
+	InitScheduler()
 	// start pprof http
 	perf.Init(Conf.PprofBind)
 	// start http listen.
@@ -0,0 +1,211 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"context"
+	"encoding/json"
+	"github.com/lucas-chi/push-service/notify"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// platform -> notifier, only the platforms with auth configured
+	Notifiers = map[string]notify.Notifier{}
+	notifyCH  chan *notifyJob
+)
+
+// notifyJob is the offline keys of a push waiting for notifying.
+type notifyJob struct {
+	Keys  []string
+	Msg   json.RawMessage
+	MsgId int64
+	Opts  *PushOpts
+}
+
+// InitNotifier create the push gateway notifiers which auth configured and
+// start the notify workers.
+func InitNotifier() error {
+	gateways := []struct {
+		platform, url, auth, topic string
+	}{
+		{notify.APNsPlatform, Conf.NotifyAPNsURL, Conf.NotifyAPNsAuth, Conf.NotifyAPNsTopic},
+		{notify.FCMPlatform, Conf.NotifyFCMURL, Conf.NotifyFCMAuth, ""},
+	}
+	for _, g := range gateways {
+		if g.auth == "" {
+			continue
+		}
+		n, err := notify.NewNotifier(g.platform, g.url, g.auth, g.topic, Conf.NotifyTimeout)
+		if err != nil {
+			log.Error("notify.NewNotifier(\"%s\", \"%s\") error(%v)", g.platform, g.url, err)
+			return err
+		}
+		Notifiers[g.platform] = n
+		log.Info("notify platform: %s gateway: %s", g.platform, g.url)
+	}
+	if len(Notifiers) == 0 {
+		return nil
+	}
+	notifyCH = make(chan *notifyJob, Conf.NotifyQueueSize)
+	for i := 0; i < Conf.NotifyWorker; i++ {
+		go notifyProc()
+	}
+	return nil
+}
+
+// notifyOffline notify the offline keys through the push gateways if the
+// push opted in, the job is dropped when the queue is full.
+func notifyOffline(keys []string, msg []byte, mid int64, opts *PushOpts) {
+	if !opts.Notify || len(keys) == 0 {
+		return
+	}
+	if notifyCH == nil {
+		log.Warn("no notify platform configured, skip offline keys: %v", keys)
+		return
+	}
+	select {
+	case notifyCH <- &notifyJob{Keys: keys, Msg: json.RawMessage(msg), MsgId: mid, Opts: opts}:
+	default:
+		log.Warn("notify queue full, drop offline keys: %v", keys)
+	}
+}
+
+// notifyProc send the notifications to the devices of the offline keys.
+func notifyProc() {
+	for job := range notifyCH {
+		client := myrpc.MessageRPC.Get()
+		args := &myrpc.MessageGetDeviceTokensArgs{Keys: job.Keys}
+		reply := &myrpc.MessageGetDeviceTokensResp{}
+		ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+		err := myrpc.Call(ctx, client, myrpc.MessageServiceGetDeviceTokens, args, reply)
+		cancel()
+		if err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetDeviceTokens, args.Keys, err)
+			continue
+		}
+		for key, tokens := range reply.Tokens {
+			for _, t := range tokens {
+				n, ok := Notifiers[t.Platform]
+				if !ok {
+					continue
+				}
+				err := n.Notify(&notify.Notification{Token: t.Token, Alert: job.Opts.Alert, Msg: job.Msg, MsgId: job.MsgId, Priority: job.Opts.Priority, CollapseKey: job.Opts.CollapseKey, ExpireAt: job.Opts.ExpireAt})
+				if err == notify.ErrTokenInvalid {
+					log.Info("user_key:\"%s\" %s token: \"%s\" invalid, unregister", key, t.Platform, t.Token)
+					unregisterDevice(key, t.Platform, t.Token)
+				} else if err != nil {
+					log.Error("user_key:\"%s\" %s notify error(%v)", key, t.Platform, err)
+				}
+			}
+		}
+	}
+}
+
+// unregisterDevice delete the device token from the message service.
+func unregisterDevice(key, platform, token string) error {
+	args := &myrpc.MessageDeviceTokenArgs{Key: key, Platform: platform, Token: token}
+	ret := 0
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+	defer cancel()
+	if err := myrpc.Call(ctx, myrpc.MessageRPC.Get(), myrpc.MessageServiceDelDeviceToken, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceDelDeviceToken, args, err)
+		return err
+	}
+	return nil
+}
+
+// RegisterDevice handle for register a push gateway device token of a key.
+// post form: key, platform (apns or fcm), token.
+func RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	deviceOp(w, r, myrpc.MessageServiceSaveDeviceToken)
+}
+
+// UnregisterDevice handle for unregister a push gateway device token of a key.
+// post form: key, platform (apns or fcm), token.
+func UnregisterDevice(w http.ResponseWriter, r *http.Request) {
+	deviceOp(w, r, myrpc.MessageServiceDelDeviceToken)
+}
+
+// deviceOp call the message service method with the posted device token.
+func deviceOp(w http.ResponseWriter, r *http.Request, method string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	args := &myrpc.MessageDeviceTokenArgs{Key: params.Get("key"), Platform: params.Get("platform"), Token: params.Get("token")}
+	if args.Key == "" || args.Token == "" || (args.Platform != notify.APNsPlatform && args.Platform != notify.FCMPlatform) {
+		res["ret"] = ParamErr
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	ret := 0
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, method, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", method, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	return
+}
+
+// GetDevices handle for get the registered device tokens of the keys.
+// url param key joined through ','.
+func GetDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	k := params.Get("key")
+	if k == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	args := &myrpc.MessageGetDeviceTokensArgs{Keys: strings.Split(k, ",")}
+	reply := &myrpc.MessageGetDeviceTokensResp{}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceGetDeviceTokens, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetDeviceTokens, args.Keys, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"devices": reply.Tokens}
+	return
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetPresence handle for get the online state of the keys.
+// url param key joined through ',', the presence of every key is got from
+// the comet node the key hashed to, the failed keys are returned in fk.
+func GetPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	k := params.Get("key")
+	if k == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	nodes, fKeys := matchNodes(strings.Split(k, ","))
+	presences := map[string]*myrpc.Presence{}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	for cometInfo, ks := range nodes {
+		args := &myrpc.CometPresenceArgs{Keys: *ks}
+		resp := &myrpc.CometPresenceResp{}
+		if err := cometInfo.Rpc.CallContext(ctx, myrpc.CometServicePresence, args, resp); err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", resp) error(%v)", myrpc.CometServicePresence, args.Keys, err)
+			fKeys = append(fKeys, *ks...)
+			continue
+		}
+		for key, p := range resp.Presences {
+			presences[key] = p
+		}
+		fKeys = append(fKeys, resp.FKeys...)
+	}
+	data := map[string]interface{}{"presence": presences}
+	if len(fKeys) != 0 {
+		data["fk"] = fKeys
+	}
+	res["data"] = data
+	return
+}
+
+// PresenceEvent expored a method for notifying a key goes online or offline,
+// the event is posted to the presence webhook targets asynchronously.
+func (c *AgentRPC) PresenceEvent(args *myrpc.AgentPresenceEventArgs, ret *int) error {
+	if args == nil || args.Key == "" {
+		return myrpc.ErrParam
+	}
+	if len(Conf.WebhookPresenceURL) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		log.Error("json.Marshal(\"%v\") error(%v)", args, err)
+		return err
+	}
+	for _, u := range Conf.WebhookPresenceURL {
+		go postWebhook(u, body)
+	}
+	return nil
+}
+
+// AckEvent expored a method for notifying a client acked a pushed message,
+// the event is posted to the ack webhook targets asynchronously.
+func (c *AgentRPC) AckEvent(args *myrpc.AgentAckEventArgs, ret *int) error {
+	if args == nil || args.Key == "" {
+		return myrpc.ErrParam
+	}
+	if len(Conf.WebhookAckURL) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		log.Error("json.Marshal(\"%v\") error(%v)", args, err)
+		return err
+	}
+	for _, u := range Conf.WebhookAckURL {
+		go postWebhook(u, body)
+	}
+	return nil
+}
+
+// KickDevice handle for close the connections of a device of the key.
+// post form: key, device.
+func KickDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	args := &myrpc.CometKickArgs{Key: params.Get("key"), Device: params.Get("device")}
+	if args.Key == "" || args.Device == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	node := myrpc.GetComet(args.Key)
+	if node == nil || node.Rpc == nil {
+		res["ret"] = NotFoundServer
+		return
+	}
+	ret := 0
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := node.Rpc.CallContext(ctx, myrpc.CometServiceKick, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.CometServiceKick, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"kicked": ret}
+	return
+}
+
+// CloseConn handle for close all or the devices connections of the key.
+// post form: key, devices joined through ',' (optional, empty all), reason
+// code sent to the client before closing (optional, default "k"), ban the
+// re-subscription second (optional).
+func CloseConn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	args := &myrpc.CometCloseConnArgs{Key: params.Get("key"), Reason: params.Get("reason")}
+	if args.Key == "" || !myrpc.ValidCloseReason(args.Reason) {
+		res["ret"] = ParamErr
+		return
+	}
+	if devices := params.Get("devices"); devices != "" {
+		args.Devices = strings.Split(devices, ",")
+	}
+	if banStr := params.Get("ban"); banStr != "" {
+		if args.Ban, err = strconv.ParseInt(banStr, 10, 64); err != nil || args.Ban < 0 {
+			log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", banStr, err)
+			res["ret"] = ParamErr
+			return
+		}
+	}
+	node := myrpc.GetComet(args.Key)
+	if node == nil || node.Rpc == nil {
+		res["ret"] = NotFoundServer
+		return
+	}
+	ret := 0
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := node.Rpc.CallContext(ctx, myrpc.CometServiceCloseConn, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.CometServiceCloseConn, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"closed": ret}
+	return
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lucas-chi/push-service/id"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// push job status
+	JobPending = "pending"
+	JobDone    = "done"
+	JobDead    = "dead"
+	JobExpired = "expired"
+	// queue sub dirs
+	queueDirName = "queue"
+	deadDirName  = "dead"
+	jobFileExt   = ".json"
+	// keep the latest done jobs for status query
+	doneJobNum = 10240
+)
+
+var (
+	PushQueue      *AsyncQueue
+	ErrJobNotExist = errors.New("push job not exist")
+	ErrQueueFull   = errors.New("push queue pending jobs exceed the limit")
+)
+
+// PushJob is a async push job stored in the local queue.
+type PushJob struct {
+	Id   string          `json:"id"`
+	Keys []string        `json:"keys"` // keys not delivered yet
+	Msg  json.RawMessage `json:"msg"`
+	PushOpts
+	Status  string `json:"status"`
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error,omitempty"`
+	Ctime   int64  `json:"ctime"`
+	Mtime   int64  `json:"mtime"`
+}
+
+// AsyncQueue is a durable local push queue, every pending job is a file under
+// the queue dir, permanently failed jobs are moved to the dead dir.
+type AsyncQueue struct {
+	queueDir string
+	deadDir  string
+	jobCH    chan *PushJob
+	mutex    *sync.Mutex
+	jobs     map[string]*PushJob // pending and dead jobs
+	pending  int                 // pending jobs, at most Conf.AsyncMaxPending new ones accepted
+	done     map[string]*PushJob
+	doneIds  []string
+}
+
+// InitPushQueue init the async push queue if enabled.
+func InitPushQueue() (err error) {
+	if !Conf.AsyncEnable {
+		return
+	}
+	PushQueue, err = NewAsyncQueue(Conf.AsyncDir)
+	return
+}
+
+// NewAsyncQueue create the queue dirs, load the stored jobs and start the workers.
+func NewAsyncQueue(dir string) (*AsyncQueue, error) {
+	q := &AsyncQueue{
+		queueDir: filepath.Join(dir, queueDirName),
+		deadDir:  filepath.Join(dir, deadDirName),
+		jobCH:    make(chan *PushJob, Conf.AsyncQueueSize),
+		mutex:    &sync.Mutex{},
+		jobs:     map[string]*PushJob{},
+		done:     map[string]*PushJob{},
+	}
+	for _, d := range []string{q.queueDir, q.deadDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			log.Error("os.MkdirAll(\"%s\") error(%v)", d, err)
+			return nil, err
+		}
+	}
+	dead, err := loadJobs(q.deadDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range dead {
+		q.jobs[job.Id] = job
+	}
+	pending, err := loadJobs(q.queueDir)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < Conf.AsyncWorker; i++ {
+		go q.work()
+	}
+	// redeliver the jobs stored before restart
+	q.pending = len(pending)
+	for _, job := range pending {
+		q.jobs[job.Id] = job
+		go q.schedule(job, 0)
+	}
+	log.Info("async push queue \"%s\" load %d pending and %d dead jobs", dir, len(pending), len(dead))
+	return q, nil
+}
+
+// Push store a new push job and schedule it, ErrQueueFull is returned if
+// the pending jobs reach Conf.AsyncMaxPending, every pending job owns at
+// most one sleeping schedule goroutine so they are bounded too.
+func (q *AsyncQueue) Push(keys []string, msg json.RawMessage, opts *PushOpts) (*PushJob, error) {
+	now := time.Now().Unix()
+	job := &PushJob{Keys: keys, Msg: msg, PushOpts: *opts, Status: JobPending, Ctime: now, Mtime: now}
+	q.mutex.Lock()
+	if q.pending >= Conf.AsyncMaxPending {
+		q.mutex.Unlock()
+		log.Warn("push queue pending jobs: %d, reject the new job", Conf.AsyncMaxPending)
+		return nil, ErrQueueFull
+	}
+	q.pending++
+	job.Id = strconv.FormatInt(id.Get(), 10)
+	for {
+		if _, ok := q.jobs[job.Id]; !ok {
+			break
+		}
+		job.Id = strconv.FormatInt(id.Get(), 10)
+	}
+	q.jobs[job.Id] = job
+	q.mutex.Unlock()
+	if err := saveJob(q.queueDir, job); err != nil {
+		q.mutex.Lock()
+		delete(q.jobs, job.Id)
+		q.pending--
+		q.mutex.Unlock()
+		return nil, err
+	}
+	select {
+	case q.jobCH <- job:
+	default:
+		// stored in the queue dir, deliver after restart or retry
+		log.Warn("push job: %s queue full, deliver later", job.Id)
+		go q.schedule(job, Conf.AsyncBackoff)
+	}
+	return job, nil
+}
+
+// Get get a copy of the push job by id.
+func (q *AsyncQueue) Get(jid string) (*PushJob, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[jid]
+	if !ok {
+		if job, ok = q.done[jid]; !ok {
+			return nil, ErrJobNotExist
+		}
+	}
+	tmp := *job
+	return &tmp, nil
+}
+
+// Dead list the dead jobs.
+func (q *AsyncQueue) Dead() []*PushJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	jobs := []*PushJob{}
+	for _, job := range q.jobs {
+		if job.Status == JobDead {
+			tmp := *job
+			jobs = append(jobs, &tmp)
+		}
+	}
+	return jobs
+}
+
+// Retry move a dead job back to the queue.
+func (q *AsyncQueue) Retry(jid string) error {
+	q.mutex.Lock()
+	job, ok := q.jobs[jid]
+	if !ok || job.Status != JobDead {
+		q.mutex.Unlock()
+		return ErrJobNotExist
+	}
+	job.Status = JobPending
+	job.Attempt = 0
+	job.Error = ""
+	job.Mtime = time.Now().Unix()
+	q.pending++
+	q.mutex.Unlock()
+	if err := saveJob(q.queueDir, job); err != nil {
+		q.mutex.Lock()
+		job.Status = JobDead
+		q.pending--
+		q.mutex.Unlock()
+		return err
+	}
+	delJob(q.deadDir, jid)
+	go q.schedule(job, 0)
+	return nil
+}
+
+// Del delete a dead job.
+func (q *AsyncQueue) Del(jid string) error {
+	q.mutex.Lock()
+	job, ok := q.jobs[jid]
+	if !ok || job.Status != JobDead {
+		q.mutex.Unlock()
+		return ErrJobNotExist
+	}
+	delete(q.jobs, jid)
+	q.mutex.Unlock()
+	return delJob(q.deadDir, jid)
+}
+
+// schedule put the job into the worker chan after delay.
+func (q *AsyncQueue) schedule(job *PushJob, delay time.Duration) {
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	q.jobCH <- job
+}
+
+// work deliver the push jobs.
+func (q *AsyncQueue) work() {
+	for {
+		job := <-q.jobCH
+		q.deliver(job)
+	}
+}
+
+// deliver push the job to the comet nodes, failed keys are retried with
+// exponential backoff till Conf.AsyncRetry attempts.
+func (q *AsyncQueue) deliver(job *PushJob) {
+	// the retries of a stale message are pointless
+	if job.ExpireAt > 0 && job.ExpireAt <= time.Now().Unix() {
+		q.finish(job, JobExpired)
+		log.Warn("push job: %s expired at %d, attempt: %d", job.Id, job.ExpireAt, job.Attempt)
+		return
+	}
+	// only the worker which owns the job modify the keys
+	nodes, fKeys := matchNodes(job.Keys)
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+	fKeys = append(fKeys, pushNodes(ctx, nodes, job.Msg, &job.PushOpts)...)
+	cancel()
+	q.mutex.Lock()
+	job.Attempt++
+	job.Keys = fKeys
+	job.Mtime = time.Now().Unix()
+	if len(fKeys) == 0 {
+		job.Status = JobDone
+		job.Error = ""
+		delete(q.jobs, job.Id)
+		q.pending--
+		q.addDone(job)
+		q.mutex.Unlock()
+		delJob(q.queueDir, job.Id)
+		log.Debug("push job: %s done, attempt: %d", job.Id, job.Attempt)
+		return
+	}
+	job.Error = "failed keys: " + strings.Join(fKeys, ",")
+	tmp := *job
+	q.mutex.Unlock()
+	if tmp.Attempt < Conf.AsyncRetry {
+		saveJob(q.queueDir, &tmp)
+		delay := backoff(tmp.Attempt)
+		log.Warn("push job: %s attempt: %d failed, retry in %v", tmp.Id, tmp.Attempt, delay)
+		go q.schedule(job, delay)
+		return
+	}
+	// move to the dead dir before it`s visible as dead
+	log.Warn("push job: %s dead after %d attempts, %s", tmp.Id, tmp.Attempt, tmp.Error)
+	tmp.Status = JobDead
+	if err := saveJob(q.deadDir, &tmp); err == nil {
+		delJob(q.queueDir, tmp.Id)
+	}
+	q.mutex.Lock()
+	job.Status = JobDead
+	q.pending--
+	q.mutex.Unlock()
+}
+
+// finish remove the job from the queue with the final status.
+func (q *AsyncQueue) finish(job *PushJob, status string) {
+	q.mutex.Lock()
+	job.Status = status
+	job.Mtime = time.Now().Unix()
+	delete(q.jobs, job.Id)
+	q.pending--
+	q.addDone(job)
+	q.mutex.Unlock()
+	delJob(q.queueDir, job.Id)
+}
+
+// addDone keep the latest done jobs, must hold the lock.
+func (q *AsyncQueue) addDone(job *PushJob) {
+	if len(q.doneIds) >= doneJobNum {
+		delete(q.done, q.doneIds[0])
+		q.doneIds = q.doneIds[1:]
+	}
+	q.done[job.Id] = job
+	q.doneIds = append(q.doneIds, job.Id)
+}
+
+// backoff get the retry delay of the attempt.
+func backoff(attempt int) time.Duration {
+	d := Conf.AsyncBackoff
+	for i := 1; i < attempt && d < Conf.AsyncMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > Conf.AsyncMaxBackoff {
+		d = Conf.AsyncMaxBackoff
+	}
+	return d
+}
+
+// saveJob write the job to dir, replace the old one atomically.
+func saveJob(dir string, job *PushJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Error("json.Marshal(\"%v\") error(%v)", job, err)
+		return err
+	}
+	file := filepath.Join(dir, job.Id+jobFileExt)
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Error("ioutil.WriteFile(\"%s\") error(%v)", tmp, err)
+		return err
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		log.Error("os.Rename(\"%s\", \"%s\") error(%v)", tmp, file, err)
+		return err
+	}
+	return nil
+}
+
+// delJob remove the job file from dir.
+func delJob(dir, jid string) error {
+	file := filepath.Join(dir, jid+jobFileExt)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		log.Error("os.Remove(\"%s\") error(%v)", file, err)
+		return err
+	}
+	return nil
+}
+
+// loadJobs read all the jobs stored in dir.
+func loadJobs(dir string) ([]*PushJob, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error("ioutil.ReadDir(\"%s\") error(%v)", dir, err)
+		return nil, err
+	}
+	jobs := []*PushJob{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), jobFileExt) {
+			continue
+		}
+		file := filepath.Join(dir, f.Name())
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Error("ioutil.ReadFile(\"%s\") error(%v)", file, err)
+			continue
+		}
+		job := &PushJob{}
+		if err = json.Unmarshal(data, job); err != nil {
+			log.Error("json.Unmarshal(\"%s\") error(%v)", string(data), err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// enqueuePush push a job to the async queue, set the job id to res.
+func enqueuePush(res map[string]interface{}, keys []string, msg []byte, opts *PushOpts) int {
+	if PushQueue == nil {
+		log.Warn("async push queue not enabled")
+		return ParamErr
+	}
+	job, err := PushQueue.Push(keys, json.RawMessage(msg), opts)
+	if err == ErrQueueFull {
+		return QueueFull
+	} else if err != nil {
+		log.Error("PushQueue.Push(\"%v\") error(%v)", keys, err)
+		return InternalErr
+	}
+	res["data"] = map[string]interface{}{"jid": job.Id}
+	return OK
+}
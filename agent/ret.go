@@ -1,9 +1,24 @@
-
 package main
 
+import (
+	myrpc "github.com/lucas-chi/push-service/rpc"
+)
+
 const (
 	OK             = 0
 	NotFoundServer = 1001
+	NotFoundJob    = 1002
+	ChatClaimed    = 1003
+	QueueFull      = 1004
+	TimeoutErr     = 65533
 	ParamErr       = 65534
 	InternalErr    = 65535
 )
+
+// rpcErrRet map a rpc call error to the ret code.
+func rpcErrRet(err error) int {
+	if err == myrpc.ErrTimeout {
+		return TimeoutErr
+	}
+	return InternalErr
+}
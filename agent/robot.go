@@ -0,0 +1,32 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"github.com/lucas-chi/push-service/robot"
+)
+
+var (
+	Robot robot.Responder
+)
+
+// InitRobot create the robot responder, the built-in dictionary by default,
+// an empty type disables the robot. a bad type or source fails the startup.
+func InitRobot() (err error) {
+	if Conf.RobotType == "" {
+		log.Warn("robot disabled")
+		return
+	}
+	if Robot, err = robot.New(Conf.RobotType, Conf.RobotSource, Conf.RobotTimeout); err != nil {
+		log.Error("robot.New(\"%s\", \"%s\") error(%v)", Conf.RobotType, Conf.RobotSource, err)
+	}
+	return
+}
+
+// ReloadRobot reload the robot responder config if supported.
+func ReloadRobot() {
+	if r, ok := Robot.(robot.Reloader); ok {
+		if err := r.Reload(); err != nil {
+			log.Error("robot reload error(%v)", err)
+		}
+	}
+}
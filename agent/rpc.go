@@ -3,6 +3,7 @@ package main
 
 import (
 	log "code.google.com/p/log4go"
+	"context"
 	"errors"
 	myrpc "github.com/lucas-chi/push-service/rpc"
 	"github.com/lucas-chi/push-service/id"
@@ -73,43 +74,66 @@ func (c *AgentRPC) ReplyMessage(args *myrpc.MessageReplyArgs, ret *int) error {
 	}
 	
 	log.Debug("received from session id:<%s> , message:\"%s\"", args.SessionId, args.Msg)
-	reply := &myrpc.MessageGetResp{}
+	mid := id.Get()
+	// notify the application server, it may answer the reply
+	var (
+		replyMsg json.RawMessage
+		replies  *WebhookReplies
+	)
+	if !args.NewSession {
+		replies = PostWebhooks(args, mid)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+	defer cancel()
+	
+	// keep the session active in the operator console
+	owner := &myrpc.MessageChatOperatorResp{}
+	if err := myrpc.Call(ctx, myrpc.MessageRPC.Get(), myrpc.MessageServiceTouchChatSession, args.SessionId, owner); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", reply) error(%v)", myrpc.MessageServiceTouchChatSession, args.SessionId, err)
+	}
 	
 	if args.NewSession {
-		reply = robot.Welcome()
+		replyMsg = robot.Body(Conf.RobotWelcome)
 	} else {
-		//reply = robot.FindReply(string(args.Msg))
-		
-		messageClient := myrpc.MessageRPC.Get()
-		
 		// save user message
-		saveArgs := &myrpc.MessageSaveUserMsgArgs{SessionId: args.SessionId, Msg: args.Msg, MsgId: id.Get(), Expire: userMsgExpire}
+		saveArgs := &myrpc.MessageSaveUserMsgArgs{SessionId: args.SessionId, Msg: args.Msg, MsgId: mid, Expire: userMsgExpire, Role: myrpc.ChatRoleUser}
 		
-		if err := messageClient.Call(myrpc.MessageServiceSaveUserMsg, saveArgs, &ret); err != nil {
+		if err := myrpc.Call(ctx, myrpc.MessageRPC.Get(), myrpc.MessageServiceSaveUserMsg, saveArgs, &ret); err != nil {
 			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSaveUserMsg, saveArgs, err)
 			return err
 		}
 		
-		// get user message
-		getArgs := &myrpc.MessageGetUserMsgArgs{SessionId: args.SessionId}
+		// the session is handed off to an operator, who replies through the console
+		if owner.Operator != "" {
+			log.Debug("session id:<%s> claimed by operator:\"%s\", skip the robot", args.SessionId, owner.Operator)
+			return nil
+		}
 		
-		if err := messageClient.Call(myrpc.MessageServiceGetUserMsg, getArgs, reply); err != nil {
-			log.Error("client.Call(\"%s\", \"%v\", resp) error(%v)", myrpc.MessageServiceGetUserMsg, getArgs, err)
-			return err
+		// webhook reply first, then the robot. the wait is bounded by a single
+		// webhook timeout, so the call still has time left to push the reply.
+		if replies != nil {
+			wctx, wcancel := context.WithTimeout(ctx, Conf.WebhookTimeout)
+			replyMsg = replies.Wait(wctx)
+			wcancel()
+		}
+		if replyMsg == nil && Robot != nil {
+			if text, err := Robot.Reply(args.SessionId, string(args.Msg)); err == nil {
+				replyMsg = robot.Body(text)
+			} else if err != robot.ErrNoReply {
+				log.Error("Robot.Reply(\"%s\") error(%v)", args.SessionId, err)
+			}
+		}
+		if replyMsg == nil {
+			log.Debug("session id:<%s> no reply", args.SessionId)
+			return nil
 		}
 	}
 	
-	replyJson, err :=json.Marshal(reply)
-	if err != nil {
-		log.Error("json.Marshal(%v) error(%v)", replyJson, err)
-		return err
-	}
-	
-	pushArgs := &myrpc.CometPushPrivateArgs{Msg: json.RawMessage(replyJson), Expire: 0, Key: args.SessionId}
-	log.Debug("reply to session id:<%s> , message:\"%s\"", args.SessionId, string(replyJson))
-	
-	if err := cometClient.Call(myrpc.CometServicePushPrivate, pushArgs, &ret); err != nil {
-		log.Error("client.Call(\"%s\", \"%s\", &ret) error(%v)", myrpc.CometServicePushPrivate, pushArgs.Key, err)
+	// only the new reply is pushed, the history is got by the conversation api
+	if _, err := pushChatMsg(ctx, args.SessionId, myrpc.ChatRoleBot, replyMsg); err != nil {
+		if err == myrpc.ErrTimeout || err == ErrCometNodeNotExist {
+			return err
+		}
 		return ErrInternal
 	}
 	
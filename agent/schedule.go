@@ -0,0 +1,266 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"context"
+	"encoding/json"
+	"github.com/lucas-chi/push-service/id"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultScheduleNum = 50
+)
+
+// InitScheduler start firing the due scheduled pushes if enabled, the
+// schedules are stored in the message service, every due schedule is taken
+// by only one agent.
+func InitScheduler() {
+	if !Conf.ScheduleEnable {
+		return
+	}
+	go schedule()
+}
+
+// schedule poll the due schedules every Conf.ScheduleInterval.
+func schedule() {
+	ticker := time.NewTicker(Conf.ScheduleInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		for {
+			n, err := fireDueSchedules()
+			if err != nil || n < Conf.ScheduleBatch {
+				break
+			}
+		}
+	}
+}
+
+// fireDueSchedules take a batch of due schedules and push them, return the
+// number of schedules taken.
+func fireDueSchedules() (int, error) {
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		return 0, myrpc.ErrNoClient
+	}
+	args := &myrpc.MessagePopDueSchedulesArgs{Now: time.Now().Unix(), Limit: Conf.ScheduleBatch}
+	reply := &myrpc.MessageSchedulesResp{}
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServicePopDueSchedules, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServicePopDueSchedules, args, err)
+		return 0, err
+	}
+	for _, sp := range reply.Schedules {
+		fireSchedule(sp)
+	}
+	return len(reply.Schedules), nil
+}
+
+// fireSchedule push the schedule through the private or multiple private
+// push path, if the async push queue enabled it`s enqueued for retry. the
+// popped schedule is gone from the storage, the failed keys are requeued.
+func fireSchedule(sp *myrpc.SchedulePush) {
+	opts := &PushOpts{Expire: sp.Expire, ExpireAt: sp.ExpireAt, Priority: sp.Priority, CollapseKey: sp.CollapseKey, Notify: sp.Notify, Alert: sp.Alert, Devices: sp.Devices, ExDevices: sp.ExDevices}
+	if opts.ExpireAt > 0 && opts.ExpireAt <= time.Now().Unix() {
+		log.Warn("schedule: %s expired at %d, skip", sp.Id, opts.ExpireAt)
+		return
+	}
+	if PushQueue != nil {
+		job, err := PushQueue.Push(sp.Keys, sp.Msg, opts)
+		if err != nil {
+			log.Error("schedule: %s PushQueue.Push() error(%v)", sp.Id, err)
+			requeueSchedule(sp, sp.Keys)
+			return
+		}
+		log.Info("schedule: %s enqueued push job: %s", sp.Id, job.Id)
+		return
+	}
+	nodes, fKeys := matchNodes(sp.Keys)
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+	defer cancel()
+	if len(sp.Keys) == 1 {
+		for node := range nodes {
+			if err := pushPrivate(ctx, node.Rpc, sp.Keys[0], sp.Msg, opts); err != nil {
+				fKeys = append(fKeys, sp.Keys[0])
+			}
+		}
+	} else {
+		fKeys = append(fKeys, pushNodes(ctx, nodes, sp.Msg, opts)...)
+	}
+	if len(fKeys) > 0 {
+		log.Error("schedule: %s push failed keys: %v", sp.Id, fKeys)
+		requeueSchedule(sp, fKeys)
+		return
+	}
+	log.Info("schedule: %s pushed %d keys", sp.Id, len(sp.Keys))
+}
+
+// requeueSchedule store the schedule again with the failed keys, it fires
+// after Conf.ScheduleRetryDelay, at most Conf.ScheduleRetry times.
+func requeueSchedule(sp *myrpc.SchedulePush, keys []string) {
+	if sp.Attempts >= Conf.ScheduleRetry {
+		log.Error("schedule: %s failed %d attempts, drop keys: %v", sp.Id, sp.Attempts+1, keys)
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("schedule: %s requeue error(%v), drop keys: %v", sp.Id, myrpc.ErrNoClient, keys)
+		return
+	}
+	sp.Keys = keys
+	sp.Attempts++
+	sp.DeliverAt = time.Now().Add(Conf.ScheduleRetryDelay).Unix()
+	ret := 0
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.RPCTimeout)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceSaveSchedule, sp, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", &ret) error(%v), drop keys: %v", myrpc.MessageServiceSaveSchedule, sp.Id, err, keys)
+		return
+	}
+	log.Warn("schedule: %s requeued %d keys, attempt: %d", sp.Id, len(keys), sp.Attempts)
+}
+
+// parseDeliverAt get the url param deliver_at unix time, 0 if not scheduled.
+func parseDeliverAt(params url.Values) (int64, error) {
+	deliverStr := params.Get("deliver_at")
+	if deliverStr == "" {
+		return 0, nil
+	}
+	deliverAt, err := strconv.ParseInt(deliverStr, 10, 64)
+	if err != nil {
+		log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", deliverStr, err)
+		return 0, err
+	}
+	return deliverAt, nil
+}
+
+// schedulePush store a scheduled push, set the schedule id to res.
+func schedulePush(ctx context.Context, res map[string]interface{}, keys []string, msg []byte, opts *PushOpts, deliverAt int64) int {
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		return InternalErr
+	}
+	sp := &myrpc.SchedulePush{
+		Id:          strconv.FormatInt(id.Get(), 10),
+		Keys:        keys,
+		Msg:         json.RawMessage(msg),
+		DeliverAt:   deliverAt,
+		Expire:      opts.Expire,
+		ExpireAt:    opts.ExpireAt,
+		Priority:    opts.Priority,
+		CollapseKey: opts.CollapseKey,
+		Notify:      opts.Notify,
+		Alert:       opts.Alert,
+		Devices:     opts.Devices,
+		ExDevices:   opts.ExDevices,
+		Ctime:       time.Now().Unix(),
+	}
+	if opts.TTL > 0 {
+		// the ttl counts from the delivery, not the request
+		sp.TTL = opts.TTL
+		sp.ExpireAt = deliverAt + opts.TTL
+	}
+	ret := 0
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceSaveSchedule, sp, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", &ret) error(%v)", myrpc.MessageServiceSaveSchedule, sp.Id, err)
+		return rpcErrRet(err)
+	}
+	res["data"] = map[string]interface{}{"sid": sp.Id}
+	return OK
+}
+
+// GetSchedules handle for list the pending scheduled pushes ordered by delivery time.
+func GetSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	limit := defaultScheduleNum
+	if nStr := params.Get("n"); nStr != "" {
+		n, err := strconv.Atoi(nStr)
+		if err != nil || n <= 0 {
+			res["ret"] = ParamErr
+			log.Error("strconv.Atoi(\"%s\") error(%v)", nStr, err)
+			return
+		}
+		limit = n
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	args := &myrpc.MessageGetSchedulesArgs{Limit: limit}
+	reply := &myrpc.MessageSchedulesResp{}
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceGetSchedules, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetSchedules, args, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	res["data"] = map[string]interface{}{"schedules": reply.Schedules}
+	return
+}
+
+// CancelSchedule handle for cancel a pending scheduled push.
+func CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	sid := params.Get("sid")
+	if sid == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	ret := 0
+	ctx, cancel := httpContext(r)
+	defer cancel()
+	if err := myrpc.Call(ctx, client, myrpc.MessageServiceDelSchedule, sid, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", &ret) error(%v)", myrpc.MessageServiceDelSchedule, sid, err)
+		res["ret"] = rpcErrRet(err)
+		return
+	}
+	if ret == 0 {
+		// fired or not exist
+		res["ret"] = NotFoundJob
+	}
+	return
+}
@@ -25,8 +25,7 @@ func HandleSignal(c chan os.Signal) {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
 			return
 		case syscall.SIGHUP:
-			// TODO reload
-			//return
+			ReloadRobot()
 		default:
 			return
 		}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookSignHeader = "X-Push-Signature"
+	webhookTimeHeader = "X-Push-Timestamp"
+	webhookMaxBody    = 64 * 1024
+)
+
+var (
+	ErrWebhookStatus = errors.New("webhook response status error")
+)
+
+// WebhookUpstream is the body posted to the webhook targets for every upstream message.
+type WebhookUpstream struct {
+	SessionId string          `json:"sessionId"`
+	Msg       json.RawMessage `json:"msg"`
+	MsgId     int64           `json:"mid"`
+	Node      string          `json:"node"`
+}
+
+var (
+	// shared by all the webhook posts, so the connections are reused
+	webhookClient *http.Client
+)
+
+// InitWebhook init the webhook http client.
+func InitWebhook() {
+	webhookClient = &http.Client{Timeout: Conf.WebhookTimeout}
+}
+
+// WebhookReplies collect the responses of the webhook targets of one upstream message.
+type WebhookReplies struct {
+	ch chan webhookReply
+	n  int
+}
+
+type webhookReply struct {
+	i    int
+	body []byte
+}
+
+// PostWebhooks post the upstream message to all the webhook targets in the
+// background, if Conf.WebhookReply is set, the returned WebhookReplies
+// collects the responses, else nil is returned and nobody waits.
+func PostWebhooks(args *myrpc.MessageReplyArgs, mid int64) *WebhookReplies {
+	if len(Conf.WebhookURL) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(&WebhookUpstream{SessionId: args.SessionId, Msg: args.Msg, MsgId: mid, Node: args.Node})
+	if err != nil {
+		log.Error("json.Marshal() error(%v)", err)
+		return nil
+	}
+	if !Conf.WebhookReply {
+		for _, u := range Conf.WebhookURL {
+			go postWebhook(u, body)
+		}
+		return nil
+	}
+	// buffered, the late targets never block after the waiter gave up
+	w := &WebhookReplies{ch: make(chan webhookReply, len(Conf.WebhookURL)), n: len(Conf.WebhookURL)}
+	for i, u := range Conf.WebhookURL {
+		go func(i int, u string) {
+			w.ch <- webhookReply{i: i, body: postWebhook(u, body)}
+		}(i, u)
+	}
+	return w
+}
+
+// Wait wait the webhook targets until all answered or the ctx is done, return
+// the response body of the first target (in config order) which answered a
+// non-empty body, the targets not answered yet are ignored.
+func (w *WebhookReplies) Wait(ctx context.Context) json.RawMessage {
+	if w == nil {
+		return nil
+	}
+	replies := make([][]byte, w.n)
+wait:
+	for got := 0; got < w.n; got++ {
+		select {
+		case r := <-w.ch:
+			replies[r.i] = r.body
+		case <-ctx.Done():
+			log.Warn("webhook wait reply error(%v), %d targets not answered", ctx.Err(), w.n-got)
+			break wait
+		}
+	}
+	for _, r := range replies {
+		if len(bytes.TrimSpace(r)) == 0 {
+			continue
+		}
+		if json.Valid(r) {
+			return json.RawMessage(r)
+		}
+		// plain text reply
+		if b, err := json.Marshal(string(r)); err == nil {
+			return json.RawMessage(b)
+		}
+	}
+	return nil
+}
+
+// postWebhook post the body to the url, retry Conf.WebhookRetry times, return the response body.
+func postWebhook(u string, body []byte) []byte {
+	for i := 0; i <= Conf.WebhookRetry; i++ {
+		if i > 0 {
+			time.Sleep(Conf.WebhookRetryDelay)
+		}
+		reply, err := doWebhook(u, body)
+		if err != nil {
+			log.Error("webhook post \"%s\" attempt: %d error(%v)", u, i+1, err)
+			continue
+		}
+		return reply
+	}
+	return nil
+}
+
+// doWebhook do a signed webhook post.
+func doWebhook(u string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimeHeader, ts)
+	if Conf.WebhookSecret != "" {
+		req.Header.Set(webhookSignHeader, signWebhook(Conf.WebhookSecret, ts, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(io.LimitReader(resp.Body, webhookMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Warn("webhook post \"%s\" status: %d body: \"%s\"", u, resp.StatusCode, string(reply))
+		return nil, ErrWebhookStatus
+	}
+	return reply, nil
+}
+
+// signWebhook sign the timestamp and body with hmac-sha256: hex(hmac(secret, ts + "." + body)).
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -9,6 +9,11 @@ import (
 	"encoding/json"
 )
 
+var (
+	// the zookeeper connection for the admin operations
+	agentZK *zk.Conn
+)
+
 func InitZK() (*zk.Conn, error) {
 	conn, err := myzk.Connect(Conf.ZookeeperAddr, Conf.ZookeeperTimeout)
 	if err != nil {
@@ -34,7 +39,10 @@ func InitZK() (*zk.Conn, error) {
 		log.Error("zk.RegisterTemp() error(%v)", err)
 		return conn, err
 	}
+	agentZK = conn
 	myrpc.InitComet(conn, Conf.ZookeeperMigratePath, Conf.ZookeeperCometPath, Conf.RPCRetry, Conf.RPCPing)
 	myrpc.InitMessage(conn, Conf.ZookeeperMessagePath, Conf.RPCRetry, Conf.RPCPing)
+	// watch the agent nodes, this one included, for the cluster backends status
+	myrpc.InitAgent(conn, Conf.ZookeeperAgentPath, Conf.RPCRetry, Conf.RPCPing)
 	return conn, nil
 }
@@ -0,0 +1,49 @@
+package bus
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	MemBusType = "mem"
+	NSQBusType = "nsq"
+)
+
+var (
+	ErrBusType   = errors.New("unknown bus type")
+	ErrBusClosed = errors.New("bus consumer closed")
+)
+
+// Message is a message fetched from the bus topic.
+type Message struct {
+	Id       string // broker message id
+	Offset   int64  // message offset in the topic, -1 if the broker don't have
+	Attempts int    // delivery attempts
+	Body     []byte // message content
+}
+
+// The bus consumer interface.
+type Consumer interface {
+	// Fetch block till a message is available.
+	Fetch() (*Message, error)
+	// Commit mark the message consumed, it won`t be delivered again.
+	Commit(m *Message) error
+	// Requeue deliver the message again after delay.
+	Requeue(m *Message, delay time.Duration) error
+	// Close close the consumer.
+	Close() error
+}
+
+// NewConsumer create a consumer of topic for the channel (consumer group).
+// The "mem" type consume from the process embedded DefaultBroker.
+func NewConsumer(typ, addr, topic, channel string) (Consumer, error) {
+	switch typ {
+	case MemBusType:
+		return DefaultBroker.Consumer(topic, channel), nil
+	case NSQBusType:
+		return DialNSQ(addr, topic, channel)
+	default:
+		return nil, ErrBusType
+	}
+}
@@ -0,0 +1,115 @@
+package bus
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultBroker is the process embedded broker used by the "mem" bus type.
+	DefaultBroker = NewMemBroker()
+)
+
+// MemBroker is a embedded in-memory broker, every topic is a append only log
+// and every channel keep it`s committed offset like a kafka consumer group.
+type MemBroker struct {
+	mutex     *sync.Mutex
+	cond      *sync.Cond
+	topics    map[string][][]byte
+	committed map[string]int64 // topic/channel: offset
+}
+
+// NewMemBroker create a empty embedded broker.
+func NewMemBroker() *MemBroker {
+	b := &MemBroker{
+		mutex:     &sync.Mutex{},
+		topics:    map[string][][]byte{},
+		committed: map[string]int64{},
+	}
+	b.cond = sync.NewCond(b.mutex)
+	return b
+}
+
+// Publish append the message to the topic, return the message offset.
+func (b *MemBroker) Publish(topic string, body []byte) int64 {
+	b.mutex.Lock()
+	b.topics[topic] = append(b.topics[topic], body)
+	offset := int64(len(b.topics[topic]) - 1)
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+	return offset
+}
+
+// Committed get the committed offset of the topic channel.
+func (b *MemBroker) Committed(topic, channel string) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.committed[topic+"/"+channel]
+}
+
+// Consumer create a consumer start from the committed offset of the channel.
+func (b *MemBroker) Consumer(topic, channel string) *MemConsumer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	group := topic + "/" + channel
+	return &MemConsumer{broker: b, topic: topic, group: group, next: b.committed[group]}
+}
+
+// MemConsumer consume a MemBroker topic.
+type MemConsumer struct {
+	broker *MemBroker
+	topic  string
+	group  string
+	next   int64
+	closed bool
+}
+
+// Fetch implements the Consumer Fetch method.
+func (c *MemConsumer) Fetch() (*Message, error) {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for !c.closed && c.next >= int64(len(b.topics[c.topic])) {
+		b.cond.Wait()
+	}
+	if c.closed {
+		return nil, ErrBusClosed
+	}
+	offset := c.next
+	c.next++
+	return &Message{Id: strconv.FormatInt(offset, 10), Offset: offset, Attempts: 1, Body: b.topics[c.topic][offset]}, nil
+}
+
+// Commit implements the Consumer Commit method.
+func (c *MemConsumer) Commit(m *Message) error {
+	b := c.broker
+	b.mutex.Lock()
+	if m.Offset+1 > b.committed[c.group] {
+		b.committed[c.group] = m.Offset + 1
+	}
+	b.mutex.Unlock()
+	return nil
+}
+
+// Requeue implements the Consumer Requeue method, seek back to the message offset.
+func (c *MemConsumer) Requeue(m *Message, delay time.Duration) error {
+	time.Sleep(delay)
+	b := c.broker
+	b.mutex.Lock()
+	if m.Offset < c.next {
+		c.next = m.Offset
+	}
+	b.mutex.Unlock()
+	return nil
+}
+
+// Close implements the Consumer Close method.
+func (c *MemConsumer) Close() error {
+	b := c.broker
+	b.mutex.Lock()
+	c.closed = true
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+	return nil
+}
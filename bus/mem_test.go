@@ -0,0 +1,46 @@
+package bus
+
+import (
+	"testing"
+)
+
+func TestMemBroker(t *testing.T) {
+	b := NewMemBroker()
+	b.Publish("push", []byte("1"))
+	b.Publish("push", []byte("2"))
+	c := b.Consumer("push", "agent")
+	m, err := c.Fetch()
+	if err != nil {
+		t.Fatalf("c.Fetch() error(%v)", err)
+	}
+	if string(m.Body) != "1" || m.Offset != 0 {
+		t.Errorf("message error: %s(%d)", m.Body, m.Offset)
+	}
+	// requeue seek back to the message
+	if err = c.Requeue(m, 0); err != nil {
+		t.Fatalf("c.Requeue() error(%v)", err)
+	}
+	if m, err = c.Fetch(); err != nil || m.Offset != 0 {
+		t.Fatalf("requeued message not fetched again")
+	}
+	if err = c.Commit(m); err != nil {
+		t.Fatalf("c.Commit() error(%v)", err)
+	}
+	if o := b.Committed("push", "agent"); o != 1 {
+		t.Errorf("committed offset: %d, expected 1", o)
+	}
+	// uncommitted message delivered to the new consumer of the channel
+	c.Close()
+	if _, err = c.Fetch(); err != ErrBusClosed {
+		t.Errorf("closed consumer fetch error(%v)", err)
+	}
+	c = b.Consumer("push", "agent")
+	if m, err = c.Fetch(); err != nil || string(m.Body) != "2" {
+		t.Errorf("new consumer not start from the committed offset")
+	}
+	// other channel start from the beginning
+	c = b.Consumer("push", "other")
+	if m, err = c.Fetch(); err != nil || string(m.Body) != "1" {
+		t.Errorf("other channel not start from the beginning")
+	}
+}
@@ -0,0 +1,182 @@
+package bus
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// nsq protocol v2
+	nsqMagic             = "  V2"
+	nsqFrameResponse     = 0
+	nsqFrameError        = 1
+	nsqFrameMessage      = 2
+	nsqHeartbeat         = "_heartbeat_"
+	nsqMsgHeaderLen      = 26
+	nsqMaxFrameSize      = 16 * 1024 * 1024
+	nsqDialTimeout       = 5 * time.Second
+	nsqMessageChanLength = 1
+)
+
+var (
+	ErrNSQProtocol = errors.New("nsq protocol error")
+)
+
+// NSQConsumer is a minimal nsqd protocol v2 consumer, it subscribe to a
+// single nsqd and keep one message in flight (RDY 1).
+type NSQConsumer struct {
+	conn   net.Conn
+	rd     *bufio.Reader
+	wmutex *sync.Mutex
+	msgCH  chan *Message
+	errCH  chan error
+}
+
+// DialNSQ connect to nsqd addr and subscribe the topic channel.
+func DialNSQ(addr, topic, channel string) (*NSQConsumer, error) {
+	conn, err := net.DialTimeout("tcp", addr, nsqDialTimeout)
+	if err != nil {
+		log.Error("net.DialTimeout(\"tcp\", \"%s\") error(%v)", addr, err)
+		return nil, err
+	}
+	c := &NSQConsumer{
+		conn:   conn,
+		rd:     bufio.NewReader(conn),
+		wmutex: &sync.Mutex{},
+		msgCH:  make(chan *Message, nsqMessageChanLength),
+		errCH:  make(chan error, 1),
+	}
+	if err = c.write(nsqMagic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = c.write(fmt.Sprintf("SUB %s %s\n", topic, channel)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, data, err := c.readFrame()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != nsqFrameResponse || string(data) != "OK" {
+		conn.Close()
+		log.Error("nsq SUB %s %s response: %d \"%s\"", topic, channel, typ, string(data))
+		return nil, ErrNSQProtocol
+	}
+	if err = c.write("RDY 1\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	log.Info("nsq consumer subscribe \"%s\" topic: %s channel: %s", addr, topic, channel)
+	return c, nil
+}
+
+// write send a command to nsqd.
+func (c *NSQConsumer) write(cmd string) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		log.Error("nsq conn.Write(\"%s\") error(%v)", cmd, err)
+		return err
+	}
+	return nil
+}
+
+// readFrame read a frame: size(4) + frame type(4) + data.
+func (c *NSQConsumer) readFrame() (int32, []byte, error) {
+	var size, typ int32
+	if err := binary.Read(c.rd, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+	if size < 4 || size > nsqMaxFrameSize {
+		log.Error("nsq frame size: %d error", size)
+		return 0, nil, ErrNSQProtocol
+	}
+	if err := binary.Read(c.rd, binary.BigEndian, &typ); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(c.rd, data); err != nil {
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+// readLoop read the frames, answer the heartbeats and dispatch the messages.
+func (c *NSQConsumer) readLoop() {
+	for {
+		typ, data, err := c.readFrame()
+		if err != nil {
+			c.errCH <- err
+			close(c.msgCH)
+			return
+		}
+		switch typ {
+		case nsqFrameResponse:
+			if string(data) == nsqHeartbeat {
+				if err = c.write("NOP\n"); err != nil {
+					c.conn.Close()
+				}
+			}
+		case nsqFrameError:
+			log.Error("nsq error frame: \"%s\"", string(data))
+		case nsqFrameMessage:
+			if len(data) < nsqMsgHeaderLen {
+				log.Error("nsq message frame length: %d error", len(data))
+				continue
+			}
+			c.msgCH <- &Message{
+				Id:       string(data[10:26]),
+				Offset:   -1,
+				Attempts: int(binary.BigEndian.Uint16(data[8:10])),
+				Body:     data[26:],
+			}
+		default:
+			log.Error("nsq unknown frame type: %d", typ)
+		}
+	}
+}
+
+// Fetch implements the Consumer Fetch method.
+func (c *NSQConsumer) Fetch() (*Message, error) {
+	m, ok := <-c.msgCH
+	if !ok {
+		select {
+		case err := <-c.errCH:
+			if err == io.EOF {
+				return nil, ErrBusClosed
+			}
+			// keep it for the next fetch
+			c.errCH <- err
+			return nil, err
+		default:
+			return nil, ErrBusClosed
+		}
+	}
+	return m, nil
+}
+
+// Commit implements the Consumer Commit method.
+func (c *NSQConsumer) Commit(m *Message) error {
+	return c.write(fmt.Sprintf("FIN %s\n", m.Id))
+}
+
+// Requeue implements the Consumer Requeue method.
+func (c *NSQConsumer) Requeue(m *Message, delay time.Duration) error {
+	return c.write(fmt.Sprintf("REQ %s %d\n", m.Id, int64(delay/time.Millisecond)))
+}
+
+// Close implements the Consumer Close method.
+func (c *NSQConsumer) Close() error {
+	c.write("CLS\n")
+	return c.conn.Close()
+}
@@ -0,0 +1,84 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFrame write a nsq frame to conn.
+func writeFrame(conn net.Conn, typ int32, data []byte) {
+	binary.Write(conn, binary.BigEndian, int32(len(data)+4))
+	binary.Write(conn, binary.BigEndian, typ)
+	conn.Write(data)
+}
+
+func TestNSQConsumer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error(%v)", err)
+	}
+	defer l.Close()
+	cmds := make(chan string, 10)
+	// fake nsqd
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		magic := make([]byte, 4)
+		rd.Read(magic)
+		line, _ := rd.ReadString('\n')
+		cmds <- strings.TrimSpace(line)
+		writeFrame(conn, nsqFrameResponse, []byte("OK"))
+		line, _ = rd.ReadString('\n')
+		cmds <- strings.TrimSpace(line)
+		writeFrame(conn, nsqFrameResponse, []byte(nsqHeartbeat))
+		msg := make([]byte, nsqMsgHeaderLen)
+		binary.BigEndian.PutUint64(msg, uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint16(msg[8:], 1)
+		copy(msg[10:], "0123456789abcdef")
+		writeFrame(conn, nsqFrameMessage, append(msg, []byte("hello")...))
+		for {
+			line, err = rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmds <- strings.TrimSpace(line)
+		}
+	}()
+	c, err := DialNSQ(l.Addr().String(), "push", "agent")
+	if err != nil {
+		t.Fatalf("DialNSQ() error(%v)", err)
+	}
+	defer c.Close()
+	if cmd := <-cmds; cmd != "SUB push agent" {
+		t.Errorf("sub cmd: \"%s\"", cmd)
+	}
+	if cmd := <-cmds; cmd != "RDY 1" {
+		t.Errorf("rdy cmd: \"%s\"", cmd)
+	}
+	if cmd := <-cmds; cmd != "NOP" {
+		t.Errorf("heartbeat not answered: \"%s\"", cmd)
+	}
+	m, err := c.Fetch()
+	if err != nil {
+		t.Fatalf("c.Fetch() error(%v)", err)
+	}
+	if string(m.Body) != "hello" || m.Attempts != 1 {
+		t.Errorf("message error: %s(%d)", m.Body, m.Attempts)
+	}
+	c.Requeue(m, time.Second)
+	if cmd := <-cmds; cmd != "REQ 0123456789abcdef 1000" {
+		t.Errorf("req cmd: \"%s\"", cmd)
+	}
+	c.Commit(m)
+	if cmd := <-cmds; cmd != "FIN 0123456789abcdef" {
+		t.Errorf("fin cmd: \"%s\"", cmd)
+	}
+}
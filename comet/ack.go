@@ -0,0 +1,77 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ackEventQueue = 1024
+)
+
+var (
+	AckStat = &ackStat{}
+	// delivery ack events sent to the agent, nil if not enabled
+	ackEvents chan *myrpc.AgentAckEventArgs
+)
+
+// ackStat counts the delivery acks of the clients per protocol.
+type ackStat struct {
+	acks [MQTTProto + 1]int64
+}
+
+// Incr increase the ack count of the protocol.
+func (s *ackStat) Incr(proto uint8) {
+	if int(proto) < len(s.acks) {
+		atomic.AddInt64(&s.acks[proto], 1)
+	}
+}
+
+// Stat get a snapshot of the total and per protocol counts.
+func (s *ackStat) Stat() (int64, map[string]int64) {
+	total, protos := int64(0), make(map[string]int64, len(s.acks))
+	for proto := range s.acks {
+		n := atomic.LoadInt64(&s.acks[proto])
+		protos[protoName(uint8(proto))] = n
+		total += n
+	}
+	return total, protos
+}
+
+// InitAckEvent start sending the delivery ack events to the agent if
+// enabled, the events are dropped when the queue is full.
+func InitAckEvent() {
+	if !Conf.AckEvent {
+		return
+	}
+	ackEvents = make(chan *myrpc.AgentAckEventArgs, ackEventQueue)
+	go sendAckEvents()
+}
+
+// ackEvent record a delivery ack of the connection, every protocol acks
+// through here, so the stat and the agent see all of them.
+func ackEvent(key string, conn *Connection, mid int64) {
+	AckStat.Incr(conn.Proto)
+	log.Debug("user_key:\"%s\" device:\"%s\" ack mid: %d", key, conn.Device, mid)
+	if ackEvents == nil {
+		return
+	}
+	ev := &myrpc.AgentAckEventArgs{Key: key, Device: conn.Device, MsgId: mid, Proto: protoName(conn.Proto), Node: Conf.ZookeeperCometNode, Time: time.Now().Unix()}
+	select {
+	case ackEvents <- ev:
+	default:
+		log.Warn("user_key:\"%s\" ack event queue full, drop event(mid:%d)", key, mid)
+	}
+}
+
+// sendAckEvents send the queued delivery ack events to the agent.
+func sendAckEvents() {
+	ret := 0
+	for ev := range ackEvents {
+		if err := myrpc.CallTimeout(myrpc.AgentRPC.Get(), Conf.RPCTimeout, myrpc.AgentServiceAckEvent, ev, &ret); err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.AgentServiceAckEvent, ev, err)
+		}
+	}
+}
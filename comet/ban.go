@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBanned = errors.New("Subscriber banned")
+	// the banned keys and devices of this comet, the key belongs to only one
+	// comet so the subscribe check is local
+	UserBans = NewBanList()
+)
+
+// BanList is the subscribers banned till a unix time.
+type BanList struct {
+	mutex *sync.Mutex
+	bans  map[string]int64
+}
+
+// NewBanList create a empty ban list.
+func NewBanList() *BanList {
+	return &BanList{mutex: &sync.Mutex{}, bans: map[string]int64{}}
+}
+
+// banKey get the ban entry of the device of the key, empty device is the whole key.
+func banKey(key, device string) string {
+	if device == "" {
+		return key
+	}
+	return key + "\x00" + device
+}
+
+// Ban ban the devices of the key for the duration, empty devices ban the
+// whole key, the expired bans are cleaned meanwhile.
+func (b *BanList) Ban(key string, devices []string, d time.Duration) {
+	now := time.Now().Unix()
+	until := time.Now().Add(d).Unix()
+	b.mutex.Lock()
+	for k, t := range b.bans {
+		if t <= now {
+			delete(b.bans, k)
+		}
+	}
+	if len(devices) == 0 {
+		b.bans[banKey(key, "")] = until
+	}
+	for _, device := range devices {
+		b.bans[banKey(key, device)] = until
+	}
+	b.mutex.Unlock()
+}
+
+// Banned check the device of the key is banned.
+func (b *BanList) Banned(key, device string) bool {
+	now := time.Now().Unix()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if t, ok := b.bans[banKey(key, "")]; ok && t > now {
+		return true
+	}
+	if device == "" {
+		return false
+	}
+	t, ok := b.bans[banKey(key, device)]
+	return ok && t > now
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/lucas-chi/push-service/hlist"
 	"github.com/lucas-chi/push-service/ketama"
 	myrpc "github.com/lucas-chi/push-service/rpc"
+	"math"
 	"sync"
+	"time"
 )
 
 var (
@@ -18,12 +20,17 @@ var (
 	UserChannel        *ChannelList
 	CometRing          *ketama.HashRing
 	nodeWeightMap      = map[string]int{}
+	ErrMigrateBatch    = errors.New("migrate batch must be positive")
+	// stop the running staged migration
+	migrateStop  chan bool
+	migrateMutex = &sync.Mutex{}
 )
 
 // The subscriber interface.
 type Channel interface {
-	// WriteMsg push a message to the subscriber.
-	WriteMsg(key string, m *myrpc.Message) error
+	// WriteMsg push a message to the subscriber, expire > 0 means the
+	// message is stored offline.
+	WriteMsg(key string, m *myrpc.Message, expire uint) error
 	// PushMsg push a message to the subscriber.
 	PushMsg(key string, m *myrpc.Message, expire uint) error
 	// AddConn add a connection for the subscriber.
@@ -31,14 +38,22 @@ type Channel interface {
 	AddConn(key string, conn *Connection) (*hlist.Element, error)
 	// RemoveConn remove a connection for the  subscriber.
 	RemoveConn(key string, e *hlist.Element) error
+	// Presence get the live connections of the subscriber.
+	Presence() *myrpc.Presence
+	// Online get the live connection count of the subscriber the message targets.
+	Online(m *myrpc.Message) int
+	// CloseConns write the reply to the connections of the devices then
+	// close them, empty devices close all, return the closed count.
+	CloseConns(key string, devices []string, reply []byte) int
 	// Expire expire the channle and clean data.
 	Close() error
 }
 
 // Channel bucket.
 type ChannelBucket struct {
-	Data  map[string]Channel
-	mutex *sync.Mutex
+	Data   map[string]Channel
+	Writer *ConnWriter
+	mutex  *sync.Mutex
 }
 
 // Channel list.
@@ -63,8 +78,9 @@ func NewChannelList() *ChannelList {
 	log.Debug("create %d ChannelBucket", Conf.ChannelBucket)
 	for i := 0; i < Conf.ChannelBucket; i++ {
 		c := &ChannelBucket{
-			Data:  map[string]Channel{},
-			mutex: &sync.Mutex{},
+			Data:   map[string]Channel{},
+			Writer: NewConnWriter(Conf.WriterRoutine, Conf.WriterQueue),
+			mutex:  &sync.Mutex{},
 		}
 		l.Channels = append(l.Channels, c)
 	}
@@ -75,7 +91,10 @@ func NewChannelList() *ChannelList {
 func (l *ChannelList) Count() int {
 	c := 0
 	for i := 0; i < Conf.ChannelBucket; i++ {
-		c += len(l.Channels[i].Data)
+		b := l.Channels[i]
+		b.Lock()
+		c += len(b.Data)
+		b.Unlock()
 	}
 	return c
 }
@@ -191,8 +210,12 @@ func (l *ChannelList) Close() {
 	}
 }
 
-// Migrate migrate portion of connections which don't belong to this comet.
+// Migrate migrate portion of connections which don't belong to this comet,
+// the channels are closed in stages, every Conf.MigrateInterval at most
+// Conf.MigrateBatch of the migrating channels, a new migration stops the
+// running one.
 func (l *ChannelList) Migrate(nw map[string]int) (err error) {
+	migrateMutex.Lock()
 	migrate := false
 	// check new/update node
 	for k, v := range nw {
@@ -214,6 +237,7 @@ func (l *ChannelList) Migrate(nw map[string]int) (err error) {
 		}
 	}
 	if !migrate {
+		migrateMutex.Unlock()
 		return
 	}
 	// init ketama
@@ -222,32 +246,84 @@ func (l *ChannelList) Migrate(nw map[string]int) (err error) {
 		ring.AddNode(node, weight)
 	}
 	ring.Bake()
+	// stop the running migration, it never closes a batch by the old ring
+	if migrateStop != nil {
+		close(migrateStop)
+	}
+	stop := make(chan bool)
+	migrateStop = stop
 	// atomic update
 	nodeWeightMap = nw
 	CometRing = ring
-	// get all the channel lock
-	channels := []Channel{}
+	migrateMutex.Unlock()
+	// get all the migrate keys
+	keys := []string{}
 	for i, c := range l.Channels {
 		c.Lock()
-		for k, v := range c.Data {
-			hn := ring.Hash(k)
-			if hn != Conf.ZookeeperCometNode {
-				channels = append(channels, v)
-				delete(c.Data, k)
-				log.Debug("migrate delete channel key \"%s\"", k)
+		for k := range c.Data {
+			if ring.Hash(k) != Conf.ZookeeperCometNode {
+				keys = append(keys, k)
 			}
 		}
 		c.Unlock()
-		log.Debug("migrate channel bucket:%d finished", i)
+		log.Debug("migrate channel bucket:%d scanned", i)
 	}
-	// close all the migrate channels
-	log.Info("close all the migrate channels")
+	batch := int(math.Ceil(float64(len(keys)) * Conf.MigrateBatch))
+	log.Info("migrate %d channels, %d every %v", len(keys), batch, Conf.MigrateInterval)
+	go l.migrate(ring, keys, batch, stop)
+	return
+}
+
+// migrate close the migrate channels by batch till all closed or stopped.
+func (l *ChannelList) migrate(ring *ketama.HashRing, keys []string, batch int, stop chan bool) {
+	for len(keys) > 0 {
+		n := batch
+		if n > len(keys) {
+			n = len(keys)
+		}
+		migrateMutex.Lock()
+		select {
+		case <-stop:
+			migrateMutex.Unlock()
+			log.Info("migrate stopped, %d channels left", len(keys))
+			return
+		default:
+		}
+		l.migrateKeys(ring, keys[:n])
+		migrateMutex.Unlock()
+		if keys = keys[n:]; len(keys) == 0 {
+			break
+		}
+		select {
+		case <-stop:
+			log.Info("migrate stopped, %d channels left", len(keys))
+			return
+		case <-time.After(Conf.MigrateInterval):
+		}
+	}
+	log.Info("migrate finished")
+}
+
+// migrateKeys delete and close the channels of the keys which don't belong
+// to this comet.
+func (l *ChannelList) migrateKeys(ring *ketama.HashRing, keys []string) {
+	channels := make([]Channel, 0, len(keys))
+	for _, k := range keys {
+		b := l.Bucket(k)
+		b.Lock()
+		if c, ok := b.Data[k]; ok && ring.Hash(k) != Conf.ZookeeperCometNode {
+			channels = append(channels, c)
+			delete(b.Data, k)
+			log.Debug("migrate delete channel key \"%s\"", k)
+		}
+		b.Unlock()
+	}
+	// close the migrate channels
 	for _, channel := range channels {
 		if err := channel.Close(); err != nil {
 			log.Error("channel.Close() error(%v)", err)
 			continue
 		}
 	}
-	log.Info("close all the migrate channels finished")
-	return
+	log.Info("close %d migrate channels", len(channels))
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"github.com/gorilla/websocket"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// negotiated payload encoding
+	CompressDeflateStr = "deflate"
+	// framed protocol flags
+	FrameFlagCompressed = uint16(1) // body is raw deflate (RFC 1951)
+)
+
+var (
+	ErrCompressSize = errors.New("decompressed payload too large")
+)
+
+// ConnMsg is a message waiting in the connection write buffer.
+type ConnMsg struct {
+	MsgId      int64
+	Body       []byte
+	Compressed bool                       // Body is deflated
+	Prepared   *websocket.PreparedMessage // websocket permessage-deflate frame shared by the connections
+	Msg        *myrpc.Message             // source message, spilled by slow consumer policy
+	Stored     bool                       // Msg is stored offline
+}
+
+// priority get the delivery priority.
+func (m *ConnMsg) priority() int {
+	if m.Msg == nil {
+		return myrpc.PriorityNormal
+	}
+	return m.Msg.Priority
+}
+
+// collapseKey get the collapse key, empty if none.
+func (m *ConnMsg) collapseKey() string {
+	if m.Msg == nil {
+		return ""
+	}
+	return m.Msg.CollapseKey
+}
+
+// compressMsg deflate the message with Conf.CompressLevel.
+func compressMsg(msg []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, Conf.CompressLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressMsg inflate the message, the result must not exceed max bytes.
+func decompressMsg(msg []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(msg))
+	defer r.Close()
+	d, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > max {
+		return nil, ErrCompressSize
+	}
+	return d, nil
+}
@@ -26,6 +26,9 @@ type Config struct {
 	MaxProc       int      `goconf:"base:maxproc"`
 	TCPBind       []string `goconf:"base:tcp.bind:,"`
 	WebsocketBind []string `goconf:"base:websocket.bind:,"`
+	SSEBind       []string `goconf:"base:sse.bind:,"`
+	LongPollBind  []string `goconf:"base:longpoll.bind:,"`
+	MQTTBind      []string `goconf:"base:mqtt.bind:,"`
 	RPCBind       []string `goconf:"base:rpc.bind:,"`
 	PprofBind     []string `goconf:"base:pprof.bind:,"`
 	StatBind      []string `goconf:"base:stat.bind:,"`
@@ -38,8 +41,9 @@ type Config struct {
 	ZookeeperMessagePath string        `goconf:"zookeeper:message.path"`
 	ZookeeperAgentPath string          `goconf:"zookeeper:agent.path"`
 	// rpc
-	RPCPing  time.Duration `goconf:"rpc:ping:time"`
-	RPCRetry time.Duration `goconf:"rpc:retry:time"`
+	RPCPing    time.Duration `goconf:"rpc:ping:time"`
+	RPCRetry   time.Duration `goconf:"rpc:retry:time"`
+	RPCTimeout time.Duration `goconf:"rpc:timeout:time"`
 	// channel
 	SndbufSize              int           `goconf:"channel:sndbuf.size:memory"`
 	RcvbufSize              int           `goconf:"channel:rcvbuf.size:memory"`
@@ -47,9 +51,27 @@ type Config struct {
 	BufioInstance           int           `goconf:"channel:bufio.instance"`
 	BufioNum                int           `goconf:"channel:bufio.num"`
 	TCPKeepalive            bool          `goconf:"channel:tcp.keepalive"`
+	TCPMaxCmdSize           int           `goconf:"channel:tcp.maxcmd.size:memory"`
 	MaxSubscriberPerChannel int           `goconf:"channel:maxsubscriber"`
 	ChannelBucket           int           `goconf:"channel:bucket"`
 	MsgBufNum               int           `goconf:"channel:msgbuf.num"`
+	WriterRoutine           int           `goconf:"channel:writer.routine"`
+	WriterQueue             int           `goconf:"channel:writer.queue"`
+	WriteTimeout            time.Duration `goconf:"channel:write.timeout:time"`
+	SlowConsumerPolicy      string        `goconf:"channel:slowconsumer.policy"`
+	SlowConsumerTimeout     time.Duration `goconf:"channel:slowconsumer.timeout:time"`
+	SlowConsumerSpillExpire time.Duration `goconf:"channel:slowconsumer.spill.expire:time"`
+	CompressThreshold       int           `goconf:"channel:compress.threshold:memory"`
+	CompressLevel           int           `goconf:"channel:compress.level"`
+	MQTTMaxPacket           int           `goconf:"channel:mqtt.maxpacket:memory"`
+	MQTTTopicPrefix         string        `goconf:"channel:mqtt.topic.prefix"`
+	WebsocketOrigins        []string      `goconf:"channel:websocket.origins:,"`
+	WebsocketMaxMsgSize     int           `goconf:"channel:websocket.maxmsg.size:memory"`
+	PresenceEvent           bool          `goconf:"channel:presence.event"`
+	AckEvent                bool          `goconf:"channel:ack.event"`
+	// migrate
+	MigrateInterval time.Duration `goconf:"migrate:interval:time"`
+	MigrateBatch    float64       `goconf:"migrate:batch"`
 }
 
 // InitConfig get a new Config struct.
@@ -63,6 +85,9 @@ func InitConfig() error {
 		MaxProc:       runtime.NumCPU(),
 		WebsocketBind: []string{"localhost:6968"},
 		TCPBind:       []string{"localhost:6969"},
+		SSEBind:       []string{"localhost:6973"},
+		LongPollBind:  []string{"localhost:6974"},
+		MQTTBind:      []string{"localhost:6975"},
 		RPCBind:       []string{"localhost:6970"},
 		PprofBind:     []string{"localhost:6971"},
 		StatBind:      []string{"localhost:6972"},
@@ -75,8 +100,9 @@ func InitConfig() error {
 		ZookeeperMessagePath: "/gopush-cluster-message",
 		ZookeeperAgentPath: "/gopush-cluster-agent",
 		// rpc
-		RPCPing:  1 * time.Second,
-		RPCRetry: 1 * time.Second,
+		RPCPing:    1 * time.Second,
+		RPCRetry:   1 * time.Second,
+		RPCTimeout: 3 * time.Second,
 		// channel
 		SndbufSize:              2048,
 		RcvbufSize:              256,
@@ -84,9 +110,27 @@ func InitConfig() error {
 		BufioInstance:           runtime.NumCPU(),
 		BufioNum:                128,
 		TCPKeepalive:            false,
+		TCPMaxCmdSize:           64 * 1024,
 		MaxSubscriberPerChannel: 64,
 		ChannelBucket:           runtime.NumCPU(),
 		MsgBufNum:               30,
+		WriterRoutine:           4,
+		WriterQueue:             1024,
+		WriteTimeout:            5 * time.Second,
+		SlowConsumerPolicy:      SlowConsumerClose,
+		SlowConsumerTimeout:     1 * time.Second,
+		SlowConsumerSpillExpire: 24 * time.Hour,
+		CompressThreshold:       1024,
+		CompressLevel:           1,
+		MQTTMaxPacket:           64 * 1024,
+		MQTTTopicPrefix:         "push/",
+		WebsocketOrigins:        []string{},
+		WebsocketMaxMsgSize:     64 * 1024,
+		PresenceEvent:           false,
+		AckEvent:                false,
+		// migrate
+		MigrateInterval: 1 * time.Second,
+		MigrateBatch:    0.1,
 	}
 	c := conf.New()
 	if err := c.Parse(confFile); err != nil {
@@ -95,5 +139,9 @@ func InitConfig() error {
 	if err := c.Unmarshal(Conf); err != nil {
 		return err
 	}
-	return nil
+	// the fraction of the migrate channels closed every interval, 1 all at once
+	if Conf.MigrateBatch <= 0 {
+		return ErrMigrateBatch
+	}
+	return validateSlowConsumerPolicy(Conf.SlowConsumerPolicy)
 }
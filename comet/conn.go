@@ -1,63 +1,326 @@
-
 package main
 
 import (
 	log "code.google.com/p/log4go"
+	"encoding/json"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Connection
 type Connection struct {
-	Conn    net.Conn
-	Proto   uint8
-	Version string
-	Buf     chan []byte
-}
-
-// HandleWrite start a goroutine get msg from chan, then send to the conn.
-func (c *Connection) HandleWrite(key string) {
-	go func() {
-		var (
-			n   int
-			err error
-		)
-		log.Debug("user_key: \"%s\" HandleWrite goroutine start", key)
-		for {
-			msg, ok := <-c.Buf
-			if !ok {
-				log.Debug("user_key: \"%s\" HandleWrite goroutine stop", key)
-				return
-			}
-			if c.Proto == WebsocketProto {
-				// raw
-				n, err = c.Conn.Write(msg)
-			} else if c.Proto == TCPProto {
-				// redis protocol
-				msg = []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(msg), string(msg)))
-				n, err = c.Conn.Write(msg)
-			} else {
-				log.Error("unknown connection protocol: %d", c.Proto)
-				panic(ErrConnProto)
-			}
-			// update stat
-			if err != nil {
-				log.Error("user_key: \"%s\" conn.Write() error(%v)", key, err)
-				//MsgStat.IncrFailed(1)
-			} else {
-				log.Debug("user_key: \"%s\" write \r\n========%s(%d)========", key, string(msg), n)
-				//MsgStat.IncrSucceed(1)
-			}
-		}
-	}()
-}
-
-// Write different message to client by different protocol
-func (c *Connection) Write(key string, msg []byte) {
-	select {
-	case c.Buf <- msg:
-	default:
+	Conn      net.Conn
+	Proto     uint8
+	Version   string
+	Compress  bool       // negotiated deflate, websocket permessage-deflate
+	Device    string     // device id, the pushes can target or exclude
+	Platform  string     // device platform label, eg: ios, android, web
+	queue     []*ConnMsg // pending messages, at most Conf.MsgBufNum
+	qmutex    sync.Mutex
+	scheduled bool      // queued in the writer
+	space     chan bool // closed to wake up the blocked writes, slow consumer policy block
+	blockHead uint64    // ticket of the blocked write allowed to enqueue
+	blockTail uint64    // next ticket of the blocked writes, they enqueue in order
+	spilling  bool      // a message spilled, the later ones go offline too, slow consumer policy spill
+	closed    bool
+	key       string
+	ctime     int64 // subscribe unix time
+	writer    *ConnWriter
+	seq       uint32 // framed protocol server frame seq
+	polled    int32  // long polling responded
+	mqtt      *mqttSession
+}
+
+// WriteFrame write a frame of the framed tcp protocol, the net.Conn
+// serializes the concurrent writes so a frame is never interleaved.
+func (c *Connection) WriteFrame(op uint8, flag uint16, seq uint32, body []byte) error {
+	f := &Frame{Ver: TCPFrameVersion, Op: op, Flag: flag, Seq: seq, Body: body}
+	_, err := c.Conn.Write(f.Bytes())
+	return err
+}
+
+// nextSeq get the next server frame seq.
+func (c *Connection) nextSeq() uint32 {
+	return atomic.AddUint32(&c.seq, 1)
+}
+
+// WriteReady tell the client the service is ready for accept heartbeat.
+func (c *Connection) WriteReady() error {
+	if c.Proto == TCPFrameProto {
+		return c.WriteFrame(OpSub, 0, c.nextSeq(), nil)
+	} else if c.Proto == SSEProto {
+		_, err := c.Conn.Write([]byte(sseReady))
+		return err
+	} else if c.Proto == LongPollProto || c.Proto == MQTTProto {
+		// the long polling response is the message or timeout, mqtt answered SUBACK
+		return nil
+	}
+	_, err := c.Conn.Write(HeartbeatReply)
+	return err
+}
+
+// WriteReply write a error reply, the framed protocol sends it as the close
+// reason, websocket sends it then a close frame.
+func (c *Connection) WriteReply(reply []byte) error {
+	if c.Proto == TCPFrameProto {
+		return c.WriteFrame(OpClose, 0, c.nextSeq(), replyCode(reply))
+	} else if c.Proto == WebsocketProto {
+		return c.Conn.(*WSConn).CloseReply(reply)
+	}
+	_, err := c.Conn.Write(reply)
+	return err
+}
+
+// WriteClose write the reason before the server closes the connection, the
+// websocket close code of the reasons other than the error replies is WSCloseKick.
+func (c *Connection) WriteClose(reply []byte) error {
+	if c.Proto == WebsocketProto {
+		code := wsCloseCode(reply)
+		if code == websocket.CloseInternalServerErr {
+			code = WSCloseKick
+		}
+		return c.Conn.(*WSConn).CloseCode(code, reply)
+	} else if c.Proto == SSEProto {
+		_, err := c.Conn.Write(sseEvent("error", replyCode(reply)))
+		return err
+	} else if c.Proto == LongPollProto {
+		if !c.pollRespond() {
+			return nil
+		}
+		_, err := c.Conn.Write(pollReply(reply))
+		return err
+	} else if c.Proto == MQTTProto {
+		// mqtt 3.1.1 server can`t tell the reason
+		return nil
+	}
+	return c.WriteReply(reply)
+}
+
+// WriteRedirect tell the client the key belongs to another comet node.
+func (c *Connection) WriteRedirect(key string) error {
+	if c.Proto != TCPFrameProto || CometRing == nil {
+		return c.WriteReply(NodeReply)
+	}
+	body, err := json.Marshal(map[string]string{"node": CometRing.Hash(key)})
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(OpRedirect, 0, c.nextSeq(), body)
+}
+
+// writeConnMsg send a message to the conn by the protocol, a skipped message
+// is not an error.
+func (c *Connection) writeConnMsg(key string, m *ConnMsg) error {
+	var (
+		n   int
+		err error
+	)
+	msg := m.Body
+	// expired while buffered
+	if m.Msg != nil && m.Msg.Expired(time.Now().Unix()) {
+		log.Warn("user_key: \"%s\" msg: %d expired at %d, discard", key, m.MsgId, m.Msg.ExpireAt)
+		return nil
+	}
+	// the writer is shared, a stuck client must not block the others
+	if err = c.Conn.SetWriteDeadline(time.Now().Add(Conf.WriteTimeout)); err != nil {
+		log.Error("user_key: \"%s\" conn.SetWriteDeadline() error(%v)", key, err)
+		return err
+	}
+	if c.Proto == WebsocketProto {
+		if m.Prepared != nil {
+			// permessage-deflate frame compressed once
+			n, err = len(msg), c.Conn.(*WSConn).WritePrepared(m.Prepared)
+		} else {
+			n, err = c.Conn.Write(msg)
+		}
+	} else if c.Proto == TCPProto {
+		// redis protocol
+		msg = []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(msg), string(msg)))
+		n, err = c.Conn.Write(msg)
+	} else if c.Proto == TCPFrameProto {
+		// framed protocol
+		flag := uint16(0)
+		if m.Compressed {
+			flag |= FrameFlagCompressed
+		}
+		n, err = len(msg), c.WriteFrame(OpPush, flag, c.nextSeq(), msg)
+	} else if c.Proto == SSEProto {
+		// message event
+		n, err = c.Conn.Write(sseEvent("", msg))
+	} else if c.Proto == LongPollProto {
+		// one message per poll, the later ones are got from the offline api
+		if !c.pollRespond() {
+			log.Debug("user_key: \"%s\" long poll responded, skip message", key)
+			return nil
+		}
+		n, err = c.Conn.Write(pollResponse(msg))
 		c.Conn.Close()
-		log.Warn("user_key: \"%s\" discard message: \"%s\" and close connection", key, string(msg))
+	} else if c.Proto == MQTTProto {
+		n, err = len(msg), c.writeMQTTPublish(key, m)
+	} else {
+		log.Error("unknown connection protocol: %d", c.Proto)
+		panic(ErrConnProto)
+	}
+	// heartbeat replies are written without deadline
+	c.Conn.SetWriteDeadline(time.Time{})
+	// update stat
+	if err != nil {
+		log.Error("user_key: \"%s\" conn.Write() error(%v)", key, err)
+		//MsgStat.IncrFailed(1)
+		return err
+	}
+	log.Debug("user_key: \"%s\" write \r\n========%s(%d)========", key, string(msg), n)
+	//MsgStat.IncrSucceed(1)
+	return nil
+}
+
+// HandleWrite attach the conn to the bucket writer, the messages are sent by
+// the shared writer goroutines instead of a goroutine per connection.
+func (c *Connection) HandleWrite(key string, w *ConnWriter) {
+	c.qmutex.Lock()
+	c.key = key
+	c.writer = w
+	c.qmutex.Unlock()
+}
+
+// abort close the connection and discard the pending messages, the client
+// gets the stored ones from the offline api after reconnect.
+func (c *Connection) abort() {
+	c.Conn.Close()
+	c.StopWrite()
+	SlowConsumerStat.IncrEvicted()
+}
+
+// StopWrite discard the pending messages, the later messages are dropped.
+func (c *Connection) StopWrite() {
+	c.qmutex.Lock()
+	c.closed = true
+	c.queue = nil
+	c.wakeBlocked()
+	c.qmutex.Unlock()
+}
+
+// Write different message to client by different protocol, the message is
+// queued by priority then sent by the bucket writer, a undelivered message
+// with the same collapse key is replaced, a full queue is handled by the
+// slow consumer policy. with the block policy the write waiting space is
+// returned, the caller must release its channel locks then Wait it.
+func (c *Connection) Write(key string, m *ConnMsg) *blockedWrite {
+	c.qmutex.Lock()
+	if c.closed {
+		c.qmutex.Unlock()
+		return nil
+	}
+	if Conf.SlowConsumerPolicy == SlowConsumerBlock {
+		// queue behind the writes already blocked, keep the order
+		if c.blockHead != c.blockTail || (!c.collapse(key, m) && len(c.queue) >= Conf.MsgBufNum) {
+			w := &blockedWrite{conn: c, key: key, m: m, ticket: c.blockTail, deadline: time.Now().Add(Conf.SlowConsumerTimeout)}
+			c.blockTail++
+			c.qmutex.Unlock()
+			return w
+		}
+		c.schedule(m)
+		return nil
+	}
+	if c.spilling && c.spill(key, m) {
+		c.qmutex.Unlock()
+		return nil
+	}
+	if !c.collapse(key, m) && len(c.queue) >= Conf.MsgBufNum && !c.slowConsumer(key, m) {
+		c.qmutex.Unlock()
+		return nil
+	}
+	c.schedule(m)
+	return nil
+}
+
+// schedule queue the message and schedule the connection in the writer.
+// qmutex must be held, it's released when return.
+func (c *Connection) schedule(m *ConnMsg) {
+	c.enqueue(m)
+	if c.scheduled {
+		c.qmutex.Unlock()
+		return
+	}
+	c.scheduled = true
+	c.qmutex.Unlock()
+	c.writer.schedule(c)
+}
+
+// wakeBlocked wake up all the blocked writes, the queue has space or the
+// connection closed. qmutex must be held.
+func (c *Connection) wakeBlocked() {
+	if c.space != nil {
+		close(c.space)
+		c.space = nil
+	}
+}
+
+// collapse remove the queued message with the same collapse key, return
+// true if removed. qmutex must be held.
+func (c *Connection) collapse(key string, m *ConnMsg) bool {
+	ck := m.collapseKey()
+	if ck == "" {
+		return false
+	}
+	for i, o := range c.queue {
+		if o.collapseKey() == ck {
+			log.Debug("user_key: \"%s\" collapse key: \"%s\" replace message: %d", key, ck, o.MsgId)
+			c.remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue insert the message after the ones with higher or equal priority,
+// a stored message never goes before another stored one: the client resumes
+// the offline messages after the last mid it got, so the stored messages
+// must be delivered in the mid order. qmutex must be held.
+func (c *Connection) enqueue(m *ConnMsg) {
+	p := m.priority()
+	i := len(c.queue)
+	for i > 0 && c.queue[i-1].priority() < p && !(m.Stored && c.queue[i-1].Stored) {
+		i--
+	}
+	c.queue = append(c.queue, nil)
+	copy(c.queue[i+1:], c.queue[i:])
+	c.queue[i] = m
+}
+
+// remove delete the i-th queued message. qmutex must be held.
+func (c *Connection) remove(i int) {
+	copy(c.queue[i:], c.queue[i+1:])
+	c.queue[len(c.queue)-1] = nil
+	c.queue = c.queue[:len(c.queue)-1]
+}
+
+// flush send the queued messages until the queue empty, the connection is
+// closed on the first write error: a timed out client must not hold the
+// shared writer for the whole queue and a partial frame corrupts the stream.
+func (c *Connection) flush() {
+	for {
+		c.qmutex.Lock()
+		if len(c.queue) == 0 {
+			c.scheduled = false
+			// release the grown queue
+			c.queue = nil
+			c.qmutex.Unlock()
+			return
+		}
+		m := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.wakeBlocked()
+		c.qmutex.Unlock()
+		if err := c.writeConnMsg(c.key, m); err != nil {
+			log.Warn("user_key: \"%s\" write error, discard the queued messages and close connection", c.key)
+			c.abort()
+			return
+		}
 	}
 }
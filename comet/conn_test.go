@@ -0,0 +1,37 @@
+package main
+
+import (
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"testing"
+)
+
+func TestEnqueue(t *testing.T) {
+	c := &Connection{}
+	msg := func(mid int64, priority int, stored bool) *ConnMsg {
+		return &ConnMsg{MsgId: mid, Msg: &myrpc.Message{MsgId: mid, Priority: priority}, Stored: stored}
+	}
+	c.enqueue(msg(1, myrpc.PriorityNormal, true))
+	c.enqueue(msg(2, myrpc.PriorityNormal, false))
+	// online high priority passes every lower one
+	c.enqueue(msg(3, myrpc.PriorityHigh, false))
+	// stored high priority passes the online message, not the stored one
+	c.enqueue(msg(4, myrpc.PriorityHigh, true))
+	c.enqueue(msg(5, myrpc.PriorityNormal, true))
+	expected := []int64{3, 1, 4, 2, 5}
+	if len(c.queue) != len(expected) {
+		t.Fatalf("queue length: %d, expected %d", len(c.queue), len(expected))
+	}
+	last := int64(0)
+	for i, m := range c.queue {
+		if m.MsgId != expected[i] {
+			t.Errorf("queue[%d] mid: %d, expected %d", i, m.MsgId, expected[i])
+		}
+		// the resume from the last mid must not skip a stored message
+		if m.Stored {
+			if m.MsgId < last {
+				t.Errorf("stored mid: %d delivered after %d", m.MsgId, last)
+			}
+			last = m.MsgId
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"time"
+)
+
+// ConnWriter is a writer goroutine pool shared by the connections of a
+// channel bucket, a connection is scheduled when it has pending messages
+// and is drained by one goroutine at a time, so the messages keep order.
+type ConnWriter struct {
+	ready chan *Connection
+}
+
+// NewConnWriter create a ConnWriter with routine goroutines.
+func NewConnWriter(routine, queue int) *ConnWriter {
+	w := &ConnWriter{ready: make(chan *Connection, queue)}
+	for i := 0; i < routine; i++ {
+		go w.handle()
+	}
+	return w
+}
+
+// handle drain the scheduled connections.
+func (w *ConnWriter) handle() {
+	for c := range w.ready {
+		c.flush()
+	}
+}
+
+// schedule queue the connection, if the writer stays busy for the write
+// timeout the connection is closed rather than block the push longer.
+func (w *ConnWriter) schedule(c *Connection) {
+	select {
+	case w.ready <- c:
+		return
+	default:
+	}
+	timer := time.NewTimer(Conf.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case w.ready <- c:
+	case <-timer.C:
+		log.Warn("user_key: \"%s\" conn writer busy, discard the queued messages and close connection", c.key)
+		c.abort()
+	}
+}
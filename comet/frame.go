@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The framed tcp protocol (v2), negotiated by the fourth argument of sub:
+// *4\r\n$3\r\nsub\r\n$len\r\nkey\r\n$len\r\nheartbeat\r\n$len\r\nversion\r\n$1\r\n2\r\n
+// after the sub command every packet is a frame, all integers are big endian:
+// | packLen(4) | ver(1) | op(1) | flag(2) | seq(4) | body |
+// packLen includes the 12 bytes header, flag FrameFlagCompressed marks a deflated body.
+const (
+	TCPFrameVersionStr = "2"
+	TCPFrameVersion    = uint8(2)
+	frameHeaderLen     = 12
+	// operations
+	OpAuth      = uint8(1) // reserved, the comet has no auth, answered by OpClose "a"
+	OpSub       = uint8(2) // server: subscribed, ready for heartbeat
+	OpHeartbeat = uint8(3) // client: heartbeat, server: heartbeat reply
+	OpPush      = uint8(4) // server: push message, seq increases per connection
+	OpAck       = uint8(5) // client: ack a pushed message id, server: ack the upstream seq
+	OpUpstream  = uint8(6) // client: upstream json message
+	OpRedirect  = uint8(7) // server: the key belongs to another comet node, body {"node":"..."}
+	OpClose     = uint8(8) // server: close reason ("a", "c", "n", "p"), client: close
+)
+
+var (
+	ErrFrame = errors.New("frame format error")
+)
+
+// Frame is a packet of the framed tcp protocol.
+type Frame struct {
+	Ver  uint8
+	Op   uint8
+	Flag uint16
+	Seq  uint32
+	Body []byte
+}
+
+// Bytes encode the frame.
+func (f *Frame) Bytes() []byte {
+	b := make([]byte, frameHeaderLen+len(f.Body))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)))
+	b[4] = f.Ver
+	b[5] = f.Op
+	binary.BigEndian.PutUint16(b[6:8], f.Flag)
+	binary.BigEndian.PutUint32(b[8:12], f.Seq)
+	copy(b[frameHeaderLen:], f.Body)
+	return b
+}
+
+// ReadFrame read a frame, the body length must not exceed maxBody.
+func ReadFrame(rd *bufio.Reader, maxBody int) (*Frame, error) {
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return nil, err
+	}
+	packLen := int(binary.BigEndian.Uint32(header[0:4]))
+	if packLen < frameHeaderLen || packLen-frameHeaderLen > maxBody {
+		return nil, ErrFrame
+	}
+	f := &Frame{
+		Ver:  header[4],
+		Op:   header[5],
+		Flag: binary.BigEndian.Uint16(header[6:8]),
+		Seq:  binary.BigEndian.Uint32(header[8:12]),
+	}
+	if f.Ver != TCPFrameVersion {
+		return nil, ErrFrame
+	}
+	f.Body = make([]byte, packLen-frameHeaderLen)
+	if _, err := io.ReadFull(rd, f.Body); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// replyCode get the reason code of a old protocol reply, eg: "-p\r\n" -> "p".
+func replyCode(reply []byte) []byte {
+	if len(reply) < 4 {
+		return reply
+	}
+	return reply[1 : len(reply)-2]
+}
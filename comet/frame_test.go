@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	f := &Frame{Ver: TCPFrameVersion, Op: OpPush, Flag: FrameFlagCompressed, Seq: 7, Body: []byte("hello")}
+	b := f.Bytes()
+	if len(b) != frameHeaderLen+5 || int(binary.BigEndian.Uint32(b[0:4])) != len(b) {
+		t.Fatalf("frame packLen error: %v", b)
+	}
+	r, err := ReadFrame(bufio.NewReader(bytes.NewReader(b)), 5)
+	if err != nil {
+		t.Fatalf("ReadFrame() error(%v)", err)
+	}
+	if r.Ver != f.Ver || r.Op != f.Op || r.Flag != f.Flag || r.Seq != f.Seq || string(r.Body) != "hello" {
+		t.Errorf("frame decode error: %+v", r)
+	}
+	// empty body
+	b = (&Frame{Ver: TCPFrameVersion, Op: OpHeartbeat}).Bytes()
+	if r, err = ReadFrame(bufio.NewReader(bytes.NewReader(b)), 0); err != nil || r.Op != OpHeartbeat || len(r.Body) != 0 {
+		t.Errorf("empty body frame error(%v)", err)
+	}
+	// frames read one by one from the stream
+	b = append(f.Bytes(), (&Frame{Ver: TCPFrameVersion, Op: OpAck, Seq: 8}).Bytes()...)
+	rd := bufio.NewReader(bytes.NewReader(b))
+	if r, err = ReadFrame(rd, 5); err != nil || r.Seq != 7 {
+		t.Fatalf("first frame error(%v)", err)
+	}
+	if r, err = ReadFrame(rd, 5); err != nil || r.Op != OpAck || r.Seq != 8 {
+		t.Fatalf("second frame error(%v)", err)
+	}
+	if _, err = ReadFrame(rd, 5); err != io.EOF {
+		t.Errorf("end of stream error(%v)", err)
+	}
+}
+
+func TestFrameError(t *testing.T) {
+	b := (&Frame{Ver: TCPFrameVersion, Op: OpUpstream, Body: []byte("hello")}).Bytes()
+	// body exceeds the limit
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(b)), 4); err != ErrFrame {
+		t.Errorf("oversized frame error(%v)", err)
+	}
+	// packLen less than the header
+	short := append([]byte{}, b...)
+	binary.BigEndian.PutUint32(short[0:4], frameHeaderLen-1)
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(short)), 5); err != ErrFrame {
+		t.Errorf("short packLen error(%v)", err)
+	}
+	// huge packLen must not be allocated
+	huge := append([]byte{}, b...)
+	binary.BigEndian.PutUint32(huge[0:4], 0xffffffff)
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(huge)), 1024); err != ErrFrame {
+		t.Errorf("huge packLen error(%v)", err)
+	}
+	// unknown version
+	ver := append([]byte{}, b...)
+	ver[4] = 1
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(ver)), 5); err != ErrFrame {
+		t.Errorf("version error(%v)", err)
+	}
+	// truncated header
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(b[:frameHeaderLen-1])), 5); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated header error(%v)", err)
+	}
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(nil)), 5); err != io.EOF {
+		t.Errorf("empty stream error(%v)", err)
+	}
+	// truncated body
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(b[:len(b)-1])), 5); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated body error(%v)", err)
+	}
+}
@@ -25,10 +25,16 @@ func main() {
 	defer log.Close()
 	// start pprof
 	perf.Init(Conf.PprofBind)
+	// start stat
+	StartStat()
 	// create channel
 	// if process exit, close channel
 	UserChannel = NewChannelList()
 	defer UserChannel.Close()
+	// start presence change events
+	InitPresenceEvent()
+	// start delivery ack events
+	InitAckEvent()
 
 	// start rpc
 	if err := StartRPC(); err != nil {
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect     = byte(1)
+	mqttConnack     = byte(2)
+	mqttPublish     = byte(3)
+	mqttPuback      = byte(4)
+	mqttSubscribe   = byte(8)
+	mqttSuback      = byte(9)
+	mqttUnsubscribe = byte(10)
+	mqttUnsuback    = byte(11)
+	mqttPingreq     = byte(12)
+	mqttPingresp    = byte(13)
+	mqttDisconnect  = byte(14)
+	// protocol
+	mqttProtoName  = "MQTT"
+	mqttProtoLevel = byte(4)
+	// connack return codes
+	mqttAccepted          = byte(0)
+	mqttBadProtoVersion   = byte(1)
+	mqttIdRejected        = byte(2)
+	mqttServerUnavailable = byte(3)
+	// suback failure
+	mqttSubFailure = byte(0x80)
+	// connect flags
+	mqttFlagWill     = byte(0x04)
+	mqttFlagPassword = byte(0x40)
+	mqttFlagUsername = byte(0x80)
+)
+
+var (
+	ErrMQTTPacket = errors.New("mqtt packet format error")
+)
+
+// mqttPacket is a mqtt control packet.
+type mqttPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// mqttConnectInfo is the parsed CONNECT packet.
+type mqttConnectInfo struct {
+	ProtoName string
+	Level     byte
+	ClientId  string
+	Username  string
+	KeepAlive int
+}
+
+// mqttSubscription is a topic filter of the SUBSCRIBE packet.
+type mqttSubscription struct {
+	Filter string
+	QoS    byte
+}
+
+// readMQTTPacket read a control packet, the remaining length must not exceed max.
+func readMQTTPacket(rd *bufio.Reader, max int) (*mqttPacket, error) {
+	h, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	// remaining length, at most 4 bytes
+	length, mul := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMQTTPacket
+		}
+		b, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * mul
+		if b&0x80 == 0 {
+			break
+		}
+		mul *= 128
+	}
+	if length > max {
+		return nil, ErrMQTTPacket
+	}
+	p := &mqttPacket{Type: h >> 4, Flags: h & 0x0f, Body: make([]byte, length)}
+	if _, err = io.ReadFull(rd, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writeMQTTPacket write a control packet in one write.
+func writeMQTTPacket(w io.Writer, typ, flags byte, body []byte) error {
+	b := make([]byte, 0, len(body)+5)
+	b = append(b, typ<<4|flags&0x0f)
+	length := len(body)
+	for {
+		d := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if length == 0 {
+			break
+		}
+	}
+	b = append(b, body...)
+	_, err := w.Write(b)
+	return err
+}
+
+// mqttString read a length prefixed string.
+func mqttString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, ErrMQTTPacket
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", nil, ErrMQTTPacket
+	}
+	return string(b[2 : 2+l]), b[2+l:], nil
+}
+
+// appendMQTTString append a length prefixed string.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacketId read the packet identifier.
+func mqttPacketId(b []byte) (uint16, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, ErrMQTTPacket
+	}
+	return binary.BigEndian.Uint16(b), b[2:], nil
+}
+
+// parseMQTTConnect parse the CONNECT packet body, will, username and password are skipped.
+func parseMQTTConnect(b []byte) (*mqttConnectInfo, error) {
+	var err error
+	info := &mqttConnectInfo{}
+	if info.ProtoName, b, err = mqttString(b); err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, ErrMQTTPacket
+	}
+	info.Level = b[0]
+	flags := b[1]
+	info.KeepAlive = int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[4:]
+	if info.ClientId, b, err = mqttString(b); err != nil {
+		return nil, err
+	}
+	if flags&mqttFlagWill != 0 {
+		// will topic and will message
+		for i := 0; i < 2; i++ {
+			if _, b, err = mqttString(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if flags&mqttFlagUsername != 0 {
+		if info.Username, b, err = mqttString(b); err != nil {
+			return nil, err
+		}
+	}
+	if flags&mqttFlagPassword != 0 {
+		if _, b, err = mqttString(b); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// parseMQTTSubscribe parse the SUBSCRIBE packet body, at least one topic filter is required.
+func parseMQTTSubscribe(b []byte) (uint16, []mqttSubscription, error) {
+	pid, b, err := mqttPacketId(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	var subs []mqttSubscription
+	for len(b) > 0 {
+		var filter string
+		if filter, b, err = mqttString(b); err != nil || len(b) == 0 {
+			return 0, nil, ErrMQTTPacket
+		}
+		subs = append(subs, mqttSubscription{Filter: filter, QoS: b[0] & 0x03})
+		b = b[1:]
+	}
+	if len(subs) == 0 {
+		return 0, nil, ErrMQTTPacket
+	}
+	return pid, subs, nil
+}
+
+// mqttPublishBody build a PUBLISH packet body, the packet id is only for qos > 0.
+func mqttPublishBody(topic string, qos byte, pid uint16, payload []byte) []byte {
+	b := make([]byte, 0, len(topic)+len(payload)+4)
+	b = appendMQTTString(b, topic)
+	if qos > 0 {
+		b = append(b, byte(pid>>8), byte(pid))
+	}
+	return append(b, payload...)
+}
+
+// mqttTopicMatch check the topic matches the filter with + and # wildcards.
+func mqttTopicMatch(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
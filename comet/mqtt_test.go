@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+// mqttPacketBytes encode a control packet.
+func mqttPacketBytes(typ, flags byte, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	writeMQTTPacket(buf, typ, flags, body)
+	return buf.Bytes()
+}
+
+func TestMQTTConnect(t *testing.T) {
+	b := appendMQTTString(nil, mqttProtoName)
+	b = append(b, mqttProtoLevel, mqttFlagWill|mqttFlagUsername|mqttFlagPassword, 0, 60)
+	b = appendMQTTString(b, "key1")
+	b = appendMQTTString(b, "will/topic")
+	b = appendMQTTString(b, "will")
+	b = appendMQTTString(b, "phone")
+	b = appendMQTTString(b, "secret")
+	p, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(mqttPacketBytes(mqttConnect, 0, b))), 1024)
+	if err != nil || p.Type != mqttConnect {
+		t.Fatalf("readMQTTPacket() error(%v)", err)
+	}
+	info, err := parseMQTTConnect(p.Body)
+	if err != nil {
+		t.Fatalf("parseMQTTConnect() error(%v)", err)
+	}
+	if info.ProtoName != mqttProtoName || info.Level != mqttProtoLevel || info.ClientId != "key1" || info.Username != "phone" || info.KeepAlive != 60 {
+		t.Errorf("connect info error: %+v", info)
+	}
+	// keep alive 0
+	z := appendMQTTString(nil, mqttProtoName)
+	z = append(z, mqttProtoLevel, 0, 0, 0)
+	z = appendMQTTString(z, "key1")
+	if info, err = parseMQTTConnect(z); err != nil || info.KeepAlive != 0 || info.Username != "" {
+		t.Errorf("keep alive 0 connect error(%v)", err)
+	}
+	// truncated at every byte
+	for i := 0; i < len(b); i++ {
+		if _, err = parseMQTTConnect(b[:i]); err != ErrMQTTPacket {
+			t.Errorf("truncated connect(%d) error(%v)", i, err)
+		}
+	}
+}
+
+func TestMQTTSubscribe(t *testing.T) {
+	b := []byte{0, 10}
+	b = append(appendMQTTString(b, "push/key1"), 1)
+	b = append(appendMQTTString(b, "push/#"), 2)
+	pid, subs, err := parseMQTTSubscribe(b)
+	if err != nil {
+		t.Fatalf("parseMQTTSubscribe() error(%v)", err)
+	}
+	if pid != 10 || len(subs) != 2 || subs[0].Filter != "push/key1" || subs[0].QoS != 1 || subs[1].Filter != "push/#" || subs[1].QoS != 2 {
+		t.Errorf("subscribe error: %d %+v", pid, subs)
+	}
+	// truncated at every byte, the packet id alone has no topic filter
+	first := 2 + 2 + len("push/key1") + 1
+	for i := 0; i < len(b); i++ {
+		if i == first {
+			// the first topic filter is complete
+			continue
+		}
+		if _, _, err = parseMQTTSubscribe(b[:i]); err != ErrMQTTPacket {
+			t.Errorf("truncated subscribe(%d) error(%v)", i, err)
+		}
+	}
+	// filter without qos
+	if _, _, err = parseMQTTSubscribe(appendMQTTString([]byte{0, 1}, "push/key1")); err != ErrMQTTPacket {
+		t.Errorf("subscribe without qos error(%v)", err)
+	}
+}
+
+func TestMQTTPuback(t *testing.T) {
+	p, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(mqttPacketBytes(mqttPuback, 0, []byte{1, 2}))), 1024)
+	if err != nil || p.Type != mqttPuback {
+		t.Fatalf("readMQTTPacket() error(%v)", err)
+	}
+	if pid, _, err := mqttPacketId(p.Body); err != nil || pid != 0x0102 {
+		t.Errorf("puback packet id: %d error(%v)", pid, err)
+	}
+	if _, _, err = mqttPacketId(p.Body[:1]); err != ErrMQTTPacket {
+		t.Errorf("truncated puback error(%v)", err)
+	}
+	// session ack only once
+	s := &mqttSession{mutex: &sync.Mutex{}, inflight: map[uint16]int64{0x0102: 5}}
+	if mid, ok := s.ack(0x0102); !ok || mid != 5 {
+		t.Errorf("session ack mid: %d", mid)
+	}
+	if _, ok := s.ack(0x0102); ok {
+		t.Error("session acked twice")
+	}
+}
+
+func TestMQTTPacketError(t *testing.T) {
+	b := mqttPacketBytes(mqttPuback, 0, []byte{1, 2})
+	// truncated fixed header and body
+	for i, err := range []error{io.EOF, io.EOF, io.EOF, io.ErrUnexpectedEOF} {
+		if _, e := readMQTTPacket(bufio.NewReader(bytes.NewReader(b[:i])), 1024); e != err {
+			t.Errorf("truncated packet(%d) error(%v)", i, e)
+		}
+	}
+	// remaining length exceeds the limit
+	if _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(b)), 1); err != ErrMQTTPacket {
+		t.Errorf("oversized packet error(%v)", err)
+	}
+	// remaining length more than 4 bytes
+	if _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{mqttPuback << 4, 0x80, 0x80, 0x80, 0x80, 0x01})), 1024); err != ErrMQTTPacket {
+		t.Errorf("remaining length error(%v)", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"time"
+)
+
+const (
+	presenceEventQueue = 1024
+)
+
+var (
+	// presence change events sent to the agent, nil if not enabled
+	presenceEvents chan *myrpc.AgentPresenceEventArgs
+)
+
+// protoName get the name of the connection protocol.
+func protoName(proto uint8) string {
+	switch proto {
+	case TCPProto:
+		return TCPProtoStr
+	case TCPFrameProto:
+		return "tcpframe"
+	case WebsocketProto:
+		return WebsocketProtoStr
+	case SSEProto:
+		return SSEProtoStr
+	case LongPollProto:
+		return LongPollProtoStr
+	case MQTTProto:
+		return MQTTProtoStr
+	}
+	return "unknown"
+}
+
+// presence get the presence of the connection.
+func (c *Connection) presence() *myrpc.PresenceConn {
+	p := &myrpc.PresenceConn{Proto: protoName(c.Proto), Ctime: c.ctime, Device: c.Device, Platform: c.Platform}
+	if addr := c.Conn.RemoteAddr(); addr != nil {
+		p.Addr = addr.String()
+	}
+	return p
+}
+
+// Presence get the presence of a key, a key without channel is offline.
+func (l *ChannelList) Presence(key string) (*myrpc.Presence, error) {
+	if err := l.validate(key); err != nil {
+		return nil, err
+	}
+	b := l.Bucket(key)
+	b.Lock()
+	c, ok := b.Data[key]
+	b.Unlock()
+	if !ok {
+		return &myrpc.Presence{Node: Conf.ZookeeperCometNode}, nil
+	}
+	p := c.Presence()
+	p.Node = Conf.ZookeeperCometNode
+	return p, nil
+}
+
+// InitPresenceEvent start sending the presence change events to the agent
+// if enabled, the events are dropped when the queue is full.
+func InitPresenceEvent() {
+	if !Conf.PresenceEvent {
+		return
+	}
+	presenceEvents = make(chan *myrpc.AgentPresenceEventArgs, presenceEventQueue)
+	go sendPresenceEvents()
+}
+
+// presenceEvent queue a presence change event of the key.
+func presenceEvent(key string, conn *Connection, online bool) {
+	if presenceEvents == nil {
+		return
+	}
+	ev := &myrpc.AgentPresenceEventArgs{Key: key, Online: online, Proto: protoName(conn.Proto), Node: Conf.ZookeeperCometNode, Time: time.Now().Unix()}
+	select {
+	case presenceEvents <- ev:
+	default:
+		log.Warn("user_key:\"%s\" presence event queue full, drop event(online:%t)", key, online)
+	}
+}
+
+// sendPresenceEvents send the queued presence events to the agent.
+func sendPresenceEvents() {
+	ret := 0
+	for ev := range presenceEvents {
+		if err := myrpc.CallTimeout(myrpc.AgentRPC.Get(), Conf.RPCTimeout, myrpc.AgentServicePresenceEvent, ev, &ret); err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.AgentServicePresenceEvent, ev, err)
+		}
+	}
+}
@@ -10,8 +10,15 @@ import (
 const (
 	TCPProto               = uint8(0)
 	WebsocketProto         = uint8(1)
+	TCPFrameProto          = uint8(2)
+	SSEProto               = uint8(3)
+	LongPollProto          = uint8(4)
+	MQTTProto              = uint8(5)
 	WebsocketProtoStr      = "websocket"
 	TCPProtoStr            = "tcp"
+	SSEProtoStr            = "sse"
+	LongPollProtoStr       = "longpoll"
+	MQTTProtoStr           = "mqtt"
 	Heartbeat              = "h"
 	minHearbeatSec         = 30
 	delayHeartbeatSec      = 5
@@ -36,6 +43,12 @@ var (
 	ParamReply = []byte("-p\r\n")
 	// node error reply
 	NodeReply = []byte("-n\r\n")
+	// upstream message failed reply
+	UpstreamReply = []byte("-u\r\n")
+	// closed by the admin reply
+	KickReply = []byte("-k\r\n")
+	// banned subscriber reply
+	BanReply = []byte("-b\r\n")
 )
 
 // StartListen start accept client.
@@ -51,8 +64,23 @@ func StartComet() error {
 			if err := StartTCP(); err != nil {
 				return err
 			}
+		} else if proto == SSEProtoStr {
+			// Start server-sent events push service
+			if err := StartSSE(); err != nil {
+				return err
+			}
+		} else if proto == LongPollProtoStr {
+			// Start long polling push service
+			if err := StartLongPoll(); err != nil {
+				return err
+			}
+		} else if proto == MQTTProtoStr {
+			// Start mqtt push service
+			if err := StartMQTT(); err != nil {
+				return err
+			}
 		} else {
-			log.Warn("unknown gopush-cluster protocol %s, (\"websocket\" or \"tcp\")", proto)
+			log.Warn("unknown gopush-cluster protocol %s, (\"websocket\", \"tcp\", \"sse\", \"longpoll\" or \"mqtt\")", proto)
 		}
 	}
 	return nil
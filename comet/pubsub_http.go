@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sse comments
+	sseReady     = ": ready\n\n"
+	sseHeartbeat = ": h\n\n"
+)
+
+var (
+	sseHeader = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\nAccess-Control-Allow-Origin: *\r\n\r\n")
+	// long poll timed out without message, the client polls again
+	pollTimeoutReply = []byte("HTTP/1.1 204 No Content\r\nCache-Control: no-cache\r\nConnection: close\r\nAccess-Control-Allow-Origin: *\r\n\r\n")
+)
+
+// StartSSE start sse listen.
+func StartSSE() error {
+	for _, bind := range Conf.SSEBind {
+		log.Info("start sse listen addr:\"%s\"", bind)
+		go httpSubListen(bind, SubscribeSSEHandle)
+	}
+	return nil
+}
+
+// StartLongPoll start long polling listen.
+func StartLongPoll() error {
+	for _, bind := range Conf.LongPollBind {
+		log.Info("start long polling listen addr:\"%s\"", bind)
+		go httpSubListen(bind, SubscribeLongPollHandle)
+	}
+	return nil
+}
+
+func httpSubListen(bind string, handler http.HandlerFunc) {
+	httpServeMux := http.NewServeMux()
+	httpServeMux.HandleFunc("/sub", handler)
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+	server := &http.Server{Handler: httpServeMux}
+	if err = server.Serve(l); err != nil {
+		log.Error("server.Serve(\"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+}
+
+// parseSubParams get the key, heartbeat and version of the http sub request,
+// if params error return the error reply, the optional device and platform
+// params are read by subDevice.
+func parseSubParams(addr string, params url.Values) (key string, heartbeat int, version string, reply []byte) {
+	key = params.Get("key")
+	if key == "" {
+		log.Warn("<%s> key param error", addr)
+		return "", 0, "", ParamReply
+	}
+	heartbeatStr := params.Get("heartbeat")
+	i, err := strconv.Atoi(heartbeatStr)
+	if err != nil {
+		log.Error("<%s> user_key:\"%s\" heartbeat argument error(%v)", addr, key, err)
+		return "", 0, "", ParamReply
+	}
+	if i < minHearbeatSec {
+		log.Warn("<%s> user_key:\"%s\" heartbeat argument error, less than %d", addr, key, minHearbeatSec)
+		return "", 0, "", ParamReply
+	}
+	return key, i, params.Get("ver"), nil
+}
+
+// subDevice get the device id and platform label of the sub request.
+func subDevice(params url.Values) (device, platform string) {
+	return params.Get("device"), params.Get("platform")
+}
+
+// getSubChannel get the channel of the key, if failed return the error reply.
+func getSubChannel(addr, key string) (Channel, []byte) {
+	c, err := UserChannel.Get(key, true)
+	if err != nil {
+		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
+		if err == ErrChannelKey {
+			return nil, NodeReply
+		}
+		return nil, ChannelReply
+	}
+	return c, nil
+}
+
+// hijack take over the http connection.
+func hijack(w http.ResponseWriter, addr string) net.Conn {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		log.Error("<%s> http.ResponseWriter not a http.Hijacker", addr)
+		http.Error(w, "Internal Server Error", 500)
+		return nil
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Error("<%s> Hijack() error(%v)", addr, err)
+		return nil
+	}
+	// the handler owns the deadlines
+	conn.SetDeadline(time.Time{})
+	return conn
+}
+
+// sseEvent format a sse message event, every line of the message is a data field.
+func sseEvent(event string, msg []byte) []byte {
+	buf := &bytes.Buffer{}
+	if event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event)
+		buf.WriteByte('\n')
+	}
+	for _, line := range bytes.Split(msg, []byte{'\n'}) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// SubscribeSSEHandle is the server-sent events handle for sub request,
+// the pushes are message events, the errors are error events with the
+// reply code and the server writes comments as heartbeat every heartbeat seconds.
+func SubscribeSSEHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	addr := r.RemoteAddr
+	key, heartbeat, version, reply := parseSubParams(addr, r.URL.Query())
+	if reply != nil {
+		sseError(w, reply)
+		return
+	}
+	log.Info("<%s> sse subscribe to key = %s, heartbeat = %d, version = %s", addr, key, heartbeat, version)
+	c, reply := getSubChannel(addr, key)
+	if reply != nil {
+		sseError(w, reply)
+		return
+	}
+	conn := hijack(w, addr)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write(sseHeader); err != nil {
+		log.Error("<%s> user_key:\"%s\" conn.Write() error(%v)", addr, key, err)
+		return
+	}
+	connection := &Connection{Conn: conn, Proto: SSEProto, Version: version}
+	connection.Device, connection.Platform = subDevice(r.URL.Query())
+	connElem, err := c.AddConn(key, connection)
+	if err != nil {
+		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
+		return
+	}
+	// heartbeat comments, a failed write closes the conn
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(heartbeat) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := conn.Write([]byte(sseHeartbeat)); err != nil {
+					log.Warn("<%s> user_key:\"%s\" write heartbeat error(%v)", addr, key, err)
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+	// the client never sends, block till the connection closed
+	b := make([]byte, 1)
+	for {
+		if _, err = conn.Read(b); err != nil {
+			log.Warn("<%s> user_key:\"%s\" sse connection close error(%v)", addr, key, err)
+			break
+		}
+	}
+	close(stop)
+	if err := c.RemoveConn(key, connElem); err != nil {
+		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+	}
+}
+
+// sseError write the error reply code as a error event.
+func sseError(w http.ResponseWriter, reply []byte) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(sseEvent("error", replyCode(reply)))
+}
+
+// SubscribeLongPollHandle is the long polling handle for sub request, the
+// request is held till a message pushed (200 with the message body) or the
+// heartbeat seconds passed (204), the client polls again after every response
+// and gets the messages pushed between two polls from the agent offline api.
+func SubscribeLongPollHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	addr := r.RemoteAddr
+	key, heartbeat, version, reply := parseSubParams(addr, r.URL.Query())
+	if reply != nil {
+		pollError(w, reply)
+		return
+	}
+	log.Debug("<%s> long poll subscribe to key = %s, heartbeat = %d, version = %s", addr, key, heartbeat, version)
+	c, reply := getSubChannel(addr, key)
+	if reply != nil {
+		pollError(w, reply)
+		return
+	}
+	conn := hijack(w, addr)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	connection := &Connection{Conn: conn, Proto: LongPollProto, Version: version}
+	connection.Device, connection.Platform = subDevice(r.URL.Query())
+	connElem, err := c.AddConn(key, connection)
+	if err != nil {
+		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
+		return
+	}
+	// the writer closes the conn after the message response
+	if err = conn.SetReadDeadline(time.Now().Add(time.Duration(heartbeat) * time.Second)); err == nil {
+		b := make([]byte, 1)
+		for err == nil {
+			_, err = conn.Read(b)
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && connection.pollRespond() {
+		if _, err = conn.Write(pollTimeoutReply); err != nil {
+			log.Warn("<%s> user_key:\"%s\" conn.Write() error(%v)", addr, key, err)
+		}
+	}
+	if err := c.RemoveConn(key, connElem); err != nil {
+		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+	}
+}
+
+// pollError write the error reply code.
+func pollError(w http.ResponseWriter, reply []byte) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(reply)
+}
+
+// pollResponse format a long polling message response.
+func pollResponse(msg []byte) []byte {
+	return []byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nCache-Control: no-cache\r\nConnection: close\r\nAccess-Control-Allow-Origin: *\r\nContent-Length: " +
+		strconv.Itoa(len(msg)) + "\r\n\r\n" + string(msg))
+}
+
+// pollReply format a long polling error reply response, the body is the reply like pollError.
+func pollReply(reply []byte) []byte {
+	return []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nCache-Control: no-cache\r\nConnection: close\r\nAccess-Control-Allow-Origin: *\r\nContent-Length: " +
+		strconv.Itoa(len(reply)) + "\r\n\r\n" + string(reply))
+}
+
+// pollRespond mark the long polling connection responded, only the first caller get true.
+func (c *Connection) pollRespond() bool {
+	return atomic.CompareAndSwapInt32(&c.polled, 0, 1)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"github.com/lucas-chi/push-service/hlist"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// the mqtt connections use the new message format
+	mqttVersion = "3.1.1"
+	// max qos 1 messages waiting for PUBACK per connection
+	mqttMaxInflight = 1024
+)
+
+// mqttSession is the mqtt state of a connection.
+type mqttSession struct {
+	mutex    *sync.Mutex
+	filters  map[string]byte // subscribed topic filter -> granted qos
+	pid      uint16
+	inflight map[uint16]int64 // packet id -> message id
+}
+
+// qos get the max granted qos.
+func (s *mqttSession) qos() byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := byte(0)
+	for _, g := range s.filters {
+		if g > q {
+			q = g
+		}
+	}
+	return q
+}
+
+// publish allocate a packet id and track the message till PUBACK,
+// return false if too many messages inflight.
+func (s *mqttSession) publish(mid int64) (uint16, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.inflight) >= mqttMaxInflight {
+		return 0, false
+	}
+	for {
+		// packet id 0 is not allowed
+		if s.pid++; s.pid == 0 {
+			s.pid++
+		}
+		if _, ok := s.inflight[s.pid]; !ok {
+			break
+		}
+	}
+	s.inflight[s.pid] = mid
+	return s.pid, true
+}
+
+// ack remove the inflight message, return the message id.
+func (s *mqttSession) ack(pid uint16) (int64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mid, ok := s.inflight[pid]
+	delete(s.inflight, pid)
+	return mid, ok
+}
+
+// undelivered get the inflight message ids.
+func (s *mqttSession) undelivered() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mids := make([]int64, 0, len(s.inflight))
+	for _, mid := range s.inflight {
+		mids = append(mids, mid)
+	}
+	return mids
+}
+
+// StartMQTT start mqtt listen.
+func StartMQTT() error {
+	for _, bind := range Conf.MQTTBind {
+		log.Info("start mqtt listen addr:\"%s\"", bind)
+		go mqttListen(bind)
+	}
+	return nil
+}
+
+func mqttListen(bind string) {
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+	// free the listener resource
+	defer func() {
+		log.Info("mqtt addr: \"%s\" close", bind)
+		if err := l.Close(); err != nil {
+			log.Error("listener.Close() error(%v)", err)
+		}
+	}()
+	// init reader buffer instance
+	rb := newtcpBufCache()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error("listener.Accept() error(%v)", err)
+			continue
+		}
+		// first packet must sent by client in specified seconds
+		if err = conn.SetReadDeadline(time.Now().Add(fitstPacketTimedoutSec)); err != nil {
+			log.Error("conn.SetReadDeadLine() error(%v)", err)
+			conn.Close()
+			continue
+		}
+		rc := rb.Get()
+		// one connection one routine
+		go handleMQTTConn(conn, rc)
+	}
+}
+
+// handleMQTTConn handle a mqtt connection, the CONNECT client id is the
+// subscriber key and the user name is the device id, the connection joins the channel after the first SUBSCRIBE
+// of the key topic, PINGREQ resets the heartbeat timeout (1.5 keep alive, none if keep alive is 0).
+func handleMQTTConn(conn net.Conn, rc chan *bufio.Reader) {
+	addr := conn.RemoteAddr().String()
+	rd := newBufioReader(rc, conn)
+	defer func() {
+		putBufioReader(rc, rd)
+		if err := conn.Close(); err != nil {
+			log.Error("<%s> conn.Close() error(%v)", addr, err)
+		}
+	}()
+	p, err := readMQTTPacket(rd, Conf.MQTTMaxPacket)
+	if err != nil || p.Type != mqttConnect {
+		log.Error("<%s> mqtt first packet not CONNECT error(%v)", addr, err)
+		return
+	}
+	info, err := parseMQTTConnect(p.Body)
+	if err != nil {
+		log.Error("<%s> parseMQTTConnect() error(%v)", addr, err)
+		return
+	}
+	if info.ProtoName != mqttProtoName || info.Level != mqttProtoLevel {
+		writeMQTTPacket(conn, mqttConnack, 0, []byte{0, mqttBadProtoVersion})
+		log.Warn("<%s> mqtt protocol \"%s\" level %d not supported", addr, info.ProtoName, info.Level)
+		return
+	}
+	key := info.ClientId
+	if key == "" {
+		writeMQTTPacket(conn, mqttConnack, 0, []byte{0, mqttIdRejected})
+		log.Warn("<%s> mqtt client id empty", addr)
+		return
+	}
+	// keep alive 0 turns the keep alive off, the connection has no read timeout
+	heartbeat := 0
+	if keepAlive := info.KeepAlive; keepAlive > 0 {
+		if keepAlive < minHearbeatSec {
+			keepAlive = minHearbeatSec
+		}
+		heartbeat = keepAlive * 3 / 2
+	} else if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		log.Error("<%s> user_key:\"%s\" conn.SetReadDeadLine() error(%v)", addr, key, err)
+		return
+	}
+	c, err := UserChannel.Get(key, true)
+	if err != nil {
+		writeMQTTPacket(conn, mqttConnack, 0, []byte{0, mqttServerUnavailable})
+		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
+		return
+	}
+	if err = writeMQTTPacket(conn, mqttConnack, 0, []byte{0, mqttAccepted}); err != nil {
+		log.Error("<%s> user_key:\"%s\" write CONNACK error(%v)", addr, key, err)
+		return
+	}
+	log.Info("<%s> mqtt subscribe to key = %s, heartbeat = %d", addr, key, heartbeat)
+	session := &mqttSession{mutex: &sync.Mutex{}, filters: map[string]byte{}, inflight: map[uint16]int64{}}
+	connection := &Connection{Conn: conn, Proto: MQTTProto, Version: mqttVersion, Device: info.Username, mqtt: session}
+	var connElem *hlist.Element
+	begin := time.Now().UnixNano()
+	end := begin + Second
+	for {
+		// more then 1 sec, reset the timer
+		if heartbeat > 0 && end-begin >= Second {
+			if err = conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
+				log.Error("<%s> user_key:\"%s\" conn.SetReadDeadLine() error(%v)", addr, key, err)
+				break
+			}
+			begin = end
+		}
+		if p, err = readMQTTPacket(rd, Conf.MQTTMaxPacket); err != nil {
+			log.Warn("<%s> user_key:\"%s\" readMQTTPacket() error(%v)", addr, key, err)
+			break
+		}
+		if connElem, err = handleMQTTPacket(c, connection, connElem, key, p); err != nil {
+			break
+		}
+		end = time.Now().UnixNano()
+	}
+	if connElem != nil {
+		if err := c.RemoveConn(key, connElem); err != nil {
+			log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+		}
+	}
+	if mids := session.undelivered(); len(mids) > 0 {
+		log.Warn("<%s> user_key:\"%s\" mqtt undelivered messages: %v", addr, key, mids)
+	}
+}
+
+// handleMQTTPacket handle a packet after CONNECT, return the channel element
+// of the connection (nil if not subscribed), errors close the connection.
+func handleMQTTPacket(c Channel, connection *Connection, connElem *hlist.Element, key string, p *mqttPacket) (*hlist.Element, error) {
+	conn := connection.Conn
+	addr := conn.RemoteAddr().String()
+	session := connection.mqtt
+	topic := Conf.MQTTTopicPrefix + key
+	switch p.Type {
+	case mqttPingreq:
+		if err := writeMQTTPacket(conn, mqttPingresp, 0, nil); err != nil {
+			log.Error("<%s> user_key:\"%s\" write PINGRESP error(%v)", addr, key, err)
+			return connElem, err
+		}
+		log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
+	case mqttSubscribe:
+		pid, subs, err := parseMQTTSubscribe(p.Body)
+		if err != nil {
+			return connElem, err
+		}
+		body := []byte{byte(pid >> 8), byte(pid)}
+		for _, s := range subs {
+			// only the key topic can be subscribed, qos 2 is downgraded to 1
+			if !mqttTopicMatch(s.Filter, topic) {
+				body = append(body, mqttSubFailure)
+				log.Warn("<%s> user_key:\"%s\" topic filter \"%s\" not match \"%s\"", addr, key, s.Filter, topic)
+				continue
+			}
+			qos := s.QoS
+			if qos > 1 {
+				qos = 1
+			}
+			session.mutex.Lock()
+			session.filters[s.Filter] = qos
+			session.mutex.Unlock()
+			body = append(body, qos)
+		}
+		if err = writeMQTTPacket(conn, mqttSuback, 0, body); err != nil {
+			log.Error("<%s> user_key:\"%s\" write SUBACK error(%v)", addr, key, err)
+			return connElem, err
+		}
+		if connElem == nil && len(session.filters) > 0 {
+			if connElem, err = c.AddConn(key, connection); err != nil {
+				log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
+				return nil, err
+			}
+		}
+	case mqttUnsubscribe:
+		pid, b, err := mqttPacketId(p.Body)
+		if err != nil {
+			return connElem, err
+		}
+		for len(b) > 0 {
+			var filter string
+			if filter, b, err = mqttString(b); err != nil {
+				return connElem, err
+			}
+			session.mutex.Lock()
+			delete(session.filters, filter)
+			session.mutex.Unlock()
+		}
+		if err = writeMQTTPacket(conn, mqttUnsuback, 0, []byte{byte(pid >> 8), byte(pid)}); err != nil {
+			log.Error("<%s> user_key:\"%s\" write UNSUBACK error(%v)", addr, key, err)
+			return connElem, err
+		}
+		if connElem != nil && len(session.filters) == 0 {
+			if err = c.RemoveConn(key, connElem); err != nil {
+				log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+			}
+			return nil, err
+		}
+	case mqttPuback:
+		pid, _, err := mqttPacketId(p.Body)
+		if err != nil {
+			return connElem, err
+		}
+		if mid, ok := session.ack(pid); ok {
+			ackEvent(key, connection, mid)
+		} else {
+			log.Warn("<%s> user_key:\"%s\" mqtt PUBACK unknown packet id: %d", addr, key, pid)
+		}
+	case mqttPublish:
+		// upstream message
+		qos := (p.Flags >> 1) & 0x03
+		if qos > 1 {
+			log.Warn("<%s> user_key:\"%s\" mqtt publish qos %d not supported", addr, key, qos)
+			return connElem, ErrMQTTPacket
+		}
+		_, b, err := mqttString(p.Body)
+		if err != nil {
+			return connElem, err
+		}
+		pid := uint16(0)
+		if qos == 1 {
+			if pid, b, err = mqttPacketId(b); err != nil {
+				return connElem, err
+			}
+		}
+		if err = upstreamMsg(key, b); err == ErrProtocol {
+			return connElem, err
+		} else if err == nil && qos == 1 {
+			// not acked messages are resent by the client
+			if err = writeMQTTPacket(conn, mqttPuback, 0, []byte{byte(pid >> 8), byte(pid)}); err != nil {
+				log.Error("<%s> user_key:\"%s\" write PUBACK error(%v)", addr, key, err)
+				return connElem, err
+			}
+		}
+	case mqttDisconnect:
+		log.Info("<%s> user_key:\"%s\" mqtt disconnect", addr, key)
+		return connElem, ErrMQTTPacket
+	default:
+		log.Warn("<%s> user_key:\"%s\" mqtt unknown packet type: %d", addr, key, p.Type)
+		return connElem, ErrMQTTPacket
+	}
+	return connElem, nil
+}
+
+// writeMQTTPublish publish a pushed message to the key topic with the granted qos.
+func (c *Connection) writeMQTTPublish(key string, m *ConnMsg) error {
+	qos := c.mqtt.qos()
+	pid := uint16(0)
+	if qos > 0 {
+		ok := false
+		if pid, ok = c.mqtt.publish(m.MsgId); !ok {
+			// the client stops acking, treat as a slow consumer
+			c.Conn.Close()
+			log.Warn("user_key: \"%s\" mqtt too many inflight messages, close connection", key)
+			return ErrMQTTPacket
+		}
+	}
+	return writeMQTTPacket(c.Conn, mqttPublish, qos<<1, mqttPublishBody(Conf.MQTTTopicPrefix+key, qos, pid, m.Body))
+}
@@ -4,7 +4,9 @@ package main
 import (
 	"bufio"
 	log "code.google.com/p/log4go"
+	"encoding/json"
 	"errors"
+	myrpc "github.com/lucas-chi/push-service/rpc"
 	"io"
 	"net"
 	"strconv"
@@ -14,6 +16,9 @@ import (
 const (
 	minCmdNum = 1
 	maxCmdNum = 5
+	// upstream commands after sub
+	UpstreamCmd = "msg"
+	AckCmd      = "ack"
 )
 
 var (
@@ -140,13 +145,14 @@ func handleTCPConn(conn net.Conn, rc chan *bufio.Reader) {
 	log.Debug("<%s> handleTcpConn routine start", addr)
 	rd := newBufioReader(rc, conn)
 	if args, err := parseCmd(rd); err == nil {
-		// return buffer bufio.Reader
-		putBufioReader(rc, rd)
 		switch args[0] {
 		case "sub":
-			SubscribeTCPHandle(conn, args[1:])
+			// the reader is kept for the upstream commands
+			SubscribeTCPHandle(conn, rd, args[1:])
+			putBufioReader(rc, rd)
 			break
 		default:
+			putBufioReader(rc, rd)
 			conn.Write(ParamReply)
 			log.Warn("<%s> unknown cmd \"%s\"", addr, args[0])
 			break
@@ -164,31 +170,42 @@ func handleTCPConn(conn net.Conn, rc chan *bufio.Reader) {
 	return
 }
 
-// SubscribeTCPHandle handle the subscribers's connection.
-func SubscribeTCPHandle(conn net.Conn, args []string) {
+// SubscribeTCPHandle handle the subscribers's connection, after subscribed
+// the client sends single byte heartbeats or upstream commands:
+// *2\r\n$3\r\nmsg\r\n$len\r\n{json}\r\n or *2\r\n$3\r\nack\r\n$len\r\nmid\r\n.
+// If the fourth argument is "2" the connection switches to the framed protocol,
+// then if the fifth argument is "deflate" the large pushes are compressed.
+// The optional sixth and seventh arguments are the device id and platform.
+func SubscribeTCPHandle(conn net.Conn, rd *bufio.Reader, args []string) {
 	argLen := len(args)
 	addr := conn.RemoteAddr().String()
+	// negotiate the protocol first, so the errors are replied by it
+	proto := TCPProto
+	if argLen > 3 && args[3] == TCPFrameVersionStr {
+		proto = TCPFrameProto
+	}
+	connection := &Connection{Conn: conn, Proto: proto}
 	if argLen < 2 {
-		conn.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Error("<%s> subscriber missing argument", addr)
 		return
 	}
 	// key, heartbeat
 	key := args[0]
 	if key == "" {
-		conn.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Warn("<%s> key param error", addr)
 		return
 	}
 	heartbeatStr := args[1]
 	i, err := strconv.Atoi(heartbeatStr)
 	if err != nil {
-		conn.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Error("<%s> user_key:\"%s\" heartbeat:\"%s\" argument error (%v)", addr, key, heartbeatStr, err)
 		return
 	}
 	if i < minHearbeatSec {
-		conn.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Warn("<%s> user_key:\"%s\" heartbeat argument error, less than %d", addr, key, minHearbeatSec)
 		return
 	}
@@ -198,65 +215,223 @@ func SubscribeTCPHandle(conn net.Conn, args []string) {
 	if argLen > 2 {
 		version = args[2]
 	}
-	log.Info("<%s> subscribe to key = %s, heartbeat = %d, version = %s", addr, key, heartbeat, version)
+	connection.Version = version
+	connection.Compress = proto == TCPFrameProto && argLen > 4 && args[4] == CompressDeflateStr
+	if argLen > 5 {
+		connection.Device = args[5]
+	}
+	if argLen > 6 {
+		connection.Platform = args[6]
+	}
+	log.Info("<%s> subscribe to key = %s, heartbeat = %d, version = %s, proto = %d, compress = %t, device = %s", addr, key, heartbeat, version, proto, connection.Compress, connection.Device)
 	// fetch subscriber from the channel
 	c, err := UserChannel.Get(key, true)
 	if err != nil {
 		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
 		if err == ErrChannelKey {
-			conn.Write(NodeReply)
+			connection.WriteRedirect(key)
 		} else {
-			conn.Write(ChannelReply)
+			connection.WriteReply(ChannelReply)
 		}
 		return
 	}
 
 	// add a conn to the channel
-	connElem, err := c.AddConn(key, &Connection{Conn: conn, Proto: TCPProto, Version: version})
+	connElem, err := c.AddConn(key, connection)
 	if err != nil {
 		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
 		return
 	}
-	// blocking wait client heartbeat
-	reply := []byte{0}
-	// reply := make([]byte, HeartbeatLen)
+	// blocking wait client heartbeat and upstream commands
+	if proto == TCPFrameProto {
+		tcpFrameLoop(connection, rd, key, heartbeat)
+	} else {
+		tcpCmdLoop(connection, rd, key, heartbeat)
+	}
+	// remove exists conn
+	if err := c.RemoveConn(key, connElem); err != nil {
+		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+	}
+	return
+}
+
+// tcpCmdLoop read the heartbeats and upstream commands of the old protocol.
+func tcpCmdLoop(c *Connection, rd *bufio.Reader, key string, heartbeat int) {
+	conn := c.Conn
+	addr := conn.RemoteAddr().String()
 	begin := time.Now().UnixNano()
 	end := begin + Second
 	for {
 		// more then 1 sec, reset the timer
 		if end-begin >= Second {
-			if err = conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
+			if err := conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
 				log.Error("<%s> user_key:\"%s\" conn.SetReadDeadLine() error(%v)", addr, key, err)
-				break
+				return
 			}
 			begin = end
 		}
-		if _, err = conn.Read(reply); err != nil {
+		reply, err := rd.Peek(1)
+		if err != nil {
 			if err != io.EOF {
 				log.Warn("<%s> user_key:\"%s\" conn.Read() failed, read heartbeat timedout error(%v)", addr, key, err)
 			} else {
 				// client connection close
 				log.Warn("<%s> user_key:\"%s\" client connection close error(%v)", addr, key, err)
 			}
-			break
+			return
 		}
 		if string(reply) == Heartbeat {
+			rd.Discard(1)
 			if _, err = conn.Write(HeartbeatReply); err != nil {
 				log.Error("<%s> user_key:\"%s\" conn.Write() failed, write heartbeat to client error(%v)", addr, key, err)
-				break
+				return
+			}
+			log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
+		} else if reply[0] == '*' {
+			cmd, err := parseCmd(rd)
+			if err != nil {
+				log.Error("<%s> user_key:\"%s\" parseCmd() error(%v)", addr, key, err)
+				return
+			}
+			if err = handleTCPUpstream(c, key, cmd); err != nil {
+				return
 			}
-			log.Debug("<%s> user_key:\"%s\" receive heartbeat (%s)", addr, key, reply)
 		} else {
 			log.Warn("<%s> user_key:\"%s\" unknown heartbeat protocol (%s)", addr, key, reply)
-			break
+			return
 		}
 		end = time.Now().UnixNano()
 	}
-	// remove exists conn
-	if err := c.RemoveConn(key, connElem); err != nil {
-		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+}
+
+// tcpFrameLoop read the frames of the framed protocol.
+func tcpFrameLoop(c *Connection, rd *bufio.Reader, key string, heartbeat int) {
+	conn := c.Conn
+	addr := conn.RemoteAddr().String()
+	begin := time.Now().UnixNano()
+	end := begin + Second
+	for {
+		// more then 1 sec, reset the timer
+		if end-begin >= Second {
+			if err := conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
+				log.Error("<%s> user_key:\"%s\" conn.SetReadDeadLine() error(%v)", addr, key, err)
+				return
+			}
+			begin = end
+		}
+		f, err := ReadFrame(rd, Conf.TCPMaxCmdSize)
+		if err != nil {
+			if err == ErrFrame {
+				c.WriteReply(ParamReply)
+				log.Error("<%s> user_key:\"%s\" ReadFrame() error(%v)", addr, key, err)
+			} else if err != io.EOF {
+				log.Warn("<%s> user_key:\"%s\" conn.Read() failed, read heartbeat timedout error(%v)", addr, key, err)
+			} else {
+				// client connection close
+				log.Warn("<%s> user_key:\"%s\" client connection close error(%v)", addr, key, err)
+			}
+			return
+		}
+		if f.Flag&FrameFlagCompressed != 0 {
+			if f.Body, err = decompressMsg(f.Body, Conf.TCPMaxCmdSize); err != nil {
+				c.WriteReply(ParamReply)
+				log.Error("<%s> user_key:\"%s\" decompressMsg() error(%v)", addr, key, err)
+				return
+			}
+		}
+		switch f.Op {
+		case OpHeartbeat:
+			if err = c.WriteFrame(OpHeartbeat, 0, f.Seq, nil); err != nil {
+				log.Error("<%s> user_key:\"%s\" conn.Write() failed, write heartbeat to client error(%v)", addr, key, err)
+				return
+			}
+			log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
+		case OpAck:
+			mid, err := strconv.ParseInt(string(f.Body), 10, 64)
+			if err != nil {
+				c.WriteReply(ParamReply)
+				log.Warn("<%s> user_key:\"%s\" ack mid: \"%s\" error(%v)", addr, key, f.Body, err)
+				return
+			}
+			ackEvent(key, c, mid)
+		case OpUpstream:
+			if err = upstreamMsg(key, f.Body); err == ErrProtocol {
+				c.WriteReply(ParamReply)
+				return
+			} else if err == nil {
+				// ack the upstream seq, the client resends the unacked ones
+				if err = c.WriteFrame(OpAck, 0, f.Seq, nil); err != nil {
+					log.Error("<%s> user_key:\"%s\" conn.Write() failed, write ack to client error(%v)", addr, key, err)
+					return
+				}
+			}
+		case OpAuth:
+			c.WriteReply(AuthReply)
+			log.Warn("<%s> user_key:\"%s\" auth not supported", addr, key)
+			return
+		case OpClose:
+			log.Info("<%s> user_key:\"%s\" client close", addr, key)
+			return
+		default:
+			c.WriteReply(ParamReply)
+			log.Warn("<%s> user_key:\"%s\" unknown frame op: %d", addr, key, f.Op)
+			return
+		}
+		end = time.Now().UnixNano()
 	}
-	return
+}
+
+// handleTCPUpstream handle a upstream command of the subscribed client,
+// protocol errors are returned and the connection should be closed.
+func handleTCPUpstream(c *Connection, key string, args []string) error {
+	conn := c.Conn
+	addr := conn.RemoteAddr().String()
+	if len(args) != 2 {
+		conn.Write(ParamReply)
+		log.Warn("<%s> user_key:\"%s\" upstream cmd argument number: %d error", addr, key, len(args))
+		return ErrProtocol
+	}
+	switch args[0] {
+	case UpstreamCmd:
+		if err := upstreamMsg(key, []byte(args[1])); err == ErrProtocol {
+			conn.Write(ParamReply)
+			return err
+		} else if err != nil {
+			// tell the client to resend, keep the connection
+			if _, err = conn.Write(UpstreamReply); err != nil {
+				return err
+			}
+		}
+	case AckCmd:
+		mid, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			conn.Write(ParamReply)
+			log.Warn("<%s> user_key:\"%s\" ack mid: \"%s\" error(%v)", addr, key, args[1], err)
+			return ErrProtocol
+		}
+		ackEvent(key, c, mid)
+	default:
+		conn.Write(ParamReply)
+		log.Warn("<%s> user_key:\"%s\" unknown upstream cmd \"%s\"", addr, key, args[0])
+		return ErrProtocol
+	}
+	return nil
+}
+
+// upstreamMsg forward a upstream json message to the agent, not json returns ErrProtocol.
+func upstreamMsg(key string, msg []byte) error {
+	if !json.Valid(msg) {
+		log.Warn("user_key:\"%s\" upstream msg: \"%s\" not json", key, msg)
+		return ErrProtocol
+	}
+	ret := 0
+	args := &myrpc.MessageReplyArgs{SessionId: key, Msg: json.RawMessage(msg), NewSession: false, Node: Conf.ZookeeperCometNode}
+	if err := myrpc.CallTimeout(myrpc.AgentRPC.Get(), Conf.RPCTimeout, myrpc.AgentServiceReply, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.AgentServiceReply, args, err)
+		return err
+	}
+	log.Debug("user_key:\"%s\" received message : \"%s\"", key, msg)
+	return nil
 }
 
 // parseCmd parse the tcp request command.
@@ -279,6 +454,10 @@ func parseCmd(rd *bufio.Reader) ([]string, error) {
 			log.Error("tcp:parseCmdSize(rd, '$') error(%v)", err)
 			return nil, err
 		}
+		if cmdLen < 0 || cmdLen > Conf.TCPMaxCmdSize {
+			log.Error("tcp:cmd argument length: %d error", cmdLen)
+			return nil, ErrProtocol
+		}
 		// get argument data
 		d, err := parseCmdData(rd, cmdLen)
 		if err != nil {
@@ -313,16 +492,17 @@ func parseCmdSize(rd *bufio.Reader, prefix uint8) (int, error) {
 	return cmdSize, nil
 }
 
-// parseCmdData get the sub request protocol cmd data not included \r\n.
+// parseCmdData get the request protocol cmd data not included \r\n,
+// the data is read by length so it may contain \r\n.
 func parseCmdData(rd *bufio.Reader, cmdLen int) ([]byte, error) {
-	d, err := rd.ReadBytes('\n')
-	if err != nil {
-		log.Error("tcp:rd.ReadBytes('\\n') error(%v)", err)
+	d := make([]byte, cmdLen+2)
+	if _, err := io.ReadFull(rd, d); err != nil {
+		log.Error("tcp:io.ReadFull() error(%v)", err)
 		return nil, err
 	}
 	dl := len(d)
 	// check last \r\n
-	if dl != cmdLen+2 || d[dl-2] != '\r' {
+	if d[dl-2] != '\r' || d[dl-1] != '\n' {
 		log.Error("tcp:\"%v\"(%d) number format error, length error or no \\r", d, dl)
 		return nil, ErrProtocol
 	}
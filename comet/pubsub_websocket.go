@@ -1,15 +1,25 @@
-
 package main
 
 import (
-	"golang.org/x/net/websocket"
 	log "code.google.com/p/log4go"
+	"encoding/json"
+	"github.com/gorilla/websocket"
 	myrpc "github.com/lucas-chi/push-service/rpc"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
-	"encoding/json"
+)
+
+var (
+	wsUpgrader = &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       checkOrigin,
+		EnableCompression: true,
+	}
 )
 
 type KeepAliveListener struct {
@@ -51,16 +61,13 @@ func websocketListen(bind string) {
 		listener     *net.TCPListener
 		addr         *net.TCPAddr
 		httpServeMux = http.NewServeMux()
-		err error
+		err          error
 	)
-	httpServeMux.HandleFunc("/sub", func(w http.ResponseWriter, req *http.Request) {
-        s := websocket.Server{Handler: websocket.Handler(SubscribeHandle)}
-        s.ServeHTTP(w, req)
-    })
-	
+	httpServeMux.HandleFunc("/sub", SubscribeHandle)
+
 	if addr, err = net.ResolveTCPAddr("tcp4", bind); err != nil {
-			log.Error("net.ResolveTCPAddr(\"tcp4\", \"%s\") error(%v)", bind, err)
-			return
+		log.Error("net.ResolveTCPAddr(\"tcp4\", \"%s\") error(%v)", bind, err)
+		return
 	}
 	if listener, err = net.ListenTCP("tcp4", addr); err != nil {
 		log.Error("net.ListenTCP(\"tcp4\", \"%s\") error(%v)", bind, err)
@@ -76,99 +83,163 @@ func websocketListen(bind string) {
 	}()
 }
 
+// checkOrigin allow the origins in Conf.WebsocketOrigins, empty or "*"
+// allow all, the requests without Origin header are not from browsers.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(Conf.WebsocketOrigins) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		log.Warn("<%s> origin:\"%s\" parse error(%v)", r.RemoteAddr, origin, err)
+		return false
+	}
+	for _, o := range Conf.WebsocketOrigins {
+		if o == "*" || strings.EqualFold(o, origin) || strings.EqualFold(o, u.Host) {
+			return true
+		}
+	}
+	log.Warn("<%s> origin:\"%s\" not allowed", r.RemoteAddr, origin)
+	return false
+}
+
 // Subscriber Handle is the websocket handle for sub request.
-func SubscribeHandle(ws *websocket.Conn) {
+// sub params: key, heartbeat, ver, binary=1 push in binary frames, device and
+// platform of the client, large pushes are compressed if permessage-deflate negotiated.
+func SubscribeHandle(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade replied the http error
+		log.Error("<%s> websocket upgrade error(%v)", r.RemoteAddr, err)
+		return
+	}
 	log.Debug("connected to websocket...")
-	addr := ws.Request().RemoteAddr
-	params := ws.Request().URL.Query()
+	addr := r.RemoteAddr
+	params := r.URL.Query()
+	compress := strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	conn := NewWSConn(ws, params.Get("binary") == "1", compress)
+	connection := &Connection{Conn: conn, Proto: WebsocketProto, Compress: compress}
+	defer conn.Close()
 	// get subscriber key
 	key := params.Get("key")
-	
 	if key == "" {
-		ws.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Warn("<%s> key param error", addr)
 		return
 	}
-	
 	// get heartbeat second
 	heartbeatStr := params.Get("heartbeat")
 	i, err := strconv.Atoi(heartbeatStr)
 	if err != nil {
-		ws.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Error("<%s> user_key:\"%s\" heartbeat argument error(%v)", addr, key, err)
 		return
 	}
 	if i < minHearbeatSec {
-		ws.Write(ParamReply)
+		connection.WriteReply(ParamReply)
 		log.Warn("<%s> user_key:\"%s\" heartbeat argument error, less than %d", addr, key, minHearbeatSec)
 		return
 	}
-	heartbeat := i + delayHeartbeatSec
-
-	version := params.Get("ver")
-	log.Info("<%s> subscribe to key = %s, heartbeat = %d, version = %s", addr, key, heartbeat, version)
+	heartbeat := time.Duration(i+delayHeartbeatSec) * time.Second
+	connection.Version = params.Get("ver")
+	connection.Device, connection.Platform = subDevice(params)
+	log.Info("<%s> subscribe to key = %s, heartbeat = %d, version = %s, compress = %t, device = %s", addr, key, i, connection.Version, compress, connection.Device)
 	// fetch subscriber from the channel
 	c, err := UserChannel.Get(key, true)
 	if err != nil {
 		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
 		if err == ErrChannelKey {
-			ws.Write(NodeReply)
+			connection.WriteReply(NodeReply)
 		} else {
-			ws.Write(ChannelReply)
+			connection.WriteReply(ChannelReply)
 		}
 		return
 	}
-
+	// any frame from the client, include pong, proves the connection alive
+	ws.SetReadLimit(int64(Conf.WebsocketMaxMsgSize))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(heartbeat))
+	})
+	ws.SetPingHandler(func(data string) error {
+		if err := ws.SetReadDeadline(time.Now().Add(heartbeat)); err != nil {
+			return err
+		}
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsControlTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	if err = ws.SetReadDeadline(time.Now().Add(heartbeat)); err != nil {
+		log.Error("<%s> user_key:\"%s\" websocket.SetReadDeadline() error(%v)", addr, key, err)
+		return
+	}
 	// add a conn to the channel
-	connElem, err := c.AddConn(key, &Connection{Conn: ws, Proto: WebsocketProto, Version: version})
+	connElem, err := c.AddConn(key, connection)
 	if err != nil {
 		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
 		return
 	}
-	
+	// server ping, the client answers pong automatically
+	stop := make(chan bool)
+	go wsPing(ws, time.Duration(i)*time.Second, stop)
 	// reply welcome message
-	args := &myrpc.MessageReplyArgs{SessionId : key, Msg : nil, NewSession : true}
+	args := &myrpc.MessageReplyArgs{SessionId: key, Msg: nil, NewSession: true, Node: Conf.ZookeeperCometNode}
 	client := myrpc.AgentRPC.Get()
 	ret := 0
-	client.Call(myrpc.AgentServiceReply, args, &ret);
-	
+	if err := myrpc.CallTimeout(client, Conf.RPCTimeout, myrpc.AgentServiceReply, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.AgentServiceReply, args, err)
+	}
 	// blocking wait client heartbeat
-	reply := ""
-	begin := time.Now().UnixNano()
-	end := begin + Second
 	for {
-		// more then 1 sec, reset the timer
-		if end-begin >= Second {
-			if err = ws.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
-				log.Error("<%s> user_key:\"%s\" websocket.SetReadDeadline() error(%v)", addr, key, err)
-				break
+		_, reply, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Error("<%s> user_key:\"%s\" websocket.ReadMessage() error(%v)", addr, key, err)
 			}
-			begin = end
+			break
 		}
-		if err = websocket.Message.Receive(ws, &reply); err != nil {
-			log.Error("<%s> user_key:\"%s\" websocket.Message.Receive() error(%v)", addr, key, err)
+		if err = ws.SetReadDeadline(time.Now().Add(heartbeat)); err != nil {
+			log.Error("<%s> user_key:\"%s\" websocket.SetReadDeadline() error(%v)", addr, key, err)
 			break
 		}
-		if reply == Heartbeat {
-			if _, err = ws.Write(HeartbeatReply); err != nil {
+		if string(reply) == Heartbeat {
+			if _, err = conn.Write(HeartbeatReply); err != nil {
 				log.Error("<%s> user_key:\"%s\" write heartbeat to client error(%s)", addr, key, err)
 				break
 			}
 			log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
 		} else { // reply user message
-			args := &myrpc.MessageReplyArgs{SessionId : key, Msg : json.RawMessage(reply), NewSession : false}
-			if err := client.Call(myrpc.AgentServiceReply, args, &ret); err != nil {
+			args := &myrpc.MessageReplyArgs{SessionId: key, Msg: json.RawMessage(reply), NewSession: false, Node: Conf.ZookeeperCometNode}
+			if err := myrpc.CallTimeout(client, Conf.RPCTimeout, myrpc.AgentServiceReply, args, &ret); err != nil {
 				log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.AgentServiceReply, args, err)
-				continue;
+				continue
 			}
 			log.Debug("<%s> user_key:\"%s\" received message : \"%s\"", addr, key, reply)
-			//break
 		}
-		end = time.Now().UnixNano()
 	}
+	close(stop)
 	// remove exists conn
 	if err := c.RemoveConn(key, connElem); err != nil {
 		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
 	}
 	return
 }
+
+// wsPing send ping frames every interval until stop.
+func wsPing(ws *websocket.Conn, interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsControlTimeout)); err != nil {
+				log.Debug("websocket ping error(%v)", err)
+				return
+			}
+		}
+	}
+}
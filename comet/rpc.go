@@ -8,7 +8,9 @@ import (
 	myrpc "github.com/lucas-chi/push-service/rpc"
 	"net"
 	"net/rpc"
+	"runtime"
 	"sync"
+	"time"
 )
 
 var (
@@ -81,9 +83,40 @@ func (c *CometRPC) Close(key string, ret *int) error {
 	return nil
 }
 
+// PushPublic expored a method for publishing a public message to every channel
+// of the comet, the message is only delivered online, ret is the pushed channel count.
+func (c *CometRPC) PushPublic(args *myrpc.CometPushPublicArgs, ret *int) error {
+	if args == nil || len(args.Msg) == 0 {
+		return myrpc.ErrParam
+	}
+	m := &myrpc.Message{Msg: args.Msg, MsgId: args.MsgId, GroupId: myrpc.PublicGroupId, ExpireAt: args.ExpireAt, Priority: args.Priority}
+	n := 0
+	for _, b := range UserChannel.Channels {
+		// copy the channels, write outside the bucket lock
+		b.Lock()
+		keys := make([]string, 0, len(b.Data))
+		chs := make([]Channel, 0, len(b.Data))
+		for k, ch := range b.Data {
+			keys = append(keys, k)
+			chs = append(chs, ch)
+		}
+		b.Unlock()
+		for i, ch := range chs {
+			if err := ch.WriteMsg(keys[i], m, 0); err != nil {
+				log.Error("ch.WriteMsg(\"%s\", \"%d\") error(%v)", keys[i], m.MsgId, err)
+				continue
+			}
+			n++
+		}
+	}
+	*ret = n
+	log.Info("push public msg:%d to %d channels", m.MsgId, n)
+	return nil
+}
+
 // PushPrivate expored a method for publishing a user private message for the channel.
-// if it`s going failed then it`ll return an error
-func (c *CometRPC) PushPrivate(args *myrpc.CometPushPrivateArgs, ret *int) error {
+// if it`s going failed then it`ll return an error, ret is the live connection count.
+func (c *CometRPC) PushPrivate(args *myrpc.CometPushPrivateArgs, rw *myrpc.CometPushPrivateResp) error {
 	if args == nil || args.Key == "" {
 		return myrpc.ErrParam
 	}
@@ -94,11 +127,13 @@ func (c *CometRPC) PushPrivate(args *myrpc.CometPushPrivateArgs, ret *int) error
 		return err
 	}
 	// use the channel push message
-	m := &myrpc.Message{Msg: args.Msg}
+	m := &myrpc.Message{Msg: args.Msg, ExpireAt: args.ExpireAt, Priority: args.Priority, CollapseKey: args.CollapseKey, Devices: args.Devices, ExDevices: args.ExDevices}
 	if err = ch.PushMsg(args.Key, m, args.Expire); err != nil {
 		log.Error("ch.PushMsg(\"%s\", \"%v\") error(%v)", args.Key, m, err)
 		return err
 	}
+	rw.Online = ch.Online(m)
+	rw.MsgId = m.MsgId
 	return nil
 }
 
@@ -140,8 +175,12 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 	// every bucket start a goroutine, return till all bucket gorouint finish
 	wg := &sync.WaitGroup{}
 	wg.Add(len(bucketMap))
-	// stored every gorouint failed keys
+	// stored every gorouint failed keys and offline keys
 	fKeysList := make([][]string, len(bucketMap))
+	oKeysList := make([][]string, len(bucketMap))
+	// one message id for all the buckets, the offline keys are notified with it
+	timeId := id.Get()
+	rw.MsgId = timeId
 	ti := 0
 	for tb, tm := range bucketMap {
 		go func(b *ChannelBucket, m *batchChannel, i int) {
@@ -155,16 +194,15 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 				return
 			}
 			b.Lock()
-			defer b.Unlock()
-			timeId := id.Get()
-			msg := &myrpc.Message{Msg: args.Msg, MsgId: timeId}
+			msg := &myrpc.Message{Msg: args.Msg, MsgId: timeId, ExpireAt: args.ExpireAt, Priority: args.Priority, CollapseKey: args.CollapseKey, Devices: args.Devices, ExDevices: args.ExDevices}
 			// private message need persistence
 			// if message expired no need persistence, only send online message
 			// rewrite message id
 			resp := &myrpc.MessageSavePrivatesResp{}
 			if args.Expire > 0 {
-				args := &myrpc.MessageSavePrivatesArgs{Keys: m.Keys, Msg: args.Msg, MsgId: timeId, Expire: args.Expire}
-				if err := c.Call(myrpc.MessageServiceSavePrivates, args, resp); err != nil {
+				args := &myrpc.MessageSavePrivatesArgs{Keys: m.Keys, Msg: args.Msg, MsgId: timeId, Expire: args.Expire, ExpireAt: args.ExpireAt, CollapseKey: args.CollapseKey}
+				if err := myrpc.CallTimeout(c, Conf.RPCTimeout, myrpc.MessageServiceSavePrivates, args, resp); err != nil {
+					b.Unlock()
 					log.Error("%s(\"%v\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSavePrivates, m.Keys, args, err)
 					// static slice is thread-safe
 					fKeysList[i] = m.Keys
@@ -178,13 +216,18 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 			for _, fk := range resp.FKeys {
 				delete(m.Chs, fk)
 			}
+			// the online writes may wait a slow consumer, never under the bucket lock
+			b.Unlock()
 			// get all channels from batchChannel chs.
 			for key, ch := range m.Chs {
-				if err := ch.WriteMsg(key, msg); err != nil {
+				if err := ch.WriteMsg(key, msg, args.Expire); err != nil {
 					// ignore online push error, cause offline msg succeed
 					log.Error("ch.WriteMsg(\"%s\", \"%s\") error(%v)", key, string(msg.Msg), err)
 					continue
 				}
+				if ch.Online(msg) == 0 {
+					oKeysList[i] = append(oKeysList[i], key)
+				}
 			}
 		}(tb, tm, ti)
 		ti++
@@ -194,6 +237,9 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 	for _, k := range fKeysList {
 		rw.FKeys = append(rw.FKeys, k...)
 	}
+	for _, k := range oKeysList {
+		rw.OKeys = append(rw.OKeys, k...)
+	}
 	return nil
 }
 
@@ -202,6 +248,82 @@ func (c *CometRPC) Migrate(args *myrpc.CometMigrateArgs, ret *int) error {
 	return UserChannel.Migrate(args.Nodes)
 }
 
+// Presence get the live connections of the keys, the keys not belong to
+// this comet are returned in FKeys.
+func (c *CometRPC) Presence(args *myrpc.CometPresenceArgs, rw *myrpc.CometPresenceResp) error {
+	if args == nil {
+		return myrpc.ErrParam
+	}
+	rw.Presences = make(map[string]*myrpc.Presence, len(args.Keys))
+	for _, key := range args.Keys {
+		p, err := UserChannel.Presence(key)
+		if err != nil {
+			rw.FKeys = append(rw.FKeys, key)
+			continue
+		}
+		rw.Presences[key] = p
+	}
+	return nil
+}
+
+// Kick expored a method for closing the connections of a device of the key,
+// ret is the closed count.
+func (c *CometRPC) Kick(args *myrpc.CometKickArgs, ret *int) error {
+	if args == nil || args.Key == "" || args.Device == "" {
+		return myrpc.ErrParam
+	}
+	ch, err := UserChannel.Get(args.Key, false)
+	if err != nil {
+		if err == ErrChannelNotExist {
+			return nil
+		}
+		log.Error("UserChannel.Get(\"%s\") error(%v)", args.Key, err)
+		return err
+	}
+	*ret = ch.CloseConns(args.Key, []string{args.Device}, KickReply)
+	return nil
+}
+
+// CloseConn expored a method for closing all or the devices connections of
+// the key with a reason, then ban the re-subscription if ban > 0, ret is the
+// closed count.
+func (c *CometRPC) CloseConn(args *myrpc.CometCloseConnArgs, ret *int) error {
+	if args == nil || args.Key == "" || !myrpc.ValidCloseReason(args.Reason) {
+		return myrpc.ErrParam
+	}
+	ch, err := UserChannel.Get(args.Key, false)
+	if err != nil && err != ErrChannelNotExist {
+		log.Error("UserChannel.Get(\"%s\") error(%v)", args.Key, err)
+		return err
+	}
+	// ban first, the closed client may reconnect at once
+	if args.Ban > 0 {
+		UserBans.Ban(args.Key, args.Devices, time.Duration(args.Ban)*time.Second)
+		log.Info("user_key:\"%s\" devices:%v banned %d second", args.Key, args.Devices, args.Ban)
+	}
+	if ch == nil {
+		return nil
+	}
+	reply := KickReply
+	if args.Reason != "" {
+		reply = []byte("-" + args.Reason + "\r\n")
+	}
+	*ret = ch.CloseConns(args.Key, args.Devices, reply)
+	return nil
+}
+
+// Stats get the channel and connection counts of the comet.
+func (c *CometRPC) Stats(args int, rw *myrpc.CometStatsResp) error {
+	slow := SlowConsumerStat.Stat()
+	rw.Channels = UserChannel.Count()
+	rw.Conns, rw.ProtoConns = ConnStat.Stat()
+	rw.Acks, rw.ProtoAcks = AckStat.Stat()
+	rw.SlowConsumer = map[string]int64{"evicted": slow.Evicted, "dropped": slow.Dropped, "spilled": slow.Spilled}
+	rw.Goroutines = runtime.NumGoroutine()
+	rw.Uptime = int64(time.Since(startTime) / time.Second)
+	return nil
+}
+
 // Ping check health.
 func (c *CometRPC) Ping(args int, ret *int) error {
 	log.Debug("ping ok")
@@ -4,10 +4,12 @@ package main
 import (
 	log "code.google.com/p/log4go"
 	"errors"
+	"github.com/gorilla/websocket"
 	"github.com/lucas-chi/push-service/hlist"
 	"github.com/lucas-chi/push-service/id"
 	myrpc "github.com/lucas-chi/push-service/rpc"
 	"sync"
+	"time"
 )
 
 var (
@@ -39,21 +41,35 @@ func NewSeqChannel() *SeqChannel {
 }
 
 // WriteMsg implements the Channel WriteMsg method.
-func (c *SeqChannel) WriteMsg(key string, m *myrpc.Message) (err error) {
+func (c *SeqChannel) WriteMsg(key string, m *myrpc.Message, expire uint) (err error) {
 	c.mutex.Lock()
-	err = c.writeMsg(key, m)
+	blocked, err := c.writeMsg(key, m, expire > 0)
 	c.mutex.Unlock()
+	waitBlocked(blocked)
 	return
 }
 
-// writeMsg write msg to conn.
-func (c *SeqChannel) writeMsg(key string, m *myrpc.Message) (err error) {
+// writeMsg write msg to conn, the writes blocked by slow consumers are
+// returned, they must be waited after c.mutex released.
+func (c *SeqChannel) writeMsg(key string, m *myrpc.Message, stored bool) (blocked []*blockedWrite, err error) {
 	var (
-		oldMsg, msg, sendMsg []byte
+		oldMsg, msg, oldZMsg, zMsg, sendMsg []byte
+		// websocket permessage-deflate messages, [old, new][text, binary]
+		prepared [2][2]*websocket.PreparedMessage
 	)
-	// push message
+	// stale message, the stored one is dropped by the offline replay
+	if m.Expired(time.Now().Unix()) {
+		log.Warn("user_key:\"%s\" msg:%d expired at %d, skip online push", key, m.MsgId, m.ExpireAt)
+		return
+	}
+	// every encoding is done once per message, not per connection
 	for e := c.conn.Front(); e != nil; e = e.Next() {
 		conn, _ := e.Value.(*Connection)
+		if !m.Targets(conn.Device) {
+			continue
+		}
+		compress := false
+		enc := 0
 		// if version empty then use old protocol
 		if conn.Version == "" {
 			if oldMsg == nil {
@@ -62,6 +78,14 @@ func (c *SeqChannel) writeMsg(key string, m *myrpc.Message) (err error) {
 				}
 			}
 			sendMsg = oldMsg
+			if compress = conn.Compress && conn.Proto != WebsocketProto && len(oldMsg) >= Conf.CompressThreshold; compress {
+				if oldZMsg == nil {
+					if oldZMsg, err = compressMsg(oldMsg); err != nil {
+						return
+					}
+				}
+				sendMsg = oldZMsg
+			}
 		} else {
 			if msg == nil {
 				if msg, err = m.Bytes(); err != nil {
@@ -69,9 +93,35 @@ func (c *SeqChannel) writeMsg(key string, m *myrpc.Message) (err error) {
 				}
 			}
 			sendMsg = msg
+			enc = 1
+			if compress = conn.Compress && conn.Proto != WebsocketProto && len(msg) >= Conf.CompressThreshold; compress {
+				if zMsg == nil {
+					if zMsg, err = compressMsg(msg); err != nil {
+						return
+					}
+				}
+				sendMsg = zMsg
+			}
+		}
+		cm := &ConnMsg{MsgId: m.MsgId, Body: sendMsg, Compressed: compress, Msg: m, Stored: stored}
+		// websocket compresses the frame once for all the connections
+		if conn.Proto == WebsocketProto && conn.Compress && len(sendMsg) >= Conf.CompressThreshold {
+			ws, _ := conn.Conn.(*WSConn)
+			t := 0
+			if ws.msgType == websocket.BinaryMessage {
+				t = 1
+			}
+			if prepared[enc][t] == nil {
+				if prepared[enc][t], err = websocket.NewPreparedMessage(ws.msgType, sendMsg); err != nil {
+					return
+				}
+			}
+			cm.Prepared = prepared[enc][t]
 		}
 		// TODO use goroutine
-		conn.Write(key, sendMsg)
+		if w := conn.Write(key, cm); w != nil {
+			blocked = append(blocked, w)
+		}
 	}
 	return
 }
@@ -89,26 +139,31 @@ func (c *SeqChannel) PushMsg(key string, m *myrpc.Message, expire uint) (err err
 	//m.MsgId = c.timeID.ID()
 	m.MsgId = id.Get()
 	if m.GroupId != myrpc.PublicGroupId && expire > 0 {
-		args := &myrpc.MessageSavePrivateArgs{Key: key, Msg: m.Msg, MsgId: m.MsgId, Expire: expire}
+		args := &myrpc.MessageSavePrivateArgs{Key: key, Msg: m.Msg, MsgId: m.MsgId, Expire: expire, ExpireAt: m.ExpireAt, CollapseKey: m.CollapseKey}
 		ret := 0
-		if err = client.Call(myrpc.MessageServiceSavePrivate, args, &ret); err != nil {
+		if err = myrpc.CallTimeout(client, Conf.RPCTimeout, myrpc.MessageServiceSavePrivate, args, &ret); err != nil {
 			c.mutex.Unlock()
 			log.Error("%s(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSavePrivate, key, args, err)
 			return
 		}
 	}
 	// push message
-	if err = c.writeMsg(key, m); err != nil {
-		c.mutex.Unlock()
+	blocked, err := c.writeMsg(key, m, m.GroupId != myrpc.PublicGroupId && expire > 0)
+	c.mutex.Unlock()
+	waitBlocked(blocked)
+	if err != nil {
 		log.Error("c.WriteMsg(\"%s\", m) error(%v)", key, err)
-		return
 	}
-	c.mutex.Unlock()
 	return
 }
 
 // AddConn implements the Channel AddConn method.
 func (c *SeqChannel) AddConn(key string, conn *Connection) (*hlist.Element, error) {
+	if UserBans.Banned(key, conn.Device) {
+		conn.WriteClose(BanReply)
+		log.Warn("user_key:\"%s\" device:\"%s\" banned", key, conn.Device)
+		return nil, ErrBanned
+	}
 	c.mutex.Lock()
 	if c.conn.Len()+1 > Conf.MaxSubscriberPerChannel {
 		c.mutex.Unlock()
@@ -116,17 +171,20 @@ func (c *SeqChannel) AddConn(key string, conn *Connection) (*hlist.Element, erro
 		return nil, ErrMaxConn
 	}
 	// send first heartbeat to tell client service is ready for accept heartbeat
-	if _, err := conn.Conn.Write(HeartbeatReply); err != nil {
+	if err := conn.WriteReady(); err != nil {
 		c.mutex.Unlock()
 		log.Error("user_key:\"%s\" write first heartbeat to client error(%v)", key, err)
 		return nil, err
 	}
 	// add conn
-	conn.Buf = make(chan []byte, Conf.MsgBufNum)
-	conn.HandleWrite(key)
+	conn.ctime = time.Now().Unix()
+	conn.HandleWrite(key, UserChannel.Bucket(key).Writer)
 	e := c.conn.PushFront(conn)
+	if c.conn.Len() == 1 {
+		presenceEvent(key, conn, true)
+	}
 	c.mutex.Unlock()
-	//ConnStat.IncrAdd()
+	ConnStat.IncrAdd(conn.Proto)
 	log.Info("user_key:\"%s\" add conn = %d", key, c.conn.Len())
 	return e, nil
 }
@@ -135,17 +193,90 @@ func (c *SeqChannel) AddConn(key string, conn *Connection) (*hlist.Element, erro
 func (c *SeqChannel) RemoveConn(key string, e *hlist.Element) error {
 	c.mutex.Lock()
 	tmp := c.conn.Remove(e)
-	c.mutex.Unlock()
 	conn, ok := tmp.(*Connection)
 	if !ok {
+		c.mutex.Unlock()
 		return ErrAssectionConn
 	}
-	close(conn.Buf)
-	//ConnStat.IncrRemove()
+	// queued under the mutex like the online event, so they keep the order
+	if c.conn.Len() == 0 {
+		presenceEvent(key, conn, false)
+	}
+	c.mutex.Unlock()
+	conn.StopWrite()
+	ConnStat.IncrRemove(conn.Proto)
 	log.Info("user_key:\"%s\" remove conn = %d", key, c.conn.Len())
 	return nil
 }
 
+// Presence implements the Channel Presence method.
+func (c *SeqChannel) Presence() *myrpc.Presence {
+	p := &myrpc.Presence{}
+	c.mutex.Lock()
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		if conn, ok := e.Value.(*Connection); ok {
+			p.Conns = append(p.Conns, conn.presence())
+		}
+	}
+	c.mutex.Unlock()
+	p.Count = len(p.Conns)
+	return p
+}
+
+// Online implements the Channel Online method.
+func (c *SeqChannel) Online(m *myrpc.Message) int {
+	n := 0
+	c.mutex.Lock()
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		if conn, ok := e.Value.(*Connection); ok && m.Targets(conn.Device) {
+			n++
+		}
+	}
+	c.mutex.Unlock()
+	return n
+}
+
+// CloseConns implements the Channel CloseConns method.
+func (c *SeqChannel) CloseConns(key string, devices []string, reply []byte) int {
+	conns := []*Connection{}
+	c.mutex.Lock()
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		if conn, ok := e.Value.(*Connection); ok && matchDevice(conn.Device, devices) {
+			conns = append(conns, conn)
+		}
+	}
+	c.mutex.Unlock()
+	// write the replies out of the lock, the client may not read
+	for _, conn := range conns {
+		// the bucket writer resets the write deadline, close by a timer instead
+		nc := conn.Conn
+		timer := time.AfterFunc(Conf.WriteTimeout, func() { nc.Close() })
+		if err := conn.WriteClose(reply); err != nil {
+			log.Warn("user_key:\"%s\" device:\"%s\" write close reply error(%v)", key, conn.Device, err)
+		}
+		timer.Stop()
+		// the subscribe routine removes the conn after the read failed
+		if err := conn.Conn.Close(); err != nil {
+			log.Warn("user_key:\"%s\" device:\"%s\" conn.Close() error(%v)", key, conn.Device, err)
+		}
+	}
+	log.Info("user_key:\"%s\" devices:%v close %d conns, reason: \"%s\"", key, devices, len(conns), replyCode(reply))
+	return len(conns)
+}
+
+// matchDevice check the device is one of the devices, empty devices match all.
+func matchDevice(device string, devices []string) bool {
+	if len(devices) == 0 {
+		return true
+	}
+	for _, d := range devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
 // Close implements the Channel Close method.
 func (c *SeqChannel) Close() error {
 	c.mutex.Lock()
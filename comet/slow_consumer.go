@@ -0,0 +1,197 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"errors"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	"sync/atomic"
+	"time"
+)
+
+// The policies of a connection whose write buffer is full.
+const (
+	SlowConsumerClose      = "close"       // close the connection
+	SlowConsumerDropOldest = "drop-oldest" // discard the oldest buffered message
+	SlowConsumerDropNewest = "drop-newest" // discard the new message
+	SlowConsumerBlock      = "block"       // wait buffer space outside the channel locks, close after the timeout
+	SlowConsumerSpill      = "spill"       // store the new and the later messages offline
+)
+
+var (
+	ErrSlowConsumerPolicy = errors.New("unknown slow consumer policy")
+	SlowConsumerStat      = &slowConsumerStat{}
+)
+
+// slowConsumerStat counts the slow consumers of the comet.
+type slowConsumerStat struct {
+	Evicted int64 `json:"evicted"` // connections closed
+	Dropped int64 `json:"dropped"` // messages discarded
+	Spilled int64 `json:"spilled"` // messages stored offline
+}
+
+// IncrEvicted increase the evicted connection count.
+func (s *slowConsumerStat) IncrEvicted() {
+	atomic.AddInt64(&s.Evicted, 1)
+}
+
+// IncrDropped increase the dropped message count.
+func (s *slowConsumerStat) IncrDropped() {
+	atomic.AddInt64(&s.Dropped, 1)
+}
+
+// IncrSpilled increase the spilled message count.
+func (s *slowConsumerStat) IncrSpilled() {
+	atomic.AddInt64(&s.Spilled, 1)
+}
+
+// Stat get a snapshot of the counts.
+func (s *slowConsumerStat) Stat() *slowConsumerStat {
+	return &slowConsumerStat{
+		Evicted: atomic.LoadInt64(&s.Evicted),
+		Dropped: atomic.LoadInt64(&s.Dropped),
+		Spilled: atomic.LoadInt64(&s.Spilled),
+	}
+}
+
+// validateSlowConsumerPolicy check the configured policy.
+func validateSlowConsumerPolicy(policy string) error {
+	switch policy {
+	case SlowConsumerClose, SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerBlock, SlowConsumerSpill:
+		return nil
+	}
+	return ErrSlowConsumerPolicy
+}
+
+// slowConsumer apply Conf.SlowConsumerPolicy when the write buffer is full,
+// return true if the new message should be buffered. qmutex must be held,
+// it's still held when return.
+func (c *Connection) slowConsumer(key string, m *ConnMsg) bool {
+	switch Conf.SlowConsumerPolicy {
+	case SlowConsumerDropOldest:
+		// the oldest of the lowest priority, the stored messages keep the
+		// mid order so the queue is not strictly ordered by priority
+		i := 0
+		for j, o := range c.queue {
+			if o.priority() < c.queue[i].priority() {
+				i = j
+			}
+		}
+		log.Warn("user_key: \"%s\" slow consumer discard message: \"%s\"", key, string(c.queue[i].Body))
+		c.remove(i)
+		SlowConsumerStat.IncrDropped()
+		return true
+	case SlowConsumerDropNewest:
+		log.Warn("user_key: \"%s\" slow consumer discard message: \"%s\"", key, string(m.Body))
+		SlowConsumerStat.IncrDropped()
+		return false
+	case SlowConsumerSpill:
+		if !c.spill(key, m) {
+			// public or expired message
+			log.Warn("user_key: \"%s\" slow consumer discard message: \"%s\"", key, string(m.Body))
+			SlowConsumerStat.IncrDropped()
+		}
+		return false
+	default:
+		c.evict(key, m)
+		return false
+	}
+}
+
+// spill leave the message to the offline api, return false if it can't be
+// got from there. the client resumes after the last mid it got, so once a
+// message spilled the later ones must not be delivered online until the
+// client reconnects. qmutex must be held.
+func (c *Connection) spill(key string, m *ConnMsg) bool {
+	if m.Msg == nil || m.Msg.GroupId == myrpc.PublicGroupId || m.Msg.Expired(time.Now().Unix()) {
+		return false
+	}
+	c.spilling = true
+	if m.Stored {
+		log.Debug("user_key: \"%s\" slow consumer leave stored message: %d offline", key, m.MsgId)
+		return true
+	}
+	go spillMsg(key, m.Msg)
+	return true
+}
+
+// blockedWrite is a write waiting the buffer space of a slow consumer with
+// the block policy, it waits after the channel and bucket locks released.
+type blockedWrite struct {
+	conn     *Connection
+	key      string
+	m        *ConnMsg
+	ticket   uint64
+	deadline time.Time
+}
+
+// Wait wait the buffer space then queue the message, the blocked writes of
+// a connection are queued in the ticket order, the connection is closed if
+// no space before the deadline.
+func (w *blockedWrite) Wait() {
+	c := w.conn
+	timer := time.NewTimer(w.deadline.Sub(time.Now()))
+	defer timer.Stop()
+	c.qmutex.Lock()
+	for !c.closed && (c.blockHead != w.ticket || (!c.collapse(w.key, w.m) && len(c.queue) >= Conf.MsgBufNum)) {
+		if c.space == nil {
+			c.space = make(chan bool)
+		}
+		space := c.space
+		c.qmutex.Unlock()
+		select {
+		case <-space:
+			c.qmutex.Lock()
+		case <-timer.C:
+			c.qmutex.Lock()
+			if !c.closed {
+				// the later blocked writes are dropped
+				c.evict(w.key, w.m)
+				c.closed = true
+			}
+			c.blockHead++
+			c.wakeBlocked()
+			c.qmutex.Unlock()
+			return
+		}
+	}
+	// let the next ticket go
+	c.blockHead++
+	c.wakeBlocked()
+	if c.closed {
+		c.qmutex.Unlock()
+		return
+	}
+	c.schedule(w.m)
+}
+
+// waitBlocked wait the blocked writes one by one, no lock may be held.
+func waitBlocked(ws []*blockedWrite) {
+	for _, w := range ws {
+		w.Wait()
+	}
+}
+
+// evict close the slow consumer connection.
+func (c *Connection) evict(key string, m *ConnMsg) {
+	c.Conn.Close()
+	SlowConsumerStat.IncrEvicted()
+	log.Warn("user_key: \"%s\" discard message: \"%s\" and close connection", key, string(m.Body))
+}
+
+// spillMsg store the message of a slow consumer offline, the client gets it
+// from the offline api.
+func spillMsg(key string, m *myrpc.Message) {
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("user_key: \"%s\" spill message error(%v)", key, ErrMessageRPC)
+		return
+	}
+	args := &myrpc.MessageSavePrivateArgs{Key: key, Msg: m.Msg, MsgId: m.MsgId, Expire: uint(Conf.SlowConsumerSpillExpire / time.Second), ExpireAt: m.ExpireAt, CollapseKey: m.CollapseKey}
+	ret := 0
+	if err := myrpc.CallTimeout(client, Conf.RPCTimeout, myrpc.MessageServiceSavePrivate, args, &ret); err != nil {
+		log.Error("%s(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSavePrivate, key, args, err)
+		return
+	}
+	SlowConsumerStat.IncrSpilled()
+	log.Debug("user_key: \"%s\" slow consumer spill message: %d", key, m.MsgId)
+}
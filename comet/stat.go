@@ -0,0 +1,86 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ConnStat  = &connStat{}
+	startTime = time.Now()
+)
+
+// connStat counts the live connections of the comet per protocol.
+type connStat struct {
+	conns [MQTTProto + 1]int64
+}
+
+// IncrAdd increase the connection count of the protocol.
+func (s *connStat) IncrAdd(proto uint8) {
+	if int(proto) < len(s.conns) {
+		atomic.AddInt64(&s.conns[proto], 1)
+	}
+}
+
+// IncrRemove decrease the connection count of the protocol.
+func (s *connStat) IncrRemove(proto uint8) {
+	if int(proto) < len(s.conns) {
+		atomic.AddInt64(&s.conns[proto], -1)
+	}
+}
+
+// Stat get a snapshot of the total and per protocol counts.
+func (s *connStat) Stat() (int64, map[string]int64) {
+	total, protos := int64(0), make(map[string]int64, len(s.conns))
+	for proto := range s.conns {
+		n := atomic.LoadInt64(&s.conns[proto])
+		protos[protoName(uint8(proto))] = n
+		total += n
+	}
+	return total, protos
+}
+
+// StartStat start the stat http listen.
+func StartStat() {
+	httpServeMux := http.NewServeMux()
+	httpServeMux.HandleFunc("/stat", StatHandle)
+	for _, bind := range Conf.StatBind {
+		log.Info("start stat listen addr:\"%s\"", bind)
+		go func(bind string) {
+			if err := http.ListenAndServe(bind, httpServeMux); err != nil {
+				log.Error("http.ListenAndServe(\"%s\") error(%v)", bind, err)
+				panic(err)
+			}
+		}(bind)
+	}
+}
+
+// StatHandle get the comet stat.
+func StatHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	conns, protoConns := ConnStat.Stat()
+	acks, protoAcks := AckStat.Stat()
+	res := map[string]interface{}{
+		"slow_consumer": SlowConsumerStat.Stat(),
+		"conns":         conns,
+		"proto_conns":   protoConns,
+		"acks":          acks,
+		"proto_acks":    protoAcks,
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.Error("json.Marshal(\"%v\") error(%v)", res, err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if _, err := w.Write(body); err != nil {
+		log.Error("w.Write(\"%s\") error(%v)", string(body), err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+const (
+	// websocket close codes of the error replies (private use range)
+	WSCloseAuth    = 4001
+	WSCloseChannel = 4002
+	WSCloseParam   = 4003
+	WSCloseNode    = 4004
+	WSCloseKick    = 4005 // closed by the admin, the reason is the close reason
+	WSCloseBan     = 4006
+	// control frame write timeout
+	wsControlTimeout = 5 * time.Second
+)
+
+var (
+	ErrWSRead = errors.New("websocket conn read not supported, use NextReader")
+)
+
+// WSConn adapts a websocket connection to the net.Conn of Connection, Write
+// sends a whole message. gorilla websocket allows one concurrent writer, the
+// data writes are serialized by wmutex, the control frames are safe.
+type WSConn struct {
+	*websocket.Conn
+	wmutex   *sync.Mutex
+	msgType  int  // push message type, text or binary
+	compress bool // permessage-deflate negotiated
+}
+
+// NewWSConn create a WSConn.
+func NewWSConn(conn *websocket.Conn, binary, compress bool) *WSConn {
+	msgType := websocket.TextMessage
+	if binary {
+		msgType = websocket.BinaryMessage
+	}
+	if compress {
+		conn.SetCompressionLevel(Conf.CompressLevel)
+	}
+	return &WSConn{Conn: conn, wmutex: &sync.Mutex{}, msgType: msgType, compress: compress}
+}
+
+// Read implements the net.Conn Read method, the messages are read by NextReader.
+func (c *WSConn) Read(b []byte) (int, error) {
+	return 0, ErrWSRead
+}
+
+// Write implements the net.Conn Write method, only the messages reach the
+// compression threshold are compressed.
+func (c *WSConn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.Conn.EnableWriteCompression(c.compress && len(b) >= Conf.CompressThreshold)
+	if err := c.Conn.WriteMessage(c.msgType, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WritePrepared write a message prepared once for all the connections.
+func (c *WSConn) WritePrepared(pm *websocket.PreparedMessage) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	c.Conn.EnableWriteCompression(c.compress)
+	return c.Conn.WritePreparedMessage(pm)
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (c *WSConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// CloseReply write the old protocol reply message for compatible, then
+// the close frame with the mapped code and the reply code as reason.
+func (c *WSConn) CloseReply(reply []byte) error {
+	return c.CloseCode(wsCloseCode(reply), reply)
+}
+
+// CloseCode write the old protocol reply message, then the close frame with
+// the code and the reply code as reason.
+func (c *WSConn) CloseCode(code int, reply []byte) error {
+	c.Write(reply)
+	return c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, string(replyCode(reply))), time.Now().Add(wsControlTimeout))
+}
+
+// wsCloseCode map the error reply to the close code.
+func wsCloseCode(reply []byte) int {
+	switch string(reply) {
+	case string(AuthReply):
+		return WSCloseAuth
+	case string(ChannelReply):
+		return WSCloseChannel
+	case string(ParamReply):
+		return WSCloseParam
+	case string(NodeReply):
+		return WSCloseNode
+	case string(KickReply):
+		return WSCloseKick
+	case string(BanReply):
+		return WSCloseBan
+	default:
+		return websocket.CloseInternalServerErr
+	}
+}
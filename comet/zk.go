@@ -33,6 +33,9 @@ func InitZK() (*zk.Conn, error) {
 	nodeInfo.RpcAddr = Conf.RPCBind
 	nodeInfo.TcpAddr = Conf.TCPBind
 	nodeInfo.WsAddr = Conf.WebsocketBind
+	nodeInfo.SseAddr = Conf.SSEBind
+	nodeInfo.PollAddr = Conf.LongPollBind
+	nodeInfo.MqttAddr = Conf.MQTTBind
 	nodeInfo.Weight = Conf.ZookeeperCometWeight
 	data, err := json.Marshal(nodeInfo)
 	if err != nil {
@@ -3,7 +3,7 @@
 
 go get -u github.com/lucas-chi/push-service
 go get -u github.com/garyburd/redigo/redis
-go get -u code.google.com/p/go.net/websocket
+go get -u github.com/gorilla/websocket
 go get -u github.com/samuel/go-zookeeper
 go get -u code.google.com/p/log4go
 go get -u code.google.com/p/go-uuid/uuid
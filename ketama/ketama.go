@@ -75,3 +75,26 @@ func (h *HashRing) Hash(s string) string {
 
 	return h.ticks[i].node
 }
+
+// Ownership get the fraction of the hash space owned by every node, a hash
+// belongs to the first tick at or after it, so the first tick also owns the
+// wrap around part after the last tick.
+func (h *HashRing) Ownership() map[string]float64 {
+	own := make(map[string]float64)
+	if h.length == 0 {
+		return own
+	}
+	const space = 1 << 32
+	prev := uint64(h.ticks[h.length-1].hash)
+	for i := 0; i < h.length; i++ {
+		t := h.ticks[i]
+		cur := uint64(t.hash)
+		span := cur - prev
+		if i == 0 {
+			span = space - prev + cur
+		}
+		own[t.node] += float64(span) / space
+		prev = cur
+	}
+	return own
+}
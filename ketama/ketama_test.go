@@ -3,6 +3,7 @@
 package ketama
 
 import (
+	"math"
 	"strconv"
 	"testing"
 )
@@ -19,3 +20,37 @@ func Benchmark_Hash(b *testing.B) {
 		ring.Hash(strconv.Itoa(i))
 	}
 }
+
+func TestOwnership(t *testing.T) {
+	ring := NewRing(Base)
+	if len(ring.Ownership()) != 0 {
+		t.Error("empty ring must own nothing")
+	}
+	ring.AddNode("node1", 1)
+	ring.Bake()
+	if own := ring.Ownership(); own["node1"] != 1 {
+		t.Errorf("single node ownership %v, want 1", own["node1"])
+	}
+	ring = NewRing(Base)
+	ring.AddNode("node1", 3)
+	ring.AddNode("node2", 1)
+	ring.Bake()
+	own := ring.Ownership()
+	sum := own["node1"] + own["node2"]
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("ownership sum %v, want 1", sum)
+	}
+	// the ownership must match the keys really hashed to the node
+	n, hit := 100000, 0
+	for i := 0; i < n; i++ {
+		if ring.Hash(strconv.Itoa(i)) == "node1" {
+			hit++
+		}
+	}
+	if d := math.Abs(float64(hit)/float64(n) - own["node1"]); d > 0.01 {
+		t.Errorf("node1 ownership %v, hashed %v", own["node1"], float64(hit)/float64(n))
+	}
+	if own["node1"] < own["node2"] {
+		t.Errorf("node1 weight 3 ownership %v less than node2 %v", own["node1"], own["node2"])
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 	log "code.google.com/p/log4go"
 	myrpc "github.com/lucas-chi/push-service/rpc"
@@ -14,18 +16,59 @@ import (
 const (
 	userMsgNamespace string = "userMsg"
 	userMsgExpire uint = 3600 * 10
+	chatSessionsKey string = "chatSessions"
+	chatOperatorNamespace string = "chatOperator"
+	collapseNamespace string = "collapse"
+	schedulesKey string = "schedules" // zset of schedule id scored by delivery time
+	scheduleKey string = "schedule"   // hash of schedule id -> schedule json
+	deviceTokenNamespace string = "deviceToken" // hash of platform:token -> register time
 )
 
 var (
 	RedisNoConnErr       = errors.New("can't get a redis conn")
 	redisProtocolSpliter = "@"
+	// delete the operator key only if owned by the operator
+	releaseScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+	// replace the msg with the same collapse key, KEYS: msgs, collapse hash
+	// ARGV: mid, msg, collapse key, max store, collapse hash expire second.
+	// the hash expire is only extended, it outlives every msg it tracks
+	collapseScript = redis.NewScript(2, `
+local old = redis.call("HGET", KEYS[2], ARGV[3])
+if old then redis.call("ZREMRANGEBYSCORE", KEYS[1], old, old) end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -1 - tonumber(ARGV[4]))
+redis.call("HSET", KEYS[2], ARGV[3], ARGV[1])
+if redis.call("TTL", KEYS[2]) < tonumber(ARGV[5]) then redis.call("EXPIRE", KEYS[2], ARGV[5]) end
+return 1`)
+	// take the due schedules, KEYS: schedules zset, schedule hash, ARGV: now, limit
+	popScheduleScript = redis.NewScript(2, `
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+if #ids == 0 then return {} end
+local vals = redis.call("HMGET", KEYS[2], unpack(ids))
+redis.call("ZREM", KEYS[1], unpack(ids))
+redis.call("HDEL", KEYS[2], unpack(ids))
+return vals`)
 )
 
 
 // RedisMessage struct encoding the composite info.
 type RedisPrivateMessage struct {
-	Msg    json.RawMessage `json:"msg"`    // message content
-	Expire int64           `json:"expire"` // expire second
+	Msg         json.RawMessage `json:"msg"`                    // message content
+	Expire      int64           `json:"expire"`                 // expire second
+	Role        string          `json:"role,omitempty"`         // chat message sender role
+	Ctime       int64           `json:"ctime,omitempty"`        // chat message create unix time
+	ExpireAt    int64           `json:"expire_at,omitempty"`    // delivery deadline unix time
+	CollapseKey string          `json:"collapse_key,omitempty"` // only the latest msg with the key is kept
+}
+
+// newRedisPrivateMessage create a stored private message, no need to keep
+// the message after the delivery deadline.
+func newRedisPrivateMessage(msg json.RawMessage, expire uint, expireAt int64, collapseKey string) *RedisPrivateMessage {
+	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + time.Now().Unix(), ExpireAt: expireAt, CollapseKey: collapseKey}
+	if expireAt > 0 && expireAt < rm.Expire {
+		rm.Expire = expireAt
+	}
+	return rm
 }
 
 // Struct for delele message
@@ -74,8 +117,8 @@ func NewRedisStorage() *RedisStorage {
 }
 
 // SavePrivate implements the Storage SavePrivate method.
-func (s *RedisStorage) SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) error {
-	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + time.Now().Unix()}
+func (s *RedisStorage) SavePrivate(key string, msg json.RawMessage, mid int64, expire uint, expireAt int64, collapseKey string) error {
+	rm := newRedisPrivateMessage(msg, expire, expireAt, collapseKey)
 	m, err := json.Marshal(rm)
 	if err != nil {
 		log.Error("json.Marshal() key:\"%s\" error(%v)", key, err)
@@ -86,34 +129,52 @@ func (s *RedisStorage) SavePrivate(key string, msg json.RawMessage, mid int64, e
 		return RedisNoConnErr
 	}
 	defer conn.Close()
-	
-	if err = conn.Send("ZADD", key, mid, m); err != nil {
-		log.Error("conn.Send(\"ZADD\", \"%s\", %d, \"%s\") error(%v)", key, mid, string(m), err)
-		return err
-	}
-	if err = conn.Send("ZREMRANGEBYRANK", key, 0, -1*(Conf.RedisMaxStore+1)); err != nil {
-		log.Error("conn.Send(\"ZREMRANGEBYRANK\", \"%s\", 0, %d) error(%v)", key, -1*(Conf.RedisMaxStore+1), err)
+	replies, err := sendPrivate(conn, key, mid, m, rm)
+	if err != nil {
 		return err
 	}
 	if err = conn.Flush(); err != nil {
 		log.Error("conn.Flush() error(%v)", err)
 		return err
 	}
-	if _, err = conn.Receive(); err != nil {
-		log.Error("conn.Receive() error(%v)", err)
-		return err
-	}
-	if _, err = conn.Receive(); err != nil {
-		log.Error("conn.Receive() error(%v)", err)
-		return err
+	for i := 0; i < replies; i++ {
+		if _, err = conn.Receive(); err != nil {
+			log.Error("conn.Receive() error(%v)", err)
+			return err
+		}
 	}
 	return nil
 }
 
+// sendPrivate send the commands of saving a private msg, return the number of replies.
+func sendPrivate(conn redis.Conn, key string, mid int64, m []byte, rm *RedisPrivateMessage) (int, error) {
+	if rm.CollapseKey != "" {
+		ckey := fmt.Sprintf("%s.%s", collapseNamespace, key)
+		ttl := rm.Expire - time.Now().Unix()
+		if ttl < 1 {
+			ttl = 1
+		}
+		if err := collapseScript.Send(conn, key, ckey, mid, m, rm.CollapseKey, Conf.RedisMaxStore, ttl); err != nil {
+			log.Error("collapseScript.Send(\"%s\", \"%s\", %d, \"%s\") error(%v)", key, ckey, mid, rm.CollapseKey, err)
+			return 0, err
+		}
+		return 1, nil
+	}
+	if err := conn.Send("ZADD", key, mid, m); err != nil {
+		log.Error("conn.Send(\"ZADD\", \"%s\", %d, \"%s\") error(%v)", key, mid, string(m), err)
+		return 0, err
+	}
+	if err := conn.Send("ZREMRANGEBYRANK", key, 0, -1*(Conf.RedisMaxStore+1)); err != nil {
+		log.Error("conn.Send(\"ZREMRANGEBYRANK\", \"%s\", 0, %d) error(%v)", key, -1*(Conf.RedisMaxStore+1), err)
+		return 0, err
+	}
+	return 2, nil
+}
+
 // SavePrivates implements the Storage SavePrivates method.
-func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) error {
+func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint, expireAt int64, collapseKey string) error {
 	// raw msg
-	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + time.Now().Unix()}
+	rm := newRedisPrivateMessage(msg, expire, expireAt, collapseKey)
 	m, err := json.Marshal(rm)
 	
 	if err != nil {
@@ -128,20 +189,14 @@ func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int6
 		return RedisNoConnErr
 	}
 	
+	replies := 0
 	for _, key := range keys {
-
-		if err = conn.Send("ZADD", key, mid, m); err != nil {
+		n, err := sendPrivate(conn, key, mid, m, rm)
+		if err != nil {
 			conn.Close()
-			log.Error("conn.Send(\"ZADD\", \"%s\", %d, \"%s\") error(%v)", key, mid, string(m), err)
 			return err
 		}
-		
-		if err = conn.Send("ZREMRANGEBYRANK", key, 0, -1*(Conf.RedisMaxStore+1)); err != nil {
-			conn.Close()
-			log.Error("conn.Send(\"ZREMRANGEBYRANK\", \"%s\", 0, %d) error(%v)", key, -1*(Conf.RedisMaxStore+1), err)
-			return err
-		} 
-		
+		replies += n
 	}
 	
 	// flush commands
@@ -152,16 +207,10 @@ func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int6
 	}
 	
 	// receive
-	for j := 0; j < len(keys); j++ {
+	for j := 0; j < replies; j++ {
 		if _, err = conn.Receive(); err != nil {
 			conn.Close()
 			log.Error("conn.Receive() error(%v)", err)
-				return err
-			}
-
-			if _, err = conn.Receive(); err != nil {
-				conn.Close()
-				log.Error("conn.Receive() error(%v)", err)
 			return err
 		}
 	}
@@ -204,7 +253,7 @@ func (s *RedisStorage) GetPrivate(key string, mid int64) ([]*myrpc.Message, erro
 			delMsgs = append(delMsgs, cmid)
 			continue
 		}
-		m := &myrpc.Message{MsgId: cmid, Msg: rm.Msg, GroupId: myrpc.PrivateGroupId}
+		m := &myrpc.Message{MsgId: cmid, Msg: rm.Msg, GroupId: myrpc.PrivateGroupId, ExpireAt: rm.ExpireAt, CollapseKey: rm.CollapseKey}
 		msgs = append(msgs, m)
 	}
 	// delete unmarshal failed and expired message
@@ -225,8 +274,9 @@ func (s *RedisStorage) DelPrivate(key string) error {
 		return RedisNoConnErr
 	}
 	defer conn.Close()
-	if _, err := conn.Do("DEL", key); err != nil {
-		log.Error("conn.Do(\"DEL\", \"%s\") error(%v)", key, err)
+	ckey := fmt.Sprintf("%s.%s", collapseNamespace, key)
+	if _, err := conn.Do("DEL", key, ckey); err != nil {
+		log.Error("conn.Do(\"DEL\", \"%s\", \"%s\") error(%v)", key, ckey, err)
 		return err
 	}
 	return nil
@@ -265,10 +315,11 @@ func (s *RedisStorage) clean() {
 	}
 }
 
-// SavePrivate implements the Storage SaveUserMsg method.
-func (s *RedisStorage) SaveUserMsg(sessionId string, msg json.RawMessage, mid int64, expire uint) error {
+// SaveUserMsg implements the Storage SaveUserMsg method.
+func (s *RedisStorage) SaveUserMsg(sessionId, role string, msg json.RawMessage, mid int64, expire uint) error {
 	key := fmt.Sprintf("%s.%s", userMsgNamespace, sessionId)
-	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + time.Now().Unix()}
+	now := time.Now().Unix()
+	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + now, Role: role, Ctime: now}
 	m, err := json.Marshal(rm)
 	if err != nil {
 		log.Error("json.Marshal() key:\"%s\" error(%v)", key, err)
@@ -316,7 +367,47 @@ func (s *RedisStorage) GetUserMsg(sessionId string) ([]*myrpc.Message, error) {
 		log.Error("conn.Do(\"ZRANGEBYSCORE\", \"%s\", \"%d\", \"-inf +inf\", \"WITHSCORES\") error(%v)", key, err)
 		return nil, err
 	}
-	msgs := make([]*myrpc.Message, 0, len(values))
+	return s.scanUserMsgs(key, values)
+}
+
+// GetConversation implements the Storage GetConversation method.
+func (s *RedisStorage) GetConversation(sessionId string, before int64, limit int) ([]*myrpc.Message, bool, error) {
+	key := fmt.Sprintf("%s.%s", userMsgNamespace, sessionId)
+	conn := s.getConn()
+	if conn == nil {
+		return nil, false, RedisNoConnErr
+	}
+	defer conn.Close()
+	max := "+inf"
+	if before > 0 {
+		max = fmt.Sprintf("(%d", before)
+	}
+	// fetch one more to know if older messages exist
+	values, err := redis.Values(conn.Do("ZREVRANGEBYSCORE", key, max, "-inf", "WITHSCORES", "LIMIT", 0, limit+1))
+	if err != nil {
+		log.Error("conn.Do(\"ZREVRANGEBYSCORE\", \"%s\", \"%s\", \"-inf\", \"WITHSCORES\", \"LIMIT\", 0, %d) error(%v)", key, max, limit+1, err)
+		return nil, false, err
+	}
+	more := len(values)/2 > limit
+	if more {
+		values = values[:limit*2]
+	}
+	msgs, err := s.scanUserMsgs(key, values)
+	if err != nil {
+		return nil, false, err
+	}
+	// oldest first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, more, nil
+}
+
+// scanUserMsgs scan the chat messages from the zset values with scores,
+// the unmarshal failed and expired messages are deleted asynchronously.
+func (s *RedisStorage) scanUserMsgs(key string, values []interface{}) ([]*myrpc.Message, error) {
+	var err error
+	msgs := make([]*myrpc.Message, 0, len(values)/2)
 	delMsgs := []int64{}
 	now := time.Now().Unix()
 	for len(values) > 0 {
@@ -339,7 +430,12 @@ func (s *RedisStorage) GetUserMsg(sessionId string) ([]*myrpc.Message, error) {
 			delMsgs = append(delMsgs, cmid)
 			continue
 		}
-		m := &myrpc.Message{MsgId: cmid, Msg: rm.Msg}
+		// messages stored before the roles are user messages
+		role := rm.Role
+		if role == "" {
+			role = myrpc.ChatRoleUser
+		}
+		m := &myrpc.Message{MsgId: cmid, Msg: rm.Msg, Role: role, Ctime: rm.Ctime}
 		msgs = append(msgs, m)
 	}
 	// delete unmarshal failed and expired message
@@ -353,6 +449,285 @@ func (s *RedisStorage) GetUserMsg(sessionId string) ([]*myrpc.Message, error) {
 	return msgs, nil
 }
 
+// TouchChatSession implements the Storage TouchChatSession method.
+func (s *RedisStorage) TouchChatSession(sessionId string) (string, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return "", RedisNoConnErr
+	}
+	defer conn.Close()
+	okey := fmt.Sprintf("%s.%s", chatOperatorNamespace, sessionId)
+	if _, err := conn.Do("ZADD", chatSessionsKey, time.Now().Unix(), sessionId); err != nil {
+		log.Error("conn.Do(\"ZADD\", \"%s\", \"%s\") error(%v)", chatSessionsKey, sessionId, err)
+		return "", err
+	}
+	// keep the claim alive with the session
+	operator, err := redis.String(conn.Do("GET", okey))
+	if err == redis.ErrNil {
+		return "", nil
+	} else if err != nil {
+		log.Error("conn.Do(\"GET\", \"%s\") error(%v)", okey, err)
+		return "", err
+	}
+	if _, err = conn.Do("EXPIRE", okey, userMsgExpire); err != nil {
+		log.Error("conn.Do(\"EXPIRE\", \"%s\") error(%v)", okey, err)
+		return "", err
+	}
+	return operator, nil
+}
+
+// GetChatSessions implements the Storage GetChatSessions method.
+func (s *RedisStorage) GetChatSessions(limit int) ([]*myrpc.ChatSession, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return nil, RedisNoConnErr
+	}
+	defer conn.Close()
+	// clean the expired sessions
+	min := time.Now().Unix() - int64(userMsgExpire)
+	if _, err := conn.Do("ZREMRANGEBYSCORE", chatSessionsKey, "-inf", fmt.Sprintf("(%d", min)); err != nil {
+		log.Error("conn.Do(\"ZREMRANGEBYSCORE\", \"%s\", \"-inf\", %d) error(%v)", chatSessionsKey, min, err)
+		return nil, err
+	}
+	values, err := redis.Values(conn.Do("ZREVRANGEBYSCORE", chatSessionsKey, "+inf", min, "WITHSCORES", "LIMIT", 0, limit))
+	if err != nil {
+		log.Error("conn.Do(\"ZREVRANGEBYSCORE\", \"%s\", \"+inf\", %d) error(%v)", chatSessionsKey, min, err)
+		return nil, err
+	}
+	sessions := make([]*myrpc.ChatSession, 0, len(values)/2)
+	okeys := make([]interface{}, 0, len(values)/2)
+	for len(values) > 0 {
+		session := &myrpc.ChatSession{}
+		if values, err = redis.Scan(values, &session.SessionId, &session.Atime); err != nil {
+			log.Error("redis.Scan() error(%v)", err)
+			return nil, err
+		}
+		sessions = append(sessions, session)
+		okeys = append(okeys, fmt.Sprintf("%s.%s", chatOperatorNamespace, session.SessionId))
+	}
+	if len(sessions) == 0 {
+		return sessions, nil
+	}
+	operators, err := redis.Strings(conn.Do("MGET", okeys...))
+	if err != nil {
+		log.Error("conn.Do(\"MGET\", \"%v\") error(%v)", okeys, err)
+		return nil, err
+	}
+	for i, operator := range operators {
+		sessions[i].Operator = operator
+	}
+	return sessions, nil
+}
+
+// ClaimChatSession implements the Storage ClaimChatSession method.
+func (s *RedisStorage) ClaimChatSession(sessionId, operator string) (string, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return "", RedisNoConnErr
+	}
+	defer conn.Close()
+	okey := fmt.Sprintf("%s.%s", chatOperatorNamespace, sessionId)
+	if _, err := conn.Do("SET", okey, operator, "EX", userMsgExpire, "NX"); err != nil && err != redis.ErrNil {
+		log.Error("conn.Do(\"SET\", \"%s\", \"%s\", \"NX\") error(%v)", okey, operator, err)
+		return "", err
+	}
+	current, err := redis.String(conn.Do("GET", okey))
+	if err != nil && err != redis.ErrNil {
+		log.Error("conn.Do(\"GET\", \"%s\") error(%v)", okey, err)
+		return "", err
+	}
+	return current, nil
+}
+
+// ReleaseChatSession implements the Storage ReleaseChatSession method.
+func (s *RedisStorage) ReleaseChatSession(sessionId, operator string) (string, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return "", RedisNoConnErr
+	}
+	defer conn.Close()
+	okey := fmt.Sprintf("%s.%s", chatOperatorNamespace, sessionId)
+	if _, err := releaseScript.Do(conn, okey, operator); err != nil {
+		log.Error("releaseScript.Do(\"%s\", \"%s\") error(%v)", okey, operator, err)
+		return "", err
+	}
+	current, err := redis.String(conn.Do("GET", okey))
+	if err != nil && err != redis.ErrNil {
+		log.Error("conn.Do(\"GET\", \"%s\") error(%v)", okey, err)
+		return "", err
+	}
+	return current, nil
+}
+
+// SaveSchedule implements the Storage SaveSchedule method.
+func (s *RedisStorage) SaveSchedule(sp *myrpc.SchedulePush) error {
+	b, err := json.Marshal(sp)
+	if err != nil {
+		log.Error("json.Marshal(\"%v\") error(%v)", sp, err)
+		return err
+	}
+	conn := s.getConn()
+	if conn == nil {
+		return RedisNoConnErr
+	}
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HSET", scheduleKey, sp.Id, b)
+	conn.Send("ZADD", schedulesKey, sp.DeliverAt, sp.Id)
+	if _, err = conn.Do("EXEC"); err != nil {
+		log.Error("conn.Do(\"EXEC\") schedule: \"%s\" error(%v)", sp.Id, err)
+		return err
+	}
+	return nil
+}
+
+// GetSchedules implements the Storage GetSchedules method.
+func (s *RedisStorage) GetSchedules(limit int) ([]*myrpc.SchedulePush, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return nil, RedisNoConnErr
+	}
+	defer conn.Close()
+	ids, err := redis.Values(conn.Do("ZRANGEBYSCORE", schedulesKey, "-inf", "+inf", "LIMIT", 0, limit))
+	if err != nil {
+		log.Error("conn.Do(\"ZRANGEBYSCORE\", \"%s\", \"-inf\", \"+inf\") error(%v)", schedulesKey, err)
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []*myrpc.SchedulePush{}, nil
+	}
+	values, err := redis.Values(conn.Do("HMGET", append([]interface{}{scheduleKey}, ids...)...))
+	if err != nil {
+		log.Error("conn.Do(\"HMGET\", \"%s\") error(%v)", scheduleKey, err)
+		return nil, err
+	}
+	return scanSchedules(values), nil
+}
+
+// DelSchedule implements the Storage DelSchedule method.
+func (s *RedisStorage) DelSchedule(id string) (bool, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return false, RedisNoConnErr
+	}
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("ZREM", schedulesKey, id)
+	conn.Send("HDEL", scheduleKey, id)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		log.Error("conn.Do(\"EXEC\") del schedule: \"%s\" error(%v)", id, err)
+		return false, err
+	}
+	n, err := redis.Int(values[0], nil)
+	if err != nil {
+		log.Error("redis.Int() error(%v)", err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PopDueSchedules implements the Storage PopDueSchedules method.
+func (s *RedisStorage) PopDueSchedules(now int64, limit int) ([]*myrpc.SchedulePush, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return nil, RedisNoConnErr
+	}
+	defer conn.Close()
+	values, err := redis.Values(popScheduleScript.Do(conn, schedulesKey, scheduleKey, now, limit))
+	if err != nil {
+		log.Error("popScheduleScript.Do(%d, %d) error(%v)", now, limit, err)
+		return nil, err
+	}
+	return scanSchedules(values), nil
+}
+
+// scanSchedules unmarshal the schedule jsons, skip the broken ones.
+func scanSchedules(values []interface{}) []*myrpc.SchedulePush {
+	schedules := make([]*myrpc.SchedulePush, 0, len(values))
+	for _, v := range values {
+		b, err := redis.Bytes(v, nil)
+		if err != nil {
+			// deleted meanwhile
+			continue
+		}
+		sp := &myrpc.SchedulePush{}
+		if err = json.Unmarshal(b, sp); err != nil {
+			log.Error("json.Unmarshal(\"%s\") error(%v)", string(b), err)
+			continue
+		}
+		schedules = append(schedules, sp)
+	}
+	return schedules
+}
+
+// SaveDeviceToken implements the Storage SaveDeviceToken method.
+func (s *RedisStorage) SaveDeviceToken(key, platform, token string) error {
+	conn := s.getConn()
+	if conn == nil {
+		return RedisNoConnErr
+	}
+	defer conn.Close()
+	tkey := fmt.Sprintf("%s.%s", deviceTokenNamespace, key)
+	if _, err := conn.Do("HSET", tkey, platform+":"+token, time.Now().Unix()); err != nil {
+		log.Error("conn.Do(\"HSET\", \"%s\", \"%s:%s\") error(%v)", tkey, platform, token, err)
+		return err
+	}
+	return nil
+}
+
+// DelDeviceToken implements the Storage DelDeviceToken method.
+func (s *RedisStorage) DelDeviceToken(key, platform, token string) error {
+	conn := s.getConn()
+	if conn == nil {
+		return RedisNoConnErr
+	}
+	defer conn.Close()
+	tkey := fmt.Sprintf("%s.%s", deviceTokenNamespace, key)
+	if _, err := conn.Do("HDEL", tkey, platform+":"+token); err != nil {
+		log.Error("conn.Do(\"HDEL\", \"%s\", \"%s:%s\") error(%v)", tkey, platform, token, err)
+		return err
+	}
+	return nil
+}
+
+// GetDeviceTokens implements the Storage GetDeviceTokens method.
+func (s *RedisStorage) GetDeviceTokens(keys []string) (map[string][]*myrpc.DeviceToken, error) {
+	conn := s.getConn()
+	if conn == nil {
+		return nil, RedisNoConnErr
+	}
+	defer conn.Close()
+	for _, key := range keys {
+		if err := conn.Send("HGETALL", fmt.Sprintf("%s.%s", deviceTokenNamespace, key)); err != nil {
+			log.Error("conn.Send(\"HGETALL\", \"%s\") error(%v)", key, err)
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		log.Error("conn.Flush() error(%v)", err)
+		return nil, err
+	}
+	tokens := make(map[string][]*myrpc.DeviceToken, len(keys))
+	for _, key := range keys {
+		values, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			log.Error("conn.Receive() key: \"%s\" error(%v)", key, err)
+			return nil, err
+		}
+		for field, mtime := range values {
+			idx := strings.Index(field, ":")
+			if idx < 0 {
+				continue
+			}
+			t := &myrpc.DeviceToken{Platform: field[:idx], Token: field[idx+1:]}
+			t.Mtime, _ = strconv.ParseInt(mtime, 10, 64)
+			tokens[key] = append(tokens[key], t)
+		}
+	}
+	return tokens, nil
+}
+
 // getConn get the connection
 func (s *RedisStorage) getConn() redis.Conn {
 	return s.pool.Get()
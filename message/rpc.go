@@ -44,8 +44,8 @@ func (r *MessageRPC) SavePrivate(m *myrpc.MessageSavePrivateArgs, ret *int) erro
 	if m == nil || m.Msg == nil || m.MsgId < 0 {
 		return myrpc.ErrParam
 	}
-	if err := UseStorage.SavePrivate(m.Key, m.Msg, m.MsgId, m.Expire); err != nil {
-		log.Error("UseStorage.SavePrivate(\"%s\", \"%s\", %d, %d) error(%v)", m.Key, string(m.Msg), m.MsgId, m.Expire, err)
+	if err := UseStorage.SavePrivate(m.Key, m.Msg, m.MsgId, m.Expire, m.ExpireAt, m.CollapseKey); err != nil {
+		log.Error("UseStorage.SavePrivate(\"%s\", \"%s\", %d, %d, %d, \"%s\") error(%v)", m.Key, string(m.Msg), m.MsgId, m.Expire, m.ExpireAt, m.CollapseKey, err)
 		return err
 	}
 	log.Debug("UseStorage.SavePrivate(\"%s\", \"%s\", %d, %d) ok", m.Key, string(m.Msg), m.MsgId, m.Expire)
@@ -57,9 +57,9 @@ func (r *MessageRPC) SavePrivates(m *myrpc.MessageSavePrivatesArgs, rw *myrpc.Me
 	if m == nil || m.Msg == nil || m.MsgId < 0 {
 		return myrpc.ErrParam
 	}
-	err := UseStorage.SavePrivates(m.Keys, m.Msg, m.MsgId, m.Expire)
+	err := UseStorage.SavePrivates(m.Keys, m.Msg, m.MsgId, m.Expire, m.ExpireAt, m.CollapseKey)
 	if err != nil {
-		log.Error("UseStorage.SavePrivates(\"%v\", \"%s\", %d, %d) error(%v)", m.Keys, string(m.Msg), m.MsgId, m.Expire, err)
+		log.Error("UseStorage.SavePrivates(\"%v\", \"%s\", %d, %d, %d, \"%s\") error(%v)", m.Keys, string(m.Msg), m.MsgId, m.Expire, m.ExpireAt, m.CollapseKey, err)
 	}
 
 	log.Debug("UseStorage.SavePrivates(\"%v\", \"%s\", %d, %d) ok", m.Keys, string(m.Msg), m.MsgId, m.Expire)
@@ -100,11 +100,15 @@ func (r *MessageRPC) SaveUserMsg(m *myrpc.MessageSaveUserMsgArgs, ret *int) erro
 	if m == nil || m.Msg == nil || m.MsgId < 0 {
 		return myrpc.ErrParam
 	}
-	if err := UseStorage.SaveUserMsg(m.SessionId, m.Msg, m.MsgId, m.Expire); err != nil {
-		log.Error("UseStorage.SaveUserMsg(\"%s\", \"%s\", %d, %d) error(%v)", m.SessionId, string(m.Msg), m.MsgId, m.Expire, err)
+	role := m.Role
+	if role == "" {
+		role = myrpc.ChatRoleUser
+	}
+	if err := UseStorage.SaveUserMsg(m.SessionId, role, m.Msg, m.MsgId, m.Expire); err != nil {
+		log.Error("UseStorage.SaveUserMsg(\"%s\", \"%s\", \"%s\", %d, %d) error(%v)", m.SessionId, role, string(m.Msg), m.MsgId, m.Expire, err)
 		return err
 	}
-	log.Debug("UseStorage.SaveUserMsg(\"%s\", \"%s\", %d, %d) ok", m.SessionId, string(m.Msg), m.MsgId, m.Expire)
+	log.Debug("UseStorage.SaveUserMsg(\"%s\", \"%s\", \"%s\", %d, %d) ok", m.SessionId, role, string(m.Msg), m.MsgId, m.Expire)
 	return nil
 }
 
@@ -129,6 +133,175 @@ func (r *MessageRPC) GetUserMsg(m *myrpc.MessageGetUserMsgArgs, rw *myrpc.Messag
 	return nil
 }
 
+// GetConversation rpc interface get a page of the chat messages.
+func (r *MessageRPC) GetConversation(m *myrpc.MessageGetConversationArgs, rw *myrpc.MessageGetConversationResp) error {
+	if m == nil || m.SessionId == "" || m.Before < 0 || m.Limit <= 0 {
+		return myrpc.ErrParam
+	}
+	msgs, more, err := UseStorage.GetConversation(m.SessionId, m.Before, m.Limit)
+	if err != nil {
+		log.Error("UseStorage.GetConversation(\"%s\", %d, %d) error(%v)", m.SessionId, m.Before, m.Limit, err)
+		return err
+	}
+	rw.Msgs = msgs
+	rw.More = more
+	log.Debug("UseStorage.GetConversation(\"%s\", %d, %d) ok, %d msgs", m.SessionId, m.Before, m.Limit, len(msgs))
+	return nil
+}
+
+// TouchChatSession rpc interface refresh the chat session, return the assigned operator.
+func (r *MessageRPC) TouchChatSession(sessionId string, rw *myrpc.MessageChatOperatorResp) error {
+	if sessionId == "" {
+		return myrpc.ErrParam
+	}
+	operator, err := UseStorage.TouchChatSession(sessionId)
+	if err != nil {
+		log.Error("UseStorage.TouchChatSession(\"%s\") error(%v)", sessionId, err)
+		return err
+	}
+	rw.Operator = operator
+	return nil
+}
+
+// GetChatSessions rpc interface get the active chat sessions.
+func (r *MessageRPC) GetChatSessions(m *myrpc.MessageGetChatSessionsArgs, rw *myrpc.MessageGetChatSessionsResp) error {
+	if m == nil || m.Limit <= 0 {
+		return myrpc.ErrParam
+	}
+	sessions, err := UseStorage.GetChatSessions(m.Limit)
+	if err != nil {
+		log.Error("UseStorage.GetChatSessions(%d) error(%v)", m.Limit, err)
+		return err
+	}
+	rw.Sessions = sessions
+	return nil
+}
+
+// ClaimChatSession rpc interface assign the chat session to the operator.
+func (r *MessageRPC) ClaimChatSession(m *myrpc.MessageChatOperatorArgs, rw *myrpc.MessageChatOperatorResp) error {
+	if m == nil || m.SessionId == "" || m.Operator == "" {
+		return myrpc.ErrParam
+	}
+	operator, err := UseStorage.ClaimChatSession(m.SessionId, m.Operator)
+	if err != nil {
+		log.Error("UseStorage.ClaimChatSession(\"%s\", \"%s\") error(%v)", m.SessionId, m.Operator, err)
+		return err
+	}
+	rw.Operator = operator
+	log.Debug("UseStorage.ClaimChatSession(\"%s\", \"%s\") owner: \"%s\"", m.SessionId, m.Operator, operator)
+	return nil
+}
+
+// ReleaseChatSession rpc interface release the chat session back to the robot.
+func (r *MessageRPC) ReleaseChatSession(m *myrpc.MessageChatOperatorArgs, rw *myrpc.MessageChatOperatorResp) error {
+	if m == nil || m.SessionId == "" || m.Operator == "" {
+		return myrpc.ErrParam
+	}
+	operator, err := UseStorage.ReleaseChatSession(m.SessionId, m.Operator)
+	if err != nil {
+		log.Error("UseStorage.ReleaseChatSession(\"%s\", \"%s\") error(%v)", m.SessionId, m.Operator, err)
+		return err
+	}
+	rw.Operator = operator
+	log.Debug("UseStorage.ReleaseChatSession(\"%s\", \"%s\") owner: \"%s\"", m.SessionId, m.Operator, operator)
+	return nil
+}
+
+// SaveSchedule rpc interface save a scheduled push.
+func (r *MessageRPC) SaveSchedule(m *myrpc.SchedulePush, ret *int) error {
+	if m == nil || m.Id == "" || len(m.Keys) == 0 || m.Msg == nil {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.SaveSchedule(m); err != nil {
+		log.Error("UseStorage.SaveSchedule(\"%s\") error(%v)", m.Id, err)
+		return err
+	}
+	log.Debug("UseStorage.SaveSchedule(\"%s\") deliver at %d ok", m.Id, m.DeliverAt)
+	return nil
+}
+
+// GetSchedules rpc interface get the pending scheduled pushes.
+func (r *MessageRPC) GetSchedules(m *myrpc.MessageGetSchedulesArgs, rw *myrpc.MessageSchedulesResp) error {
+	if m == nil || m.Limit <= 0 {
+		return myrpc.ErrParam
+	}
+	schedules, err := UseStorage.GetSchedules(m.Limit)
+	if err != nil {
+		log.Error("UseStorage.GetSchedules(%d) error(%v)", m.Limit, err)
+		return err
+	}
+	rw.Schedules = schedules
+	return nil
+}
+
+// DelSchedule rpc interface cancel a scheduled push, ret 1 if deleted.
+func (r *MessageRPC) DelSchedule(id string, ret *int) error {
+	if id == "" {
+		return myrpc.ErrParam
+	}
+	ok, err := UseStorage.DelSchedule(id)
+	if err != nil {
+		log.Error("UseStorage.DelSchedule(\"%s\") error(%v)", id, err)
+		return err
+	}
+	if ok {
+		*ret = 1
+	}
+	return nil
+}
+
+// PopDueSchedules rpc interface take the due scheduled pushes.
+func (r *MessageRPC) PopDueSchedules(m *myrpc.MessagePopDueSchedulesArgs, rw *myrpc.MessageSchedulesResp) error {
+	if m == nil || m.Limit <= 0 {
+		return myrpc.ErrParam
+	}
+	schedules, err := UseStorage.PopDueSchedules(m.Now, m.Limit)
+	if err != nil {
+		log.Error("UseStorage.PopDueSchedules(%d, %d) error(%v)", m.Now, m.Limit, err)
+		return err
+	}
+	rw.Schedules = schedules
+	return nil
+}
+
+// SaveDeviceToken rpc interface register a push gateway token.
+func (r *MessageRPC) SaveDeviceToken(m *myrpc.MessageDeviceTokenArgs, ret *int) error {
+	if m == nil || m.Key == "" || m.Platform == "" || m.Token == "" {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.SaveDeviceToken(m.Key, m.Platform, m.Token); err != nil {
+		log.Error("UseStorage.SaveDeviceToken(\"%s\", \"%s\", \"%s\") error(%v)", m.Key, m.Platform, m.Token, err)
+		return err
+	}
+	return nil
+}
+
+// DelDeviceToken rpc interface unregister a push gateway token.
+func (r *MessageRPC) DelDeviceToken(m *myrpc.MessageDeviceTokenArgs, ret *int) error {
+	if m == nil || m.Key == "" || m.Platform == "" || m.Token == "" {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.DelDeviceToken(m.Key, m.Platform, m.Token); err != nil {
+		log.Error("UseStorage.DelDeviceToken(\"%s\", \"%s\", \"%s\") error(%v)", m.Key, m.Platform, m.Token, err)
+		return err
+	}
+	return nil
+}
+
+// GetDeviceTokens rpc interface get the push gateway tokens of the keys.
+func (r *MessageRPC) GetDeviceTokens(m *myrpc.MessageGetDeviceTokensArgs, rw *myrpc.MessageGetDeviceTokensResp) error {
+	if m == nil || len(m.Keys) == 0 {
+		return myrpc.ErrParam
+	}
+	tokens, err := UseStorage.GetDeviceTokens(m.Keys)
+	if err != nil {
+		log.Error("UseStorage.GetDeviceTokens(\"%v\") error(%v)", m.Keys, err)
+		return err
+	}
+	rw.Tokens = tokens
+	return nil
+}
+
 // Server Ping interface
 func (r *MessageRPC) Ping(p int, ret *int) error {
 	log.Debug("ping ok")
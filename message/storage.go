@@ -22,17 +22,42 @@ var (
 type Storage interface {
 	// GetPrivate get private msgs.
 	GetPrivate(key string, mid int64) ([]*rpc.Message, error)
-	// SavePrivate Save single private msg.
-	SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) error
+	// SavePrivate Save single private msg, expireAt is the delivery deadline, 0 never,
+	// if collapseKey not empty the former msg with the same collapse key is replaced.
+	SavePrivate(key string, msg json.RawMessage, mid int64, expire uint, expireAt int64, collapseKey string) error
 	// Save private msgs return failed keys.
-	SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) error
+	SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint, expireAt int64, collapseKey string) error
 	// DelPrivate delete private msgs.
 	DelPrivate(key string) error
-	// GetUserMsg get user msgs.
+	// GetUserMsg get all the chat msgs of the session.
 	GetUserMsg(sessionId string) ([]*rpc.Message, error)
-	// SaveUserMsg Save single user msg.
-	SaveUserMsg(sessionId string, msg json.RawMessage, mid int64, expire uint) error
-	
+	// SaveUserMsg Save single chat msg with the sender role.
+	SaveUserMsg(sessionId, role string, msg json.RawMessage, mid int64, expire uint) error
+	// GetConversation get a page of chat msgs older than the before msg id, return if more msgs exist.
+	GetConversation(sessionId string, before int64, limit int) ([]*rpc.Message, bool, error)
+	// TouchChatSession refresh the chat session active time, return the operator.
+	TouchChatSession(sessionId string) (string, error)
+	// GetChatSessions get the latest active chat sessions.
+	GetChatSessions(limit int) ([]*rpc.ChatSession, error)
+	// ClaimChatSession assign the session to the operator if not claimed, return the current operator.
+	ClaimChatSession(sessionId, operator string) (string, error)
+	// ReleaseChatSession release the session back to robot if claimed by the operator, return the current operator.
+	ReleaseChatSession(sessionId, operator string) (string, error)
+	// SaveSchedule save a scheduled push.
+	SaveSchedule(s *rpc.SchedulePush) error
+	// GetSchedules get the pending scheduled pushes ordered by delivery time.
+	GetSchedules(limit int) ([]*rpc.SchedulePush, error)
+	// DelSchedule cancel a scheduled push, return false if not exist.
+	DelSchedule(id string) (bool, error)
+	// PopDueSchedules remove and return the scheduled pushes due at now,
+	// a schedule is returned only once.
+	PopDueSchedules(now int64, limit int) ([]*rpc.SchedulePush, error)
+	// SaveDeviceToken register a push gateway token of the key.
+	SaveDeviceToken(key, platform, token string) error
+	// DelDeviceToken unregister a push gateway token of the key.
+	DelDeviceToken(key, platform, token string) error
+	// GetDeviceTokens get the push gateway tokens of the keys.
+	GetDeviceTokens(keys []string) (map[string][]*rpc.DeviceToken, error)
 }
 
 // InitStorage init the storage type(mysql or redis).
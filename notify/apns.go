@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// apnsPayload is the body of the apns request.
+type apnsPayload struct {
+	Aps   apnsAps         `json:"aps"`
+	Msg   json.RawMessage `json:"msg,omitempty"`
+	MsgId int64           `json:"mid,omitempty"`
+}
+
+type apnsAps struct {
+	Alert            string `json:"alert,omitempty"`
+	ContentAvailable int    `json:"content-available,omitempty"`
+}
+
+// apnsError is the body answered by apns when the request failed, eg: {"reason":"BadDeviceToken"}.
+type apnsError struct {
+	Reason string `json:"reason"`
+}
+
+// APNsNotifier send notifications through the apns http/2 provider api.
+type APNsNotifier struct {
+	url    string
+	auth   string
+	topic  string
+	client *http.Client
+}
+
+// Notify implements the Notifier Notify method.
+func (a *APNsNotifier) Notify(n *Notification) error {
+	p := &apnsPayload{Aps: apnsAps{Alert: n.Alert}, Msg: n.Msg, MsgId: n.MsgId}
+	if n.Alert == "" {
+		p.Aps.ContentAvailable = 1
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", a.url+"/3/device/"+n.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.auth != "" {
+		req.Header.Set("Authorization", "bearer "+a.auth)
+	}
+	if a.topic != "" {
+		req.Header.Set("apns-topic", a.topic)
+	}
+	// silent notifications must use priority 5
+	if n.Priority >= highPriority && n.Alert != "" {
+		req.Header.Set("apns-priority", "10")
+	} else {
+		req.Header.Set("apns-priority", "5")
+	}
+	if n.ExpireAt > 0 {
+		req.Header.Set("apns-expiration", strconv.FormatInt(n.ExpireAt, 10))
+	}
+	if n.CollapseKey != "" {
+		req.Header.Set("apns-collapse-id", n.CollapseKey)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		log.Error("apns post \"%s\" error(%v)", a.url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+	ae := &apnsError{}
+	json.Unmarshal(data, ae)
+	log.Warn("apns post \"%s\" status: %d reason: \"%s\"", a.url, resp.StatusCode, ae.Reason)
+	if resp.StatusCode == http.StatusGone || ae.Reason == "BadDeviceToken" || ae.Reason == "Unregistered" {
+		return ErrTokenInvalid
+	}
+	return ErrStatus
+}
@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// fcmRequest is the body of the fcm http request.
+type fcmRequest struct {
+	To           string           `json:"to"`
+	Priority     string           `json:"priority"`
+	CollapseKey  string           `json:"collapse_key,omitempty"`
+	TimeToLive   *int64           `json:"time_to_live,omitempty"`
+	Notification *fcmNotification `json:"notification,omitempty"`
+	Data         fcmData          `json:"data"`
+}
+
+type fcmNotification struct {
+	Body string `json:"body"`
+}
+
+type fcmData struct {
+	Msg   json.RawMessage `json:"msg,omitempty"`
+	MsgId int64           `json:"mid,omitempty"`
+}
+
+// fcmResponse is the body answered by fcm, eg: {"success":0,"failure":1,"results":[{"error":"NotRegistered"}]}.
+type fcmResponse struct {
+	Success int `json:"success"`
+	Failure int `json:"failure"`
+	Results []struct {
+		MessageId string `json:"message_id"`
+		Error     string `json:"error"`
+	} `json:"results"`
+}
+
+// FCMNotifier send notifications through the fcm http api.
+type FCMNotifier struct {
+	url    string
+	auth   string
+	client *http.Client
+}
+
+// Notify implements the Notifier Notify method.
+func (f *FCMNotifier) Notify(n *Notification) error {
+	r := &fcmRequest{To: n.Token, Priority: "normal", CollapseKey: n.CollapseKey, Data: fcmData{Msg: n.Msg, MsgId: n.MsgId}}
+	if n.Priority >= highPriority {
+		r.Priority = "high"
+	}
+	if n.Alert != "" {
+		r.Notification = &fcmNotification{Body: n.Alert}
+	}
+	if n.ExpireAt > 0 {
+		ttl := n.ExpireAt - time.Now().Unix()
+		if ttl < 0 {
+			ttl = 0
+		}
+		r.TimeToLive = &ttl
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.auth != "" {
+		req.Header.Set("Authorization", "key="+f.auth)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		log.Error("fcm post \"%s\" error(%v)", f.url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Warn("fcm post \"%s\" status: %d body: \"%s\"", f.url, resp.StatusCode, string(data))
+		return ErrStatus
+	}
+	fr := &fcmResponse{}
+	if err = json.Unmarshal(data, fr); err != nil {
+		log.Error("json.Unmarshal(\"%s\") error(%v)", string(data), err)
+		return err
+	}
+	if fr.Failure == 0 {
+		return nil
+	}
+	for _, res := range fr.Results {
+		if res.Error == "NotRegistered" || res.Error == "InvalidRegistration" {
+			return ErrTokenInvalid
+		}
+		log.Warn("fcm post \"%s\" error: \"%s\"", f.url, res.Error)
+	}
+	return ErrStatus
+}
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	APNsPlatform = "apns"
+	FCMPlatform  = "fcm"
+	// the priority at or above is delivered immediately by the gateway
+	highPriority = 10
+	maxBody      = 64 * 1024
+)
+
+var (
+	ErrPlatform     = errors.New("unknown notify platform")
+	ErrStatus       = errors.New("notify gateway response status error")
+	ErrTokenInvalid = errors.New("device token invalid or unregistered")
+)
+
+// Notification is a message sent to a device through a third-party push gateway.
+type Notification struct {
+	Token       string          // device token
+	Alert       string          // text shown to the user, empty for a silent notification
+	Msg         json.RawMessage // message content, delivered as custom data
+	MsgId       int64           // message id
+	Priority    int             // the higher is delivered first
+	CollapseKey string          // replace the undelivered notification with the same key
+	ExpireAt    int64           // not delivered after the unix time, 0 the gateway default
+}
+
+// The notifier interface, a notifier deliver notifications to the devices
+// of one platform.
+type Notifier interface {
+	// Notify send the notification, ErrTokenInvalid means the token
+	// should be unregistered.
+	Notify(n *Notification) error
+}
+
+// NewNotifier create a notifier of the platform, url is the gateway address,
+// auth is the apns provider token or the fcm server key, topic is the apns
+// app bundle id (ignored by fcm).
+func NewNotifier(platform, url, auth, topic string, timeout time.Duration) (Notifier, error) {
+	client := &http.Client{Timeout: timeout}
+	switch platform {
+	case APNsPlatform:
+		return &APNsNotifier{url: url, auth: auth, topic: topic, client: client}, nil
+	case FCMPlatform:
+		return &FCMNotifier{url: url, auth: auth, client: client}, nil
+	default:
+		return nil, ErrPlatform
+	}
+}
@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPNsNotifier(t *testing.T) {
+	reqs := make(chan *http.Request, 2)
+	bodies := make(chan []byte, 2)
+	// fake apns
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs <- r
+		bodies <- body
+		if r.URL.Path == "/3/device/gone" {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+			return
+		}
+	}))
+	defer ts.Close()
+	n, err := NewNotifier(APNsPlatform, ts.URL, "jwt", "com.example.app", time.Second)
+	if err != nil {
+		t.Fatalf("NewNotifier() error(%v)", err)
+	}
+	err = n.Notify(&Notification{Token: "t1", Alert: "hi", Msg: json.RawMessage(`{"a":1}`), MsgId: 7, Priority: 10, CollapseKey: "c", ExpireAt: 100})
+	if err != nil {
+		t.Fatalf("n.Notify() error(%v)", err)
+	}
+	r, body := <-reqs, <-bodies
+	if r.URL.Path != "/3/device/t1" || r.Header.Get("Authorization") != "bearer jwt" || r.Header.Get("apns-topic") != "com.example.app" {
+		t.Errorf("request path: %s headers: %v", r.URL.Path, r.Header)
+	}
+	if r.Header.Get("apns-priority") != "10" || r.Header.Get("apns-expiration") != "100" || r.Header.Get("apns-collapse-id") != "c" {
+		t.Errorf("request headers: %v", r.Header)
+	}
+	if string(body) != `{"aps":{"alert":"hi"},"msg":{"a":1},"mid":7}` {
+		t.Errorf("request body: %s", body)
+	}
+	if err = n.Notify(&Notification{Token: "gone", Priority: 10}); err != ErrTokenInvalid {
+		t.Errorf("unregistered token error(%v)", err)
+	}
+	r, body = <-reqs, <-bodies
+	// silent notification
+	if r.Header.Get("apns-priority") != "5" || string(body) != `{"aps":{"content-available":1}}` {
+		t.Errorf("silent request priority: %s body: %s", r.Header.Get("apns-priority"), body)
+	}
+}
+
+func TestFCMNotifier(t *testing.T) {
+	reqs := make(chan *fcmRequest, 2)
+	// fake fcm
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "key=server" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fr := &fcmRequest{}
+		json.NewDecoder(r.Body).Decode(fr)
+		reqs <- fr
+		if fr.To == "bad" {
+			w.Write([]byte(`{"success":0,"failure":1,"results":[{"error":"NotRegistered"}]}`))
+			return
+		}
+		w.Write([]byte(`{"success":1,"failure":0,"results":[{"message_id":"m1"}]}`))
+	}))
+	defer ts.Close()
+	n, _ := NewNotifier(FCMPlatform, ts.URL, "server", "", time.Second)
+	err := n.Notify(&Notification{Token: "t1", Alert: "hi", Msg: json.RawMessage(`"x"`), MsgId: 7, Priority: 10, CollapseKey: "c", ExpireAt: time.Now().Unix() + 60})
+	if err != nil {
+		t.Fatalf("n.Notify() error(%v)", err)
+	}
+	fr := <-reqs
+	if fr.To != "t1" || fr.Priority != "high" || fr.CollapseKey != "c" || fr.Notification == nil || fr.Notification.Body != "hi" || string(fr.Data.Msg) != `"x"` || fr.Data.MsgId != 7 {
+		t.Errorf("request: %+v", fr)
+	}
+	if fr.TimeToLive == nil || *fr.TimeToLive < 59 || *fr.TimeToLive > 60 {
+		t.Errorf("request time_to_live: %v", fr.TimeToLive)
+	}
+	if err = n.Notify(&Notification{Token: "bad"}); err != ErrTokenInvalid {
+		t.Errorf("unregistered token error(%v)", err)
+	}
+	if fr = <-reqs; fr.Priority != "normal" || fr.Notification != nil {
+		t.Errorf("request: %+v", fr)
+	}
+	n, _ = NewNotifier(FCMPlatform, ts.URL, "wrong", "", time.Second)
+	if err = n.Notify(&Notification{Token: "t1"}); err != ErrStatus {
+		t.Errorf("unauthorized error(%v)", err)
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	if _, err := NewNotifier("sms", "", "", "", time.Second); err != ErrPlatform {
+		t.Errorf("unknown platform error(%v)", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+var (
+	ErrAgentRet = errors.New("agent api failed")
+)
+
+// agentResp is the response of the agent http api.
+type agentResp struct {
+	Ret  int             `json:"ret"`
+	Data json.RawMessage `json:"data"`
+}
+
+// agentGet call the agent get api, the data of the response is returned.
+func agentGet(addr, uri string, params url.Values) (json.RawMessage, error) {
+	return agentDo("GET", addr, uri, params, nil)
+}
+
+// agentPost call the agent post api, the data of the response is returned.
+func agentPost(addr, uri string, params url.Values, body []byte) (json.RawMessage, error) {
+	return agentDo("POST", addr, uri, params, body)
+}
+
+// agentDo call the agent http api, a response with a non-zero ret is an error.
+func agentDo(method, addr, uri string, params url.Values, body []byte) (json.RawMessage, error) {
+	u := fmt.Sprintf("http://%s%s", addr, uri)
+	if len(params) != 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: Conf.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := &agentResp{}
+	if err = json.Unmarshal(b, res); err != nil {
+		return nil, err
+	}
+	if res.Ret != 0 {
+		return nil, fmt.Errorf("%v, %s ret: %d", ErrAgentRet, uri, res.Ret)
+	}
+	return res.Data, nil
+}
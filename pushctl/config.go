@@ -0,0 +1,66 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"flag"
+	"github.com/lucas-chi/push-service/conf"
+	"os"
+	"time"
+)
+
+var (
+	Conf     *Config
+	ConfFile string
+)
+
+func init() {
+	flag.StringVar(&ConfFile, "c", "./pushctl.conf", " set pushctl config file path, the defaults are used if the file not exists")
+}
+
+type Config struct {
+	// agent
+	AgentAddr  string        `goconf:"agent:addr"`
+	AdminAddr  string        `goconf:"agent:admin.addr"`
+	Timeout    time.Duration `goconf:"agent:timeout:time"`
+	RPCTimeout time.Duration `goconf:"rpc:timeout:time"`
+	Log        string        `goconf:"base:log"`
+	// zookeeper
+	ZookeeperAddr        []string      `goconf:"zookeeper:addr:,"`
+	ZookeeperTimeout     time.Duration `goconf:"zookeeper:timeout:time"`
+	ZookeeperCometPath   string        `goconf:"zookeeper:comet.path"`
+	ZookeeperMessagePath string        `goconf:"zookeeper:message.path"`
+	ZookeeperAgentPath   string        `goconf:"zookeeper:agent.path"`
+	ZookeeperMigratePath string        `goconf:"zookeeper:migrate.path"`
+}
+
+// InitConfig get a new Config struct.
+func InitConfig(file string) (*Config, error) {
+	cf := &Config{
+		// agent
+		AgentAddr:  "localhost:80",
+		AdminAddr:  "localhost:81",
+		Timeout:    10 * time.Second,
+		RPCTimeout: 30 * time.Second,
+		Log:        "",
+		// zookeeper
+		ZookeeperAddr:        []string{":2181"},
+		ZookeeperTimeout:     30 * time.Second,
+		ZookeeperCometPath:   "/gopush-cluster-comet",
+		ZookeeperMessagePath: "/gopush-cluster-message",
+		ZookeeperAgentPath:   "/gopush-cluster-agent",
+		ZookeeperMigratePath: "/gopush-migrate-lock",
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return cf, nil
+	}
+	c := conf.New()
+	if err := c.Parse(file); err != nil {
+		log.Error("goconf.Parse(\"%s\") failed (%s)", file, err.Error())
+		return nil, err
+	}
+	if err := c.Unmarshal(cf); err != nil {
+		log.Error("goconf.Unmarshal() failed (%s)", err.Error())
+		return nil, err
+	}
+	return cf, nil
+}
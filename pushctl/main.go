@@ -0,0 +1,419 @@
+// pushctl is the command-line admin tool of the cluster, the pushes and the
+// stats go through the agent http api, the nodes and the weights are read
+// and changed in zookeeper.
+package main
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lucas-chi/push-service/ketama"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	myzk "github.com/lucas-chi/push-service/zk"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: pushctl [-c pushctl.conf] <command> [arguments]
+
+commands:
+  push private -key k [options] [file]   push a private message
+  push multi -keys k1,k2 [options] [file]
+                                         push a private message to multiple keys
+  push public [-ttl s] [-priority p] [file]
+                                         push a public message to every online key
+  msg -key k [-mid n]                    get the offline messages of the key after mid
+  node -key k                            show the comet node the key hashed to
+  nodes                                  list the comet, message and agent nodes
+  weight -node n -weight w               change the weight of the comet node, the agents
+                                         rebuild the ring and the comets migrate in stages
+  migrate                                notify the comet nodes to migrate by the weights
+  stats [-interval 5s] [-count n]        tail the comet stats
+
+the message is read from the file, or stdin if no file or file is "-".
+run "pushctl push private -h" for the push options.
+`
+
+var (
+	ErrUsage = errors.New("invalid arguments")
+	// push options passed through to the agent push api
+	pushOptions = []string{"expire", "ttl", "priority", "collapse_key", "devices", "exdevices", "notify", "alert", "async", "deliver_at"}
+)
+
+func main() {
+	var err error
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if Conf, err = InitConfig(ConfFile); err != nil {
+		fmt.Fprintf(os.Stderr, "InitConfig(\"%s\") error(%v)\n", ConfFile, err)
+		os.Exit(2)
+	}
+	// the library logs are only written if a log config is set
+	if Conf.Log != "" {
+		log.LoadConfiguration(Conf.Log)
+	} else {
+		log.Global = log.NewDefaultLogger(log.CRITICAL)
+	}
+	defer log.Close()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmds := map[string]func([]string) error{
+		"push":    cmdPush,
+		"msg":     cmdMsg,
+		"node":    cmdNode,
+		"nodes":   cmdNodes,
+		"weight":  cmdWeight,
+		"migrate": cmdMigrate,
+		"stats":   cmdStats,
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err = cmd(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "pushctl %s: %v\n", args[0], err)
+		if err == ErrUsage {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// readMsg read the message from the file, or stdin if the file is empty or "-".
+func readMsg(file string) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if file == "" || file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b = bytes.TrimSpace(b); len(b) == 0 {
+		return nil, ErrUsage
+	}
+	return b, nil
+}
+
+// printJSON print the json indented.
+func printJSON(data json.RawMessage) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Indent(buf, data, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(os.Stdout)
+	return err
+}
+
+// zkConnect connect to zookeeper.
+func zkConnect() (*zk.Conn, error) {
+	return myzk.Connect(Conf.ZookeeperAddr, Conf.ZookeeperTimeout)
+}
+
+// cmdPush push a private, multiple private or public message.
+func cmdPush(args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	typ := args[0]
+	fs := flag.NewFlagSet("push "+typ, flag.ExitOnError)
+	key := fs.String("key", "", "subscriber key")
+	keys := fs.String("keys", "", "subscriber keys joined through ','")
+	opts := map[string]*string{}
+	for _, name := range pushOptions {
+		opts[name] = fs.String(name, "", "push option "+name+", see the agent push api")
+	}
+	fs.Parse(args[1:])
+	params := url.Values{}
+	for name, v := range opts {
+		if *v != "" {
+			params.Set(name, *v)
+		}
+	}
+	// the agent requires the expire, 0 the message is not stored offline
+	if params.Get("expire") == "" {
+		params.Set("expire", "0")
+	}
+	var (
+		body []byte
+		err  error
+	)
+	switch typ {
+	case "private":
+		if *key == "" {
+			return ErrUsage
+		}
+		if body, err = readMsg(fs.Arg(0)); err != nil {
+			return err
+		}
+		params.Set("key", *key)
+		data, err := agentPost(Conf.AdminAddr, "/1/admin/push/private", params, body)
+		if err != nil {
+			return err
+		}
+		return printJSON(data)
+	case "multi":
+		if *keys == "" {
+			return ErrUsage
+		}
+		msg, err := readMsg(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if body, err = json.Marshal(map[string]string{"m": string(msg), "k": *keys}); err != nil {
+			return err
+		}
+		data, err := agentPost(Conf.AdminAddr, "/1/admin/push/mprivate", params, body)
+		if err != nil {
+			return err
+		}
+		return printJSON(data)
+	case "public":
+		// public messages are only delivered online, the agent ignores expire
+		if body, err = readMsg(fs.Arg(0)); err != nil {
+			return err
+		}
+		data, err := agentPost(Conf.AdminAddr, "/1/admin/push/public", params, body)
+		if err != nil {
+			return err
+		}
+		return printJSON(data)
+	}
+	return ErrUsage
+}
+
+// cmdMsg print the offline messages of the key.
+func cmdMsg(args []string) error {
+	fs := flag.NewFlagSet("msg", flag.ExitOnError)
+	key := fs.String("key", "", "subscriber key")
+	mid := fs.Int64("mid", 0, "get the messages after the message id")
+	fs.Parse(args)
+	if *key == "" {
+		return ErrUsage
+	}
+	data, err := agentGet(Conf.AgentAddr, "/1/msg/get", url.Values{"k": {*key}, "m": {strconv.FormatInt(*mid, 10)}})
+	if err != nil {
+		return err
+	}
+	return printJSON(data)
+}
+
+// cmdNode print the comet node the key hashed to, the ring is built from the
+// zookeeper weights as the agents do.
+func cmdNode(args []string) error {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	key := fs.String("key", "", "subscriber key")
+	fs.Parse(args)
+	if *key == "" {
+		return ErrUsage
+	}
+	conn, err := zkConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	infos, err := getCometNodes(conn)
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return ErrNodeNotExist
+	}
+	ring := ketama.NewRing(ketama.Base)
+	for name, info := range infos {
+		ring.AddNode(name, info.Weight)
+	}
+	ring.Bake()
+	name := ring.Hash(*key)
+	info := infos[name]
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "node:\t%s\n", name)
+	fmt.Fprintf(w, "weight:\t%d\n", info.Weight)
+	fmt.Fprintf(w, "rpc:\t%s\n", strings.Join(info.RpcAddr, ","))
+	fmt.Fprintf(w, "tcp:\t%s\n", strings.Join(info.TcpAddr, ","))
+	fmt.Fprintf(w, "ws:\t%s\n", strings.Join(info.WsAddr, ","))
+	fmt.Fprintf(w, "sse:\t%s\n", strings.Join(info.SseAddr, ","))
+	fmt.Fprintf(w, "longpoll:\t%s\n", strings.Join(info.PollAddr, ","))
+	fmt.Fprintf(w, "mqtt:\t%s\n", strings.Join(info.MqttAddr, ","))
+	return w.Flush()
+}
+
+// cmdNodes list the comet, message and agent nodes with the weights.
+func cmdNodes(args []string) error {
+	conn, err := zkConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNODE\tWEIGHT\tOWNERSHIP\tRPC")
+	infos, err := getCometNodes(conn)
+	if err != nil {
+		return err
+	}
+	ring := ketama.NewRing(ketama.Base)
+	names := make([]string, 0, len(infos))
+	for name, info := range infos {
+		ring.AddNode(name, info.Weight)
+		names = append(names, name)
+	}
+	ring.Bake()
+	ownership := ring.Ownership()
+	sort.Strings(names)
+	for _, name := range names {
+		info := infos[name]
+		fmt.Fprintf(w, "comet\t%s\t%d\t%.2f%%\t%s\n", name, info.Weight, ownership[name]*100, strings.Join(info.RpcAddr, ","))
+	}
+	for _, t := range []struct{ typ, root string }{{"message", Conf.ZookeeperMessagePath}, {"agent", Conf.ZookeeperAgentPath}} {
+		nodes, err := getNodes(conn, t.root)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			info := &myrpc.MessageNodeInfo{}
+			if err = json.Unmarshal(node.Data, info); err != nil {
+				return fmt.Errorf("node %s: %v", node.Name, err)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t-\t%s\n", t.typ, node.Name, info.Weight, strings.Join(info.Rpc, ","))
+		}
+	}
+	return w.Flush()
+}
+
+// cmdWeight change the weight of the comet node in zookeeper, the agents
+// rebuild the ring and notify the comets to migrate.
+func cmdWeight(args []string) error {
+	fs := flag.NewFlagSet("weight", flag.ExitOnError)
+	node := fs.String("node", "", "comet node name")
+	weight := fs.Int("weight", 0, "new weight, must be positive")
+	fs.Parse(args)
+	if *node == "" || *weight <= 0 {
+		return ErrUsage
+	}
+	conn, err := zkConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	old, err := myrpc.SetCometWeight(conn, Conf.ZookeeperCometPath, *node, *weight)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("comet node %s weight %d -> %d\n", *node, old, *weight)
+	return nil
+}
+
+// cmdMigrate notify every comet node to migrate the keys by the weights.
+func cmdMigrate(args []string) error {
+	conn, err := zkConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := migrate(conn)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(res))
+	for name := range res {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := false
+	for _, name := range names {
+		if err := res[name]; err != nil {
+			failed = true
+			fmt.Printf("%s\tfailed: %v\n", name, err)
+		} else {
+			fmt.Printf("%s\tok\n", name)
+		}
+	}
+	if failed {
+		return myrpc.ErrCometRPC
+	}
+	return nil
+}
+
+// cometStat is the stat of a comet node from the agent cluster api.
+type cometStat struct {
+	Weight    int                   `json:"weight"`
+	Ownership float64               `json:"ownership"`
+	Stats     *myrpc.CometStatsResp `json:"stats"`
+	Error     string                `json:"error"`
+}
+
+// cmdStats print the comet stats every interval.
+func cmdStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	interval := fs.Duration("interval", 5*time.Second, "poll interval")
+	count := fs.Int("count", 0, "stop after the count polls, 0 never")
+	fs.Parse(args)
+	if *interval <= 0 {
+		return ErrUsage
+	}
+	last := map[string]int64{}
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		data, err := agentGet(Conf.AdminAddr, "/1/admin/cluster/comets", nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %v\n", time.Now().Format("15:04:05"), err)
+			continue
+		}
+		res := struct {
+			Comets map[string]*cometStat `json:"comets"`
+		}{}
+		if err = json.Unmarshal(data, &res); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(res.Comets))
+		for name := range res.Comets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		now := time.Now().Format("15:04:05")
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, name := range names {
+			c := res.Comets[name]
+			if c.Stats == nil {
+				fmt.Fprintf(w, "%s\t%s\tweight:%d\t%.2f%%\terror: %s\n", now, name, c.Weight, c.Ownership, c.Error)
+				continue
+			}
+			s := c.Stats
+			prev, ok := last[name]
+			if !ok {
+				prev = s.Conns
+			}
+			fmt.Fprintf(w, "%s\t%s\tweight:%d\t%.2f%%\tchannels:%d\tconns:%d(%+d)\tevicted:%d\tdropped:%d\tspilled:%d\tgoroutines:%d\n",
+				now, name, c.Weight, c.Ownership, s.Channels, s.Conns, s.Conns-prev,
+				s.SlowConsumer["evicted"], s.SlowConsumer["dropped"], s.SlowConsumer["spilled"], s.Goroutines)
+			last[name] = s.Conns
+		}
+		w.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	myrpc "github.com/lucas-chi/push-service/rpc"
+	myzk "github.com/lucas-chi/push-service/zk"
+	"github.com/samuel/go-zookeeper/zk"
+	"net/rpc"
+	"path"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNodeNotExist = errors.New("node not exist")
+	ErrMigrating    = errors.New("another migration is going through")
+)
+
+// zkNode is the registered data of a node, the first child under the node is
+// the leader as the agents select.
+type zkNode struct {
+	Name    string
+	Path    string // leader path
+	Data    []byte
+	Version int32
+}
+
+// getNodes get the leader data of every node under the root path.
+func getNodes(conn *zk.Conn, root string) ([]*zkNode, error) {
+	names, err := myzk.GetNodes(conn, root)
+	if err == myzk.ErrNoChild || err == myzk.ErrNodeNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	nodes := make([]*zkNode, 0, len(names))
+	for _, name := range names {
+		children, err := myzk.GetNodes(conn, path.Join(root, name))
+		if err == myzk.ErrNoChild || err == myzk.ErrNodeNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sort.Strings(children)
+		fpath := path.Join(root, name, children[0])
+		data, stat, err := conn.Get(fpath)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, &zkNode{Name: name, Path: fpath, Data: data, Version: stat.Version})
+	}
+	return nodes, nil
+}
+
+// getCometNodes get the info of every comet node.
+func getCometNodes(conn *zk.Conn) (map[string]*myrpc.CometNodeInfo, error) {
+	nodes, err := getNodes(conn, Conf.ZookeeperCometPath)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[string]*myrpc.CometNodeInfo, len(nodes))
+	for _, node := range nodes {
+		info := &myrpc.CometNodeInfo{}
+		if err = json.Unmarshal(node.Data, info); err != nil {
+			return nil, fmt.Errorf("node %s: %v", node.Name, err)
+		}
+		infos[node.Name] = info
+	}
+	return infos, nil
+}
+
+// migrate notify every comet node to migrate the keys by the current
+// weights, it holds the migrate lock the agents use.
+func migrate(conn *zk.Conn) (map[string]error, error) {
+	infos, err := getCometNodes(conn)
+	if err != nil {
+		return nil, err
+	}
+	weights := make(map[string]int, len(infos))
+	for name, info := range infos {
+		weights[name] = info.Weight
+	}
+	if _, err = conn.Create(Conf.ZookeeperMigratePath, []byte("1"), zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err == zk.ErrNodeExists {
+		return nil, ErrMigrating
+	} else if err != nil {
+		return nil, err
+	}
+	defer conn.Delete(Conf.ZookeeperMigratePath, -1)
+	res := make(map[string]error, len(infos))
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for name, info := range infos {
+		wg.Add(1)
+		go func(name string, info *myrpc.CometNodeInfo) {
+			defer wg.Done()
+			err := migrateNode(info, weights)
+			mutex.Lock()
+			res[name] = err
+			mutex.Unlock()
+		}(name, info)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// migrateNode call the migrate rpc of the comet node.
+func migrateNode(info *myrpc.CometNodeInfo, weights map[string]int) error {
+	if len(info.RpcAddr) == 0 {
+		return myrpc.ErrNoClient
+	}
+	client, err := rpc.Dial("tcp", info.RpcAddr[0])
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ret := 0
+	return myrpc.CallTimeout(client, Conf.RPCTimeout, myrpc.CometServiceMigrate, &myrpc.CometMigrateArgs{Nodes: weights}, &ret)
+}
@@ -1,32 +1,83 @@
-package main
+package robot
 
 import (
+	"encoding/json"
+	"errors"
 	myrpc "github.com/lucas-chi/push-service/rpc"
+	"time"
 )
 
 const (
 	defaultReply = "爱你一万年！"
+	// responder types
+	DictType    = "dict"
+	RulesType   = "rules"
+	WebhookType = "webhook"
 )
 
 var (
-	dic = map[string]string{
+	ErrNoReply       = errors.New("robot has no reply")
+	ErrResponderType = errors.New("unknown robot responder type")
+	dic              = map[string]string{
 		"卖个萌让我开心一下": "今天没吃药，感觉萌萌哒",
-		"如何才能召唤你": "主人来都来了，评价一个先，拜托拜托～",
-		"你喜欢干什么？":"如果经济条件允许的话,我想要到各地去旅游。",
+		"如何才能召唤你":   "主人来都来了，评价一个先，拜托拜托～",
+		"你喜欢干什么？":   "如果经济条件允许的话,我想要到各地去旅游。",
 	}
 )
 
+// The robot reply engine interface.
+type Responder interface {
+	// Reply find a reply for the session message, return ErrNoReply if none.
+	Reply(sessionId, msg string) (string, error)
+}
+
+// Reloader is implemented by the responders which can reload their config.
+type Reloader interface {
+	Reload() error
+}
+
+// New create a responder by type, src is the rules file path or the webhook url.
+func New(typ, src string, timeout time.Duration) (Responder, error) {
+	switch typ {
+	case DictType:
+		return &DictResponder{}, nil
+	case RulesType:
+		return NewRulesResponder(src)
+	case WebhookType:
+		return NewWebhookResponder(src, timeout), nil
+	default:
+		return nil, ErrResponderType
+	}
+}
+
+// DictResponder answer with the built-in dictionary.
+type DictResponder struct {
+}
+
+// Reply implements the Responder Reply method.
+func (r *DictResponder) Reply(sessionId, msg string) (string, error) {
+	return FindReply(msg), nil
+}
+
+// FindReply find a reply in the built-in dictionary.
 func FindReply(msg string) string {
-	if reply, ok := dic[msg];ok {
+	if reply, ok := dic[msg]; ok {
 		return reply
 	} else {
 		return defaultReply
 	}
 }
 
-func Welcome() *myrpc.MessageGetResp {
+// Body get a well-formed json message body: {"body":"text"}.
+func Body(text string) json.RawMessage {
+	b, _ := json.Marshal(map[string]string{"body": text})
+	return json.RawMessage(b)
+}
+
+// Welcome get the welcome messages for a new session.
+func Welcome(text string) *myrpc.MessageGetResp {
 	msgs := make([]*myrpc.Message, 1)
-	m := &myrpc.Message{MsgId: 0, Msg: []byte("\"body\" : \"尊敬的用户，我将竭诚为您服务\"}")}
+	m := &myrpc.Message{MsgId: 0, Msg: Body(text), Role: myrpc.ChatRoleBot}
 	msgs[0] = m
-	return &myrpc.MessageGetResp{Msgs : msgs}
-}
\ No newline at end of file
+	return &myrpc.MessageGetResp{Msgs: msgs}
+}
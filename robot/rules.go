@@ -0,0 +1,120 @@
+package robot
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var (
+	ErrRule = errors.New("robot rule must have a keyword or regex and a reply")
+)
+
+// Rule is a rules file entry, a message contains the keyword or matches the
+// regex is answered with the reply template.
+// eg: [{"keyword":"hello","reply":"hi"},{"regex":"^order (\\d+)$","reply":"order {{index .Match 1}} is shipping"}]
+type Rule struct {
+	Keyword string `json:"keyword"`
+	Regex   string `json:"regex"`
+	Reply   string `json:"reply"`
+	re      *regexp.Regexp
+	tpl     *template.Template
+}
+
+// ReplyData is the data of the reply template.
+type ReplyData struct {
+	SessionId string
+	Msg       string
+	Match     []string // regex submatches
+}
+
+// RulesResponder answer with the first matched rule of the rules file.
+type RulesResponder struct {
+	file  string
+	mutex *sync.RWMutex
+	rules []*Rule
+}
+
+// NewRulesResponder load the rules file.
+func NewRulesResponder(file string) (*RulesResponder, error) {
+	r := &RulesResponder{file: file, mutex: &sync.RWMutex{}}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload implements the Reloader Reload method, the old rules are kept if failed.
+func (r *RulesResponder) Reload() error {
+	data, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		log.Error("ioutil.ReadFile(\"%s\") error(%v)", r.file, err)
+		return err
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		log.Error("robot rules file: \"%s\" error(%v)", r.file, err)
+		return err
+	}
+	r.mutex.Lock()
+	r.rules = rules
+	r.mutex.Unlock()
+	log.Info("robot load %d rules from \"%s\"", len(rules), r.file)
+	return nil
+}
+
+// parseRules parse the json rules and compile the regex and templates.
+func parseRules(data []byte) ([]*Rule, error) {
+	rules := []*Rule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if (rule.Keyword == "" && rule.Regex == "") || rule.Reply == "" {
+			return nil, ErrRule
+		}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, err
+			}
+			rule.re = re
+		}
+		tpl, err := template.New("reply").Parse(rule.Reply)
+		if err != nil {
+			return nil, err
+		}
+		rule.tpl = tpl
+	}
+	return rules, nil
+}
+
+// Reply implements the Responder Reply method.
+func (r *RulesResponder) Reply(sessionId, msg string) (string, error) {
+	r.mutex.RLock()
+	rules := r.rules
+	r.mutex.RUnlock()
+	for _, rule := range rules {
+		data := &ReplyData{SessionId: sessionId, Msg: msg}
+		if rule.re != nil {
+			if data.Match = rule.re.FindStringSubmatch(msg); data.Match == nil {
+				continue
+			}
+		} else if !strings.Contains(msg, rule.Keyword) {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := rule.tpl.Execute(buf, data); err != nil {
+			log.Error("robot rule reply template: \"%s\" error(%v)", rule.Reply, err)
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	return "", ErrNoReply
+}
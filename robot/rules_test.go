@@ -0,0 +1,55 @@
+package robot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRulesResponder(t *testing.T) {
+	f, err := ioutil.TempFile("", "robot-rules")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile() error(%v)", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"keyword":"hello","reply":"hi {{.SessionId}}"},{"regex":"^order (\\d+)$","reply":"order {{index .Match 1}} is shipping"}]`)
+	f.Close()
+	r, err := NewRulesResponder(f.Name())
+	if err != nil {
+		t.Fatalf("NewRulesResponder() error(%v)", err)
+	}
+	if reply, err := r.Reply("s1", "hello robot"); err != nil || reply != "hi s1" {
+		t.Errorf("keyword reply: \"%s\" error(%v)", reply, err)
+	}
+	if reply, err := r.Reply("s1", "order 42"); err != nil || reply != "order 42 is shipping" {
+		t.Errorf("regex reply: \"%s\" error(%v)", reply, err)
+	}
+	if _, err := r.Reply("s1", "bye"); err != ErrNoReply {
+		t.Errorf("unmatched message error(%v)", err)
+	}
+	// reload
+	if err = ioutil.WriteFile(f.Name(), []byte(`[{"keyword":"bye","reply":"see you"}]`), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() error(%v)", err)
+	}
+	if err = r.Reload(); err != nil {
+		t.Fatalf("r.Reload() error(%v)", err)
+	}
+	if reply, err := r.Reply("s1", "bye"); err != nil || reply != "see you" {
+		t.Errorf("reloaded reply: \"%s\" error(%v)", reply, err)
+	}
+	// bad rules keep the old
+	ioutil.WriteFile(f.Name(), []byte(`[{"regex":"(","reply":"x"}]`), 0644)
+	if err = r.Reload(); err == nil {
+		t.Errorf("bad regex reload succeed")
+	}
+	if reply, _ := r.Reply("s1", "bye"); reply != "see you" {
+		t.Errorf("old rules not kept")
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	w := Welcome("hi \"there\"")
+	if len(w.Msgs) != 1 || string(w.Msgs[0].Msg) != `{"body":"hi \"there\""}` {
+		t.Errorf("welcome message error: %s", w.Msgs[0].Msg)
+	}
+}
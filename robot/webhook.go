@@ -0,0 +1,73 @@
+package robot
+
+import (
+	"bytes"
+	log "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookMaxBody = 64 * 1024
+)
+
+var (
+	ErrWebhookStatus = errors.New("robot webhook response status error")
+)
+
+// webhookRequest is the body posted to the robot webhook.
+type webhookRequest struct {
+	SessionId string `json:"sessionId"`
+	Msg       string `json:"msg"`
+}
+
+// webhookResponse is the body answered by the robot webhook, eg: {"reply":"hi"}.
+type webhookResponse struct {
+	Reply string `json:"reply"`
+}
+
+// WebhookResponder ask a http backend for the reply.
+type WebhookResponder struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookResponder create a webhook responder.
+func NewWebhookResponder(url string, timeout time.Duration) *WebhookResponder {
+	return &WebhookResponder{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Reply implements the Responder Reply method.
+func (r *WebhookResponder) Reply(sessionId, msg string) (string, error) {
+	body, err := json.Marshal(&webhookRequest{SessionId: sessionId, Msg: msg})
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("robot webhook post \"%s\" error(%v)", r.url, err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, webhookMaxBody))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Error("robot webhook post \"%s\" status: %d", r.url, resp.StatusCode)
+		return "", ErrWebhookStatus
+	}
+	wr := &webhookResponse{}
+	if err = json.Unmarshal(data, wr); err != nil {
+		log.Error("json.Unmarshal(\"%s\") error(%v)", string(data), err)
+		return "", err
+	}
+	if wr.Reply == "" {
+		return "", ErrNoReply
+	}
+	return wr.Reply, nil
+}
@@ -15,6 +15,8 @@ const (
 	// agent rpc service
 	AgentService             = "AgentRPC"
 	AgentServiceReply  = "AgentRPC.ReplyMessage"
+	AgentServicePresenceEvent = "AgentRPC.PresenceEvent"
+	AgentServiceAckEvent      = "AgentRPC.AckEvent"
 )
 
 var (
@@ -42,6 +44,26 @@ type MessageReplyArgs struct {
 	SessionId    string          //  session ID
 	Msg    json.RawMessage // message content
 	NewSession bool			// new session 
+	Node       string          // comet node which the session connected
+}
+
+// Presence change event args, sent by comet when a key goes online or offline
+type AgentPresenceEventArgs struct {
+	Key    string `json:"key"`    // subscriber key
+	Online bool   `json:"online"` // true: the first connection, false: the last connection closed
+	Proto  string `json:"proto"`  // protocol of the connection
+	Node   string `json:"node"`   // comet node
+	Time   int64  `json:"time"`   // event unix time
+}
+
+// Delivery ack event args, sent by comet when a client acks a pushed message
+type AgentAckEventArgs struct {
+	Key    string `json:"key"`              // subscriber key
+	Device string `json:"device,omitempty"` // device id of the connection, empty if not given
+	MsgId  int64  `json:"mid"`              // acked message id
+	Proto  string `json:"proto"`            // protocol of the connection
+	Node   string `json:"node"`             // comet node
+	Time   int64  `json:"time"`             // ack unix time
 }
 
 // Message SavePrivates response
@@ -0,0 +1,33 @@
+package rpc
+
+import (
+	"context"
+	"net/rpc"
+	"time"
+)
+
+// Call invokes the named function on client and waits for it to complete or
+// for ctx to be done, whichever happens first. A deadline exceeded on ctx is
+// reported as ErrTimeout, the reply must not be used in that case.
+func Call(ctx context.Context, client *rpc.Client, serviceMethod string, args interface{}, reply interface{}) error {
+	if client == nil {
+		return ErrNoClient
+	}
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// CallTimeout invokes the named function on client with a per-call timeout.
+func CallTimeout(client *rpc.Client, timeout time.Duration, serviceMethod string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Call(ctx, client, serviceMethod, args, reply)
+}
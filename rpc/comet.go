@@ -19,7 +19,14 @@ const (
 	cometService             = "CometRPC"
 	CometServicePushPrivate  = "CometRPC.PushPrivate"
 	CometServicePushPrivates = "CometRPC.PushPrivates"
+	CometServicePushPublic   = "CometRPC.PushPublic"
 	CometServiceMigrate      = "CometRPC.Migrate"
+	CometServicePresence     = "CometRPC.Presence"
+	CometServiceKick         = "CometRPC.Kick"
+	CometServiceCloseConn    = "CometRPC.CloseConn"
+	CometServiceStats        = "CometRPC.Stats"
+	// max length of the close reason code
+	maxCloseReason = 32
 )
 
 var (
@@ -29,15 +36,20 @@ var (
 	// Ketama algorithm for check Comet node
 	cometRing   *ketama.HashRing
 	ErrCometRPC = errors.New("comet rpc call failed")
+	// weight must be positive
+	ErrCometWeight = errors.New("comet weight must be positive")
 )
 
 // CometNodeData stored in zookeeper
 type CometNodeInfo struct {
-	RpcAddr []string `json:"rpc"`
-	TcpAddr []string `json:"tcp"`
-	WsAddr  []string `json:"ws"`
-	Weight  int      `json:"weight"`
-	Rpc     *WeightRpc `json:"-"`
+	RpcAddr  []string   `json:"rpc"`
+	TcpAddr  []string   `json:"tcp"`
+	WsAddr   []string   `json:"ws"`
+	SseAddr  []string   `json:"sse"`
+	PollAddr []string   `json:"longpoll"`
+	MqttAddr []string   `json:"mqtt"`
+	Weight   int        `json:"weight"`
+	Rpc      *WeightRpc `json:"-"`
 }
 
 type CometNodeEvent struct {
@@ -49,29 +61,49 @@ type CometNodeEvent struct {
 	Event int
 }
 
+// Channel Push Private Message response
+type CometPushPrivateResp struct {
+	Online int   // live connections got the message
+	MsgId  int64 // message id
+}
+
 // Channel Push Private Message Args
 type CometPushPrivateArgs struct {
-	Key    string          // subscriber key
-	Msg    json.RawMessage // message content
-	Expire uint            // message expire second
+	Key         string          // subscriber key
+	Msg         json.RawMessage // message content
+	Expire      uint            // message expire second
+	ExpireAt    int64           // message delivery deadline unix time, 0 never
+	Priority    int             // the higher is delivered first
+	CollapseKey string          // replace the undelivered message with the same key
+	Devices     []string        // only push to the devices, empty all
+	ExDevices   []string        // not push to the devices
 }
 
 // Channel Push multi Private Message Args
 type CometPushPrivatesArgs struct {
-	Keys   []string        // subscriber keys
-	Msg    json.RawMessage // message content
-	Expire uint            // message expire second
+	Keys        []string        // subscriber keys
+	Msg         json.RawMessage // message content
+	Expire      uint            // message expire second
+	ExpireAt    int64           // message delivery deadline unix time, 0 never
+	Priority    int             // the higher is delivered first
+	CollapseKey string          // replace the undelivered message with the same key
+	Devices     []string        // only push to the devices, empty all
+	ExDevices   []string        // not push to the devices
 }
 
 // Channel Push multi Private Message response
 type CometPushPrivatesResp struct {
 	FKeys []string // subscriber keys
+	OKeys []string // offline keys, pushed but without live connection
+	MsgId int64    // message id of the pushed keys
 }
 
 // Channel Push Public Message Args
 type CometPushPublicArgs struct {
-	MsgID int64  // message id
-	Msg   string // message content
+	MsgId    int64           // message id, the same on every comet node
+	Msg      json.RawMessage // message content
+	ExpireAt int64           // message delivery deadline unix time, 0 never
+	Priority int             // the higher is delivered first
 }
 
 // Channel Migrate Args
@@ -79,6 +111,86 @@ type CometMigrateArgs struct {
 	Nodes map[string]int // current comet nodes
 }
 
+// Channel Presence Args
+type CometPresenceArgs struct {
+	Keys []string // subscriber keys
+}
+
+// PresenceConn is a live connection of a subscriber key.
+type PresenceConn struct {
+	Proto    string `json:"proto"`              // tcp, tcpframe, websocket, sse, longpoll or mqtt
+	Addr     string `json:"addr"`               // client remote address
+	Ctime    int64  `json:"ctime"`              // connect unix time
+	Device   string `json:"device,omitempty"`   // device id
+	Platform string `json:"platform,omitempty"` // device platform label
+}
+
+// Presence is the online state of a subscriber key.
+type Presence struct {
+	Count int             `json:"count"` // live connection count, 0 offline
+	Node  string          `json:"node"`  // comet node
+	Conns []*PresenceConn `json:"conns,omitempty"`
+}
+
+// Channel Presence response
+type CometPresenceResp struct {
+	Presences map[string]*Presence // key -> presence
+	FKeys     []string             // keys not belong to the comet
+}
+
+// Channel Kick Args
+type CometKickArgs struct {
+	Key    string // subscriber key
+	Device string // device id
+}
+
+// Channel CloseConn Args
+type CometCloseConnArgs struct {
+	Key     string   // subscriber key
+	Devices []string // the devices to close, empty all
+	Reason  string   // reason code sent to the client, empty "k"
+	Ban     int64    // ban the re-subscription second, 0 no ban
+}
+
+// ValidCloseReason check the close reason code only contains letters, digits, '_' and '-'.
+func ValidCloseReason(reason string) bool {
+	if len(reason) > maxCloseReason {
+		return false
+	}
+	for _, r := range reason {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Comet Stats response
+type CometStatsResp struct {
+	Channels     int              `json:"channels"`      // subscriber keys
+	Conns        int64            `json:"conns"`         // live connections
+	ProtoConns   map[string]int64 `json:"proto_conns"`   // protocol -> live connections
+	Acks         int64            `json:"acks"`          // delivery acks
+	ProtoAcks    map[string]int64 `json:"proto_acks"`    // protocol -> delivery acks
+	SlowConsumer map[string]int64 `json:"slow_consumer"` // evicted, dropped, spilled
+	Goroutines   int              `json:"goroutines"`
+	Uptime       int64            `json:"uptime"` // second
+}
+
+// CometNodes get all the comet nodes info, the returned map must not be modified.
+func CometNodes() map[string]*CometNodeInfo {
+	return cometNodeInfoMap
+}
+
+// CometOwnership get the fraction of the keys hashed to every comet node.
+func CometOwnership() map[string]float64 {
+	ring := cometRing
+	if ring == nil {
+		return map[string]float64{}
+	}
+	return ring.Ownership()
+}
+
 // Channel New Args
 type CometNewArgs struct {
 	Expire int64  // message expire second
@@ -159,7 +271,7 @@ func handleCometNodeEvent(conn *zk.Conn, migrateLockPath, fpath string, retry, p
 		// if node del this will clean the resource
 		// if node update, after reuse rpc connection, this will clean the resource
 		if info, ok := cometNodeInfoMap[ev.Key]; ok {
-			if info != nil && info.Rpc != nil {
+			if info != nil && info.Rpc != nil && !reuseRpc(info, ev.Value) {
 				info.Rpc.Close()
 			}
 		}
@@ -194,6 +306,11 @@ func handleCometNodeEvent(conn *zk.Conn, migrateLockPath, fpath string, retry, p
 	}
 }
 
+// reuseRpc check the new node info reuses the rpc connection of the old.
+func reuseRpc(old, info *CometNodeInfo) bool {
+	return info != nil && info.Rpc != nil && info.Rpc.Client == old.Rpc.Client
+}
+
 // notify every Comet node to migrate
 func notifyMigrate(conn *zk.Conn, migrateLockPath, znode, key string, update bool, nodeWeightMap map[string]int) (err error) {
 	// try lock
@@ -269,29 +386,36 @@ func watchCometNode(conn *zk.Conn, node, fpath string, retry, ping time.Duration
 		}
 		// leader selection
 		sort.Strings(nodes)
-		if info, err := registerCometNode(conn, nodes[0], fpath, retry, ping, true); err != nil {
+		info, dataWatch, err := registerCometNode(conn, nodes[0], fpath, retry, ping, true)
+		if err != nil {
 			log.Error("zk path: \"%s\" registerCometNode error(%v)", fpath, err)
 			time.Sleep(waitNodeDelaySecond)
 			continue
-		} else {
-			// update node info
-			ch <- &CometNodeEvent{Event: eventNodeUpdate, Key: node, Value: info}
 		}
-		// blocking receive event
-		event := <-watch
-		log.Info("zk path: \"%s\" receive a event: (%v)", fpath, event)
+		// update node info
+		ch <- &CometNodeEvent{Event: eventNodeUpdate, Key: node, Value: info}
+		// blocking receive event, the leader data changes when the weight changed
+		select {
+		case event := <-watch:
+			log.Info("zk path: \"%s\" receive a event: (%v)", fpath, event)
+		case event := <-dataWatch:
+			log.Info("zk path: \"%s\" leader \"%s\" receive a event: (%v)", fpath, nodes[0], event)
+		}
 	}
 	// WARN, if no persistence node and comet rpc not config
 	log.Warn("zk path: \"%s\" never watch again till recreate", fpath)
 }
 
-// registerCometNode get infomation of comet node
-func registerCometNode(conn *zk.Conn, node, fpath string, retry, ping time.Duration, startPing bool) (info *CometNodeInfo, err error) {
+// registerCometNode get infomation of comet node, the returned watch fires
+// when the node data changed.
+func registerCometNode(conn *zk.Conn, node, fpath string, retry, ping time.Duration, startPing bool) (info *CometNodeInfo, watch <-chan zk.Event, err error) {
+	// the comet node name
+	name := path.Base(fpath)
 	// get current node info from zookeeper
 	fpath = path.Join(fpath, node)
-	data, _, err := conn.Get(fpath)
+	data, _, watch, err := conn.GetW(fpath)
 	if err != nil {
-		log.Error("zk.Get(\"%s\") error(%v)", fpath, err)
+		log.Error("zk.GetW(\"%s\") error(%v)", fpath, err)
 		return
 	}
 	info = &CometNodeInfo{}
@@ -304,31 +428,69 @@ func registerCometNode(conn *zk.Conn, node, fpath string, retry, ping time.Durat
 		err = ErrCometRPC
 		return
 	}
-	// get old node info for finding the old rpc connection
-	oldInfo := cometNodeInfoMap[node]
-	
-	// init comet rpc
-	var (
-		r *rpc.Client
-	)
-	
+	if info.Weight <= 0 {
+		log.Warn("zk nodes: \"%s\" weight %d invalid, use 1", fpath, info.Weight)
+		info.Weight = 1
+	}
+	addr := info.RpcAddr[0]
+	// reuse the old rpc connection if the rpc addr not changed, e.g. only the weight changed
+	if oldInfo := cometNodeInfoMap[name]; oldInfo != nil && oldInfo.Rpc != nil && oldInfo.Rpc.Addr == addr && oldInfo.Rpc.Client != nil {
+		info.Rpc = &WeightRpc{Weight: info.Weight, Addr: addr, Client: oldInfo.Rpc.Client}
+		log.Info("zk path: \"%s\" register nodes: \"%s\", reuse rpc", fpath, node)
+		return
+	}
 	// create rpc client connection
-	if oldInfo == nil || oldInfo.Rpc == nil {
-		addr := info.RpcAddr[0]
-		
-		if r, err = rpc.Dial("tcp", addr); err != nil {
-			log.Error("rpc.Dial(\"%s\") error(%v)", addr, err)
-			return
-		}
-		
-		log.Debug("node:%s addr:%s rpc reconnect", node, addr)
-		info.Rpc = &WeightRpc{Weight: 1, Addr: addr, Client: r}
+	r, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		log.Error("rpc.Dial(\"%s\") error(%v)", addr, err)
+		return
 	}
-	
+	log.Debug("node:%s addr:%s rpc reconnect", node, addr)
+	info.Rpc = &WeightRpc{Weight: info.Weight, Addr: addr, Client: r}
 	log.Info("zk path: \"%s\" register nodes: \"%s\"", fpath, node)
 	return
 }
 
+// SetCometWeight change the weight of the comet node in zookeeper, the agents
+// watching the node rebuild the ring and notify the comets to migrate.
+func SetCometWeight(conn *zk.Conn, fpath, node string, weight int) (old int, err error) {
+	if weight <= 0 {
+		err = ErrCometWeight
+		return
+	}
+	fpath = path.Join(fpath, node)
+	nodes, err := myzk.GetNodes(conn, fpath)
+	if err != nil {
+		log.Error("zk path: \"%s\" getNodes error(%v)", fpath, err)
+		return
+	}
+	// the leader the agents select
+	sort.Strings(nodes)
+	fpath = path.Join(fpath, nodes[0])
+	data, stat, err := conn.Get(fpath)
+	if err != nil {
+		log.Error("zk.Get(\"%s\") error(%v)", fpath, err)
+		return
+	}
+	info := &CometNodeInfo{}
+	if err = json.Unmarshal(data, info); err != nil {
+		log.Error("json.Unmarshal(\"%s\", nodeData) error(%v)", string(data), err)
+		return
+	}
+	old, info.Weight = info.Weight, weight
+	if data, err = json.Marshal(info); err != nil {
+		log.Error("json.Marshal() node:%s error(%v)", node, err)
+		return
+	}
+	// the version check fails if the node changed since read
+	if _, err = conn.Set(fpath, data, stat.Version); err != nil {
+		log.Error("conn.Set(\"%s\",\"%s\",%d) error(%v)", fpath, string(data), stat.Version, err)
+		return
+	}
+	log.Info("zk path: \"%s\" weight %d -> %d", fpath, old, weight)
+	return
+}
+
 // GetComet get the node infomation under the node.
 func GetComet(key string) *CometNodeInfo {
 	if cometRing == nil || len(cometNodeInfoMap) == 0 {
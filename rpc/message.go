@@ -16,13 +16,25 @@ const (
 	PrivateGroupId = 0
 	PublicGroupId  = 1
 	// message rpc service
-	MessageService             = "MessageRPC"
-	MessageServiceGetPrivate   = "MessageRPC.GetPrivate"
-	MessageServiceSavePrivate  = "MessageRPC.SavePrivate"
-	MessageServiceSavePrivates = "MessageRPC.SavePrivates"
-	MessageServiceDelPrivate   = "MessageRPC.DelPrivate"
-	MessageServiceGetUserMsg   = "MessageRPC.GetUserMsg"
-	MessageServiceSaveUserMsg  = "MessageRPC.SaveUserMsg"
+	MessageService                   = "MessageRPC"
+	MessageServiceGetPrivate         = "MessageRPC.GetPrivate"
+	MessageServiceSavePrivate        = "MessageRPC.SavePrivate"
+	MessageServiceSavePrivates       = "MessageRPC.SavePrivates"
+	MessageServiceDelPrivate         = "MessageRPC.DelPrivate"
+	MessageServiceGetUserMsg         = "MessageRPC.GetUserMsg"
+	MessageServiceSaveUserMsg        = "MessageRPC.SaveUserMsg"
+	MessageServiceGetConversation    = "MessageRPC.GetConversation"
+	MessageServiceTouchChatSession   = "MessageRPC.TouchChatSession"
+	MessageServiceGetChatSessions    = "MessageRPC.GetChatSessions"
+	MessageServiceClaimChatSession   = "MessageRPC.ClaimChatSession"
+	MessageServiceReleaseChatSession = "MessageRPC.ReleaseChatSession"
+	MessageServiceSaveSchedule       = "MessageRPC.SaveSchedule"
+	MessageServiceGetSchedules       = "MessageRPC.GetSchedules"
+	MessageServiceDelSchedule        = "MessageRPC.DelSchedule"
+	MessageServicePopDueSchedules    = "MessageRPC.PopDueSchedules"
+	MessageServiceSaveDeviceToken    = "MessageRPC.SaveDeviceToken"
+	MessageServiceDelDeviceToken     = "MessageRPC.DelDeviceToken"
+	MessageServiceGetDeviceTokens    = "MessageRPC.GetDeviceTokens"
 )
 
 var (
@@ -39,6 +51,19 @@ type MessageNodeEvent struct {
 	Event int
 }
 
+// Chat message sender roles
+const (
+	ChatRoleUser     = "user"
+	ChatRoleBot      = "bot"
+	ChatRoleOperator = "operator"
+)
+
+// Message priorities, the higher is delivered first
+const (
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
 // Message node info
 type MessageNodeInfo struct {
 	Rpc    []string `json:"rpc"`
@@ -47,9 +72,39 @@ type MessageNodeInfo struct {
 
 // The Message struct
 type Message struct {
-	Msg     json.RawMessage `json:"msg"` // message content
-	MsgId   int64           `json:"mid"` // message id
-	GroupId uint            `json:"gid"` // group id
+	Msg         json.RawMessage `json:"msg"`                    // message content
+	MsgId       int64           `json:"mid"`                    // message id
+	GroupId     uint            `json:"gid"`                    // group id
+	Role        string          `json:"role,omitempty"`         // chat message sender role
+	Ctime       int64           `json:"ctime,omitempty"`        // chat message create unix time
+	ExpireAt    int64           `json:"expire_at,omitempty"`    // unix time after which the message must not be delivered, 0 never
+	Priority    int             `json:"priority,omitempty"`     // the higher is delivered first
+	CollapseKey string          `json:"collapse_key,omitempty"` // replace the undelivered message with the same key
+	Devices     []string        `json:"-"`                      // only delivered online to the devices, empty all
+	ExDevices   []string        `json:"-"`                      // not delivered online to the devices
+}
+
+// Expired check the message is stale at the unix time now.
+func (m *Message) Expired(now int64) bool {
+	return m.ExpireAt > 0 && m.ExpireAt <= now
+}
+
+// Targets check the message is delivered to the device.
+func (m *Message) Targets(device string) bool {
+	for _, d := range m.ExDevices {
+		if d == device {
+			return false
+		}
+	}
+	if len(m.Devices) == 0 {
+		return true
+	}
+	for _, d := range m.Devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
 }
 
 // The Old Message struct (Compatible), TODO remove it.
@@ -82,18 +137,22 @@ func (m *Message) OldBytes() ([]byte, error) {
 
 // Message SavePrivate args
 type MessageSavePrivateArgs struct {
-	Key    string          // subscriber key
-	Msg    json.RawMessage // message content
-	MsgId  int64           // message id
-	Expire uint            // message expire second
+	Key         string          // subscriber key
+	Msg         json.RawMessage // message content
+	MsgId       int64           // message id
+	Expire      uint            // message expire second
+	ExpireAt    int64           // message delivery deadline unix time, 0 never
+	CollapseKey string          // keep only the latest message with the key
 }
 
 // Message SavePrivates args
 type MessageSavePrivatesArgs struct {
-	Keys   []string        // subscriber keys
-	Msg    json.RawMessage // message content
-	MsgId  int64           // message id
-	Expire uint            // message expire second
+	Keys        []string        // subscriber keys
+	Msg         json.RawMessage // message content
+	MsgId       int64           // message id
+	Expire      uint            // message expire second
+	ExpireAt    int64           // message delivery deadline unix time, 0 never
+	CollapseKey string          // keep only the latest message with the key
 }
 
 // Message SavePrivates response
@@ -116,10 +175,11 @@ type MessageGetPrivateArgs struct {
 
 // Message SaveUserMsg args
 type MessageSaveUserMsgArgs struct {
-	SessionId    string          // sessionId key
-	Msg    json.RawMessage // message content
-	MsgId  int64           // message id
-	Expire uint            // message expire second
+	SessionId string          // sessionId key
+	Msg       json.RawMessage // message content
+	MsgId     int64           // message id
+	Expire    uint            // message expire second
+	Role      string          // sender role, empty means user
 }
 
 // Message GetUserMsg args
@@ -127,11 +187,111 @@ type MessageGetUserMsgArgs struct {
 	SessionId string  // sessionId id
 }
 
+// Message GetConversation args
+type MessageGetConversationArgs struct {
+	SessionId string // session id
+	Before    int64  // only messages older than the message id, 0 means from the latest
+	Limit     int    // max messages
+}
+
+// Message GetConversation response
+type MessageGetConversationResp struct {
+	Msgs []*Message // messages, oldest first
+	More bool       // older messages exist, page with Before set to Msgs[0].MsgId
+}
+
 // Message Get Response
 type MessageGetResp struct {
 	Msgs []*Message // messages
 }
 
+// Chat session info
+type ChatSession struct {
+	SessionId string `json:"sessionId"` // session id
+	Operator  string `json:"operator"`  // operator who claimed the session, empty means robot
+	Atime     int64  `json:"atime"`     // last active unix time
+}
+
+// Message GetChatSessions args
+type MessageGetChatSessionsArgs struct {
+	Limit int // max sessions, latest active first
+}
+
+// Message GetChatSessions response
+type MessageGetChatSessionsResp struct {
+	Sessions []*ChatSession // sessions
+}
+
+// Message ClaimChatSession and ReleaseChatSession args
+type MessageChatOperatorArgs struct {
+	SessionId string // session id
+	Operator  string // operator id
+}
+
+// Message TouchChatSession, ClaimChatSession and ReleaseChatSession response
+type MessageChatOperatorResp struct {
+	Operator string // current operator of the session, empty means robot
+}
+
+// Scheduled push, delivered at DeliverAt
+type SchedulePush struct {
+	Id          string          `json:"id"`                     // schedule id
+	Keys        []string        `json:"keys"`                   // subscriber keys
+	Msg         json.RawMessage `json:"msg"`                    // message content
+	DeliverAt   int64           `json:"deliver_at"`             // delivery unix time
+	Expire      uint            `json:"expire"`                 // message expire second
+	ExpireAt    int64           `json:"expire_at,omitempty"`    // message delivery deadline unix time, 0 never
+	TTL         int64           `json:"ttl,omitempty"`          // message delivery second after deliver_at, 0 never
+	Priority    int             `json:"priority,omitempty"`     // the higher is delivered first
+	CollapseKey string          `json:"collapse_key,omitempty"` // replace the undelivered message with the same key
+	Notify      bool            `json:"notify,omitempty"`       // notify the offline keys through the push gateways
+	Alert       string          `json:"alert,omitempty"`        // the push gateway notification text
+	Devices     []string        `json:"devices,omitempty"`      // only push to the devices, empty all
+	ExDevices   []string        `json:"exdevices,omitempty"`    // not push to the devices
+	Ctime       int64           `json:"ctime"`                  // create unix time
+	Attempts    int             `json:"attempts,omitempty"`     // failed fire attempts, the failed keys are delivered again
+}
+
+// Message GetSchedules args
+type MessageGetSchedulesArgs struct {
+	Limit int // max schedules
+}
+
+// Message PopDueSchedules args
+type MessagePopDueSchedulesArgs struct {
+	Now   int64 // schedules deliver at or before now are due
+	Limit int   // max schedules
+}
+
+// Message GetSchedules and PopDueSchedules response
+type MessageSchedulesResp struct {
+	Schedules []*SchedulePush // schedules ordered by delivery time
+}
+
+// DeviceToken is a third-party push gateway token of a subscriber device.
+type DeviceToken struct {
+	Platform string `json:"platform"` // push gateway, apns or fcm
+	Token    string `json:"token"`    // device token
+	Mtime    int64  `json:"mtime"`    // register unix time
+}
+
+// Message SaveDeviceToken and DelDeviceToken args
+type MessageDeviceTokenArgs struct {
+	Key      string // subscriber key
+	Platform string // push gateway
+	Token    string // device token
+}
+
+// Message GetDeviceTokens args
+type MessageGetDeviceTokensArgs struct {
+	Keys []string // subscriber keys
+}
+
+// Message GetDeviceTokens response
+type MessageGetDeviceTokensResp struct {
+	Tokens map[string][]*DeviceToken // key -> device tokens
+}
+
 // watchMessageRoot watch the message root path.
 func watchMessageRoot(conn *zk.Conn, fpath string, ch chan *MessageNodeEvent) error {
 	for {
@@ -3,11 +3,13 @@ package rpc
 
 import (
 	log "code.google.com/p/log4go"
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net/rpc"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -47,6 +49,13 @@ func (w *WeightRpc) Call(serviceMethod string, args interface{}, reply interface
 	return nil
 }
 
+// CallContext call the weightrpc inner *rpc.Client, give up when ctx is done.
+func (w *WeightRpc) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	// giving up doesn't cancel the pending call, a late reply is still decoded
+	// into reply, so after an error reply must be dropped, not read or reused.
+	return Call(ctx, w.Client, serviceMethod, args, reply)
+}
+
 type byWeight []*WeightRpc
 
 // Len is part of sort.Interface.
@@ -70,11 +79,21 @@ type RandLB struct {
 	s       []*WeightRpc
 	p       []float64
 	exitCH  chan int
+	service string
+}
+
+// BackendStatus is the ping status of a load balancing rpc backend.
+type BackendStatus struct {
+	Addr    string `json:"addr"`
+	Weight  int    `json:"weight"`
+	Alive   bool   `json:"alive"`
+	Latency int64  `json:"latency"` // ping round trip microsecond
+	Error   string `json:"error,omitempty"`
 }
 
 // NewRandLB new a random load balancing object.
 func NewRandLB(clients map[string]*WeightRpc, service string, retry, ping time.Duration, check bool) (*RandLB, error) {
-	r := &RandLB{Clients: clients}
+	r := &RandLB{Clients: clients, service: service}
 	r.initWeightRand()
 	if check && len(clients) > 0 {
 		log.Info("rpc ping start")
@@ -127,6 +146,54 @@ func (r *RandLB) Get() *rpc.Client {
 	return r.s[sort.Search(len(r.p), func(i int) bool { return r.p[i] >= rand.Float64() })].Client
 }
 
+// Status ping every backend concurrently and get the status, the ping gives
+// up when ctx is done.
+func (r *RandLB) Status(ctx context.Context) []*BackendStatus {
+	clients := r.Clients
+	method := fmt.Sprintf("%s.Ping", r.service)
+	res := make([]*BackendStatus, 0, len(clients))
+	wg := &sync.WaitGroup{}
+	for _, client := range clients {
+		if client == nil {
+			continue
+		}
+		st := &BackendStatus{Addr: client.Addr, Weight: client.Weight}
+		res = append(res, st)
+		wg.Add(1)
+		go func(client *WeightRpc, st *BackendStatus) {
+			defer wg.Done()
+			ret := 0
+			now := time.Now()
+			if err := client.CallContext(ctx, method, 0, &ret); err != nil {
+				st.Error = err.Error()
+				return
+			}
+			st.Alive = true
+			st.Latency = int64(time.Since(now) / time.Microsecond)
+		}(client, st)
+	}
+	wg.Wait()
+	sort.Sort(byAddr(res))
+	return res
+}
+
+type byAddr []*BackendStatus
+
+// Len is part of sort.Interface.
+func (r byAddr) Len() int {
+	return len(r)
+}
+
+// Swap is part of sort.Interface.
+func (r byAddr) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// Less is part of sort.Interface.
+func (r byAddr) Less(i, j int) bool {
+	return r[i].Addr < r[j].Addr
+}
+
 // Stop stop the retry connect goroutine and ping goroutines.
 func (r *RandLB) Stop() {
 	if r.exitCH != nil {
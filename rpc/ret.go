@@ -9,6 +9,8 @@ const (
 	// common
 	// ok
 	OK = 0
+	// rpc call timeout
+	TimeoutErr = 65533
 	// param error
 	ParamErr = 65534
 	// internal error
@@ -16,5 +18,7 @@ const (
 )
 
 var (
-	ErrParam = errors.New("parameter error")
+	ErrParam    = errors.New("parameter error")
+	ErrTimeout  = errors.New("rpc call timeout")
+	ErrNoClient = errors.New("rpc client not available")
 )
@@ -0,0 +1,50 @@
+package main
+
+import (
+	log "code.google.com/p/log4go"
+	"flag"
+	"github.com/lucas-chi/push-service/conf"
+	"time"
+)
+
+var (
+	Conf     *Config
+	ConfFile string
+)
+
+func init() {
+	flag.StringVar(&ConfFile, "c", "./connmem.conf", " set gopush-cluster comet connection memory benchmark config file path")
+}
+
+type Config struct {
+	// base
+	Addr      string        `goconf:"base:addr"`
+	Pprof     string        `goconf:"base:pprof"`
+	KeyPrefix string        `goconf:"base:key.prefix"`
+	Conns     int           `goconf:"base:conns"`
+	Heartbeat int           `goconf:"base:heartbeat"`
+	Settle    time.Duration `goconf:"base:settle:time"`
+}
+
+// InitConfig get a new Config struct.
+func InitConfig(file string) (*Config, error) {
+	cf := &Config{
+		// base
+		Addr:      "localhost:6969",
+		Pprof:     "localhost:6971",
+		KeyPrefix: "connmem-",
+		Conns:     10000,
+		Heartbeat: 60,
+		Settle:    5 * time.Second,
+	}
+	c := conf.New()
+	if err := c.Parse(file); err != nil {
+		log.Error("goconf.Parse(\"%s\") failed (%s)", file, err.Error())
+		return nil, err
+	}
+	if err := c.Unmarshal(cf); err != nil {
+		log.Error("goconf.Unmarshal() failed (%s)", err.Error())
+		return nil, err
+	}
+	return cf, nil
+}
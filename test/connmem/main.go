@@ -0,0 +1,149 @@
+// connmem measures the comet memory per subscriber connection, it opens
+// Conf.Conns tcp subscribers and compares the runtime stats the comet pprof
+// reports before and after, run it against the builds to compare.
+package main
+
+import (
+	"bufio"
+	log "code.google.com/p/log4go"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrReply   = errors.New("sub reply error")
+	statRegexp = regexp.MustCompile(`# (Sys|HeapInuse|StackInuse) = (\d+)`)
+	gRegexp    = regexp.MustCompile(`goroutine profile: total (\d+)`)
+)
+
+// Stat is the comet runtime stat.
+type Stat struct {
+	Sys        int64
+	HeapInuse  int64
+	StackInuse int64
+	Goroutine  int64
+}
+
+// getStat get the runtime stat of the comet by pprof.
+func getStat() (*Stat, error) {
+	s := &Stat{}
+	// force a gc, the heap profile reports the last gc
+	body, err := httpGet(fmt.Sprintf("http://%s/debug/pprof/heap?debug=1&gc=1", Conf.Pprof))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range statRegexp.FindAllStringSubmatch(body, -1) {
+		v, _ := strconv.ParseInt(m[2], 10, 64)
+		switch m[1] {
+		case "Sys":
+			s.Sys = v
+		case "HeapInuse":
+			s.HeapInuse = v
+		case "StackInuse":
+			s.StackInuse = v
+		}
+	}
+	if body, err = httpGet(fmt.Sprintf("http://%s/debug/pprof/goroutine?debug=1", Conf.Pprof)); err != nil {
+		return nil, err
+	}
+	if m := gRegexp.FindStringSubmatch(body); m != nil {
+		s.Goroutine, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	return s, nil
+}
+
+func httpGet(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// sub subscribe a key, block until the comet ready.
+func sub(key string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", Conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	hb := strconv.Itoa(Conf.Heartbeat)
+	if _, err = conn.Write([]byte(fmt.Sprintf("*3\r\n$3\r\nsub\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(hb), hb))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if line != "+h\r\n" {
+		conn.Close()
+		return nil, ErrReply
+	}
+	return conn, nil
+}
+
+func main() {
+	var err error
+	flag.Parse()
+	if Conf, err = InitConfig(ConfFile); err != nil {
+		log.Error("InitConfig(\"%s\") error(%v)", ConfFile, err)
+		return
+	}
+	defer log.Close()
+	before, err := getStat()
+	if err != nil {
+		log.Error("getStat() error(%v)", err)
+		return
+	}
+	conns := make([]net.Conn, 0, Conf.Conns)
+	for i := 0; i < Conf.Conns; i++ {
+		key := fmt.Sprintf("%s%d", Conf.KeyPrefix, i)
+		conn, err := sub(key)
+		if err != nil {
+			log.Error("sub(\"%s\") error(%v)", key, err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+	// keep alive while measuring
+	go func() {
+		for {
+			time.Sleep(time.Duration(Conf.Heartbeat) * time.Second / 2)
+			for _, conn := range conns {
+				conn.Write([]byte("h"))
+			}
+		}
+	}()
+	time.Sleep(Conf.Settle)
+	after, err := getStat()
+	if err != nil {
+		log.Error("getStat() error(%v)", err)
+		return
+	}
+	n := int64(len(conns))
+	if n == 0 {
+		log.Error("no connection")
+		return
+	}
+	fmt.Printf("connections:  %d\n", n)
+	fmt.Printf("goroutines:   %d -> %d (%.2f per conn)\n", before.Goroutine, after.Goroutine, float64(after.Goroutine-before.Goroutine)/float64(n))
+	fmt.Printf("sys:          %d bytes per conn\n", (after.Sys-before.Sys)/n)
+	fmt.Printf("heap inuse:   %d bytes per conn\n", (after.HeapInuse-before.HeapInuse)/n)
+	fmt.Printf("stack inuse:  %d bytes per conn\n", (after.StackInuse-before.StackInuse)/n)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}